@@ -0,0 +1,108 @@
+// Command registry-mirror mirrors images from one registry to another as
+// described by a JSON config file; see the mirror package. It is meant to be
+// run on a schedule: state kept between runs means only changed images are
+// copied. It writes a JSON report, and exits with status 1 if any image
+// failed to mirror.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/heroku/docker-registry-client/mirror"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+func main() {
+	configPath := flag.String("config", "", "mirror config file (required)")
+	statePath := flag.String("state", "", "state file, overriding the config's")
+	reportPath := flag.String("report", "-", "where to write the JSON report, or - for stdout")
+	dryRun := flag.Bool("dry-run", false, "report what would be copied without copying it")
+	quiet := flag.Bool("quiet", false, "don't log requests")
+	flag.Parse()
+
+	if *configPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed, err := run(*configPath, *statePath, *reportPath, *dryRun, *quiet)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "registry-mirror:", err)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "registry-mirror: %d images failed\n", failed)
+		os.Exit(1)
+	}
+}
+
+func run(configPath, statePath, reportPath string, dryRun, quiet bool) (int, error) {
+	config, err := mirror.LoadConfig(configPath)
+	if err != nil {
+		return 0, err
+	}
+	if statePath == "" {
+		statePath = config.State
+	}
+
+	m, err := mirror.New(config)
+	if err != nil {
+		return 0, err
+	}
+	m.DryRun = dryRun
+	if quiet {
+		m.Logf = registry.Quiet
+		m.Source.Logf = registry.Quiet
+		m.Destination.Logf = registry.Quiet
+	}
+	if statePath != "" {
+		if m.State, err = mirror.LoadState(statePath); err != nil {
+			return 0, err
+		}
+	}
+
+	// Stop between images on SIGINT or SIGTERM, saving what was done so far.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	report, runErr := m.Run(ctx)
+
+	if statePath != "" && !dryRun {
+		if err := m.State.Save(statePath); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeReport(reportPath, report); err != nil {
+		return 0, err
+	}
+	return report.Failed, runErr
+}
+
+func writeReport(path string, report *mirror.Report) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
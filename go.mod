@@ -7,6 +7,7 @@ require (
 	github.com/docker/libtrust v0.0.0-20160708172513-aabc10ec26b7
 	github.com/gorilla/context v1.1.1
 	github.com/gorilla/mux v0.0.0-20160902153343-0a192a193177
+	github.com/klauspost/compress v1.11.13
 	github.com/opencontainers/go-digest v1.0.0-rc1
 	github.com/sirupsen/logrus v0.10.1-0.20160829202321-3ec0642a7fb6
 	golang.org/x/net v0.0.0-20160930002750-a333c534c871
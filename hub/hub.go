@@ -0,0 +1,117 @@
+// Package hub is a client for the Docker Hub API at hub.docker.com, which
+// knows what the registry API on registry-1.docker.io doesn't: the
+// repositories in a namespace, and when each tag was pushed and how big it is
+// on each platform.
+package hub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// DefaultURL is the Docker Hub API.
+const DefaultURL = "https://hub.docker.com"
+
+// The largest page size the Hub API accepts.
+const maxPageSize = 100
+
+type Client struct {
+	URL    string
+	Client *http.Client
+	Logf   registry.LogfCallback
+
+	// Token is the JWT sent with every request. Login sets it; leave it empty
+	// to use the API anonymously, which only sees public repositories.
+	Token string
+}
+
+/*
+ * Create a new Client for the Docker Hub API, logging in with the given
+ * credentials unless both are empty.
+ */
+func New(ctx context.Context, username, password string) (*Client, error) {
+	return NewWithTransport(ctx, DefaultURL, username, password, http.DefaultTransport)
+}
+
+/*
+ * Create a new Client, as with New, for the Hub API at hubUrl, using the
+ * provided http.RoundTripper as transport.
+ */
+func NewWithTransport(ctx context.Context, hubUrl, username, password string, transport http.RoundTripper) (*Client, error) {
+	client := &Client{
+		URL: strings.TrimSuffix(hubUrl, "/"),
+		Client: &http.Client{
+			Transport: &registry.ErrorTransport{Transport: transport},
+		},
+		Logf: registry.Log,
+	}
+
+	if username != "" || password != "" {
+		if err := client.Login(ctx, username, password); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token string `json:"token"`
+}
+
+// Login exchanges a username and password or personal access token for a JWT
+// through `/v2/users/login`, and uses it from then on.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	url := c.URL + "/v2/users/login"
+	c.Logf("hub.login url=%s username=%s", url, username)
+
+	body, err := json.Marshal(loginRequest{Username: username, Password: password})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var response loginResponse
+	if err := c.do(req, &response); err != nil {
+		return err
+	}
+	c.Token = response.Token
+	return nil
+}
+
+// getJson fetches url and decodes the JSON body into response.
+func (c *Client) getJson(ctx context.Context, url string, response interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, response)
+}
+
+func (c *Client) do(req *http.Request, response interface{}) error {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,175 @@
+package hub_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/hub"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// hubDataSource serves a namespace with three repositories and a repository
+// with two tags, two items per page, to clients holding the token "jwt".
+func hubDataSource(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/users/login" {
+			var login map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&login); err != nil || r.Method != "POST" {
+				t.Errorf("bad login request: %v %v", r.Method, err)
+			}
+			if login["username"] != "user" || login["password"] != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"detail":"Incorrect authentication credentials"}`))
+				return
+			}
+			w.Write([]byte(`{"token":"jwt"}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer jwt" {
+			t.Errorf("expected the JWT, got %q", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("page_size") != "2" {
+			t.Errorf("unexpected page_size = %v", r.URL.Query().Get("page_size"))
+		}
+
+		next := fmt.Sprintf("http://%s%s?page=2&page_size=2", r.Host, r.URL.Path)
+		switch r.URL.Path + "?" + r.URL.Query().Get("page") {
+		case "/v2/namespaces/acme/repositories?":
+			fmt.Fprintf(w, `{"count":3,"next":%q,"results":[{"name":"api","namespace":"acme","last_updated":"2024-01-02T03:04:05Z"},{"name":"web","namespace":"acme"}]}`, next)
+		case "/v2/namespaces/acme/repositories?2":
+			w.Write([]byte(`{"count":3,"next":null,"results":[{"name":"worker","namespace":"acme","is_private":true}]}`))
+		case "/v2/repositories/acme/api/tags?":
+			fmt.Fprintf(w, `{"count":2,"next":%q,"results":[{"name":"latest","digest":"sha256:aaa","last_updated":"2024-01-02T03:04:05Z","images":[{"architecture":"amd64","os":"linux","digest":"sha256:bbb","size":100},{"architecture":"arm64","os":"linux","variant":"v8","digest":"sha256:ccc","size":90}]}]}`, next)
+		case "/v2/repositories/acme/api/tags?2":
+			w.Write([]byte(`{"count":2,"next":null,"results":[{"name":"1.0","digest":"sha256:ddd","images":[]}]}`))
+		default:
+			t.Errorf("unexpected request %v", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func newTestClient(t *testing.T, username, password string) (*hub.Client, func(), error) {
+	ts := httptest.NewServer(hubDataSource(t))
+	client, err := hub.NewWithTransport(context.Background(), ts.URL, username, password, http.DefaultTransport)
+	if client != nil {
+		client.Logf = registry.Quiet
+	}
+	return client, ts.Close, err
+}
+
+func Test_Hub_Repositories(t *testing.T) {
+	client, done, err := newTestClient(t, "user", "pass")
+	defer done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := client.ListRepositories("acme", hub.ListOptions{PageSize: 2})
+	var names []string
+	for {
+		repo, err := it.Next(context.Background())
+		if err == registry.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, repo.FullName())
+		if repo.Name == "api" && !repo.LastUpdated.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Errorf("unexpected last_updated %v", repo.LastUpdated)
+		}
+	}
+
+	expected := []string{"acme/api", "acme/web", "acme/worker"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Got %v but expected %v", names, expected)
+	}
+	if it.Count() != 3 {
+		t.Errorf("expected a count of 3, got %v", it.Count())
+	}
+}
+
+func Test_Hub_Tags(t *testing.T) {
+	client, done, err := newTestClient(t, "user", "pass")
+	defer done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := client.ListTags("acme", "api", hub.ListOptions{PageSize: 2})
+	var tags []hub.Tag
+	for {
+		tag, err := it.Next(context.Background())
+		if err == registry.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+
+	if len(tags) != 2 || tags[0].Name != "latest" || tags[1].Name != "1.0" {
+		t.Fatalf("unexpected tags %+v", tags)
+	}
+	if tags[0].Digest != "sha256:aaa" {
+		t.Errorf("unexpected digest %v", tags[0].Digest)
+	}
+	expected := map[string]int64{"linux/amd64": 100, "linux/arm64/v8": 90}
+	if sizes := tags[0].Sizes(); !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Got sizes %v but expected %v", sizes, expected)
+	}
+}
+
+func Test_Hub_NextOnAnotherHost(t *testing.T) {
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("followed next to another host, with Authorization %q", r.Header.Get("Authorization"))
+	}))
+	defer elsewhere.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/users/login" {
+			w.Write([]byte(`{"token":"jwt"}`))
+			return
+		}
+		fmt.Fprintf(w, `{"count":2,"next":%q,"results":[{"name":"api","namespace":"acme"}]}`, elsewhere.URL+r.URL.Path+"?page=2")
+	}))
+	defer ts.Close()
+	client, err := hub.NewWithTransport(context.Background(), ts.URL, "user", "pass", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Logf = registry.Quiet
+
+	it := client.ListRepositories("acme", hub.ListOptions{})
+	if _, err := it.Next(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := it.Next(context.Background()); err == nil || err == registry.ErrIteratorDone {
+		t.Errorf("expected an error for a next page on another host, got %v", err)
+	}
+}
+
+func Test_Hub_LoginFailure(t *testing.T) {
+	_, done, err := newTestClient(t, "user", "wrong")
+	defer done()
+
+	ue, ok := err.(*url.Error)
+	if !ok {
+		t.Fatalf("expected a *url.Error, got %v", err)
+	}
+	if he, ok := ue.Err.(*registry.HttpStatusError); !ok || he.Response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401, got %v", err)
+	}
+}
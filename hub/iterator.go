@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// ListOptions controls how listings are paged.
+type ListOptions struct {
+	// PageSize is the number of items fetched per request, up to 100. Zero
+	// uses 100.
+	PageSize int
+}
+
+type pageResponse struct {
+	Count   int             `json:"count"`
+	Next    string          `json:"next"`
+	Results json.RawMessage `json:"results"`
+}
+
+// pager walks a paginated Hub listing by following each page's `next` URL.
+type pager struct {
+	client *Client
+	next   string
+	count  int
+	done   bool
+	err    error
+}
+
+func newPager(client *Client, path string, opts ListOptions) pager {
+	n := opts.PageSize
+	if n <= 0 || n > maxPageSize {
+		n = maxPageSize
+	}
+	q := url.Values{}
+	q.Set("page_size", strconv.Itoa(n))
+	return pager{
+		client: client,
+		next:   client.URL + path + "?" + q.Encode(),
+	}
+}
+
+// fetch decodes the next page's results into results. It returns
+// registry.ErrIteratorDone once there are no more pages, and keeps
+// returning the first error it hits.
+func (p *pager) fetch(ctx context.Context, results interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.done {
+		return registry.ErrIteratorDone
+	}
+
+	p.client.Logf("hub.list url=%s", p.next)
+	var page pageResponse
+	if err := p.client.getJson(ctx, p.next, &page); err != nil {
+		p.err = err
+		return err
+	}
+	if len(page.Results) > 0 {
+		if err := json.Unmarshal(page.Results, results); err != nil {
+			p.err = err
+			return err
+		}
+	}
+
+	p.count = page.Count
+	p.done = page.Next == ""
+	if !p.done {
+		// This page is fine; a bad next page fails the fetch of that page.
+		p.next, p.err = p.client.resolve(page.Next)
+	}
+	return nil
+}
+
+// resolve resolves a `next` URL against the client's URL. It refuses URLs
+// on any other host, which the client's token would otherwise be sent to.
+func (client *Client) resolve(next string) (string, error) {
+	base, err := url.Parse(client.URL)
+	if err != nil {
+		return "", err
+	}
+	u, err := base.Parse(next)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != base.Scheme || u.Host != base.Host {
+		return "", fmt.Errorf("refusing to follow next page %s, which isn't on %s", next, client.URL)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// Repository is a repository as described by the Hub API.
+type Repository struct {
+	Name           string    `json:"name"`
+	Namespace      string    `json:"namespace"`
+	RepositoryType string    `json:"repository_type"`
+	Description    string    `json:"description"`
+	IsPrivate      bool      `json:"is_private"`
+	StarCount      int64     `json:"star_count"`
+	PullCount      int64     `json:"pull_count"`
+	LastUpdated    time.Time `json:"last_updated"`
+	DateRegistered time.Time `json:"date_registered"`
+}
+
+// FullName returns the repository's name as used with the registry API, such
+// as "library/alpine".
+func (r Repository) FullName() string {
+	return r.Namespace + "/" + r.Name
+}
+
+// RepositoryIterator lists the repositories in a namespace one at a time.
+// Obtain one with ListRepositories.
+type RepositoryIterator struct {
+	pager pager
+	buf   []Repository
+}
+
+// ListRepositories returns an iterator over the repositories in a namespace,
+// that is a user or organization, through
+// `/v2/namespaces/{namespace}/repositories`.
+func (c *Client) ListRepositories(namespace string, opts ListOptions) *RepositoryIterator {
+	path := fmt.Sprintf("/v2/namespaces/%s/repositories", url.PathEscape(namespace))
+	return &RepositoryIterator{pager: newPager(c, path, opts)}
+}
+
+// Next returns the next repository, or registry.ErrIteratorDone once they
+// have all been returned.
+func (it *RepositoryIterator) Next(ctx context.Context) (Repository, error) {
+	for len(it.buf) == 0 {
+		if err := it.pager.fetch(ctx, &it.buf); err != nil {
+			return Repository{}, err
+		}
+	}
+	repo := it.buf[0]
+	it.buf = it.buf[1:]
+	return repo, nil
+}
+
+// Count returns the total number of repositories reported by the Hub, which
+// is known once Next has been called.
+func (it *RepositoryIterator) Count() int {
+	return it.pager.count
+}
+
+// Repositories returns every repository in a namespace.
+func (c *Client) Repositories(ctx context.Context, namespace string) ([]Repository, error) {
+	it := c.ListRepositories(namespace, ListOptions{})
+	var repos []Repository
+	for {
+		repo, err := it.Next(ctx)
+		if err == registry.ErrIteratorDone {
+			return repos, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+}
@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// Tag is a tag as described by the Hub API.
+type Tag struct {
+	Name          string    `json:"name"`
+	Digest        string    `json:"digest"` // of the manifest or index the tag points to
+	FullSize      int64     `json:"full_size"`
+	LastUpdated   time.Time `json:"last_updated"`
+	TagStatus     string    `json:"tag_status"`
+	TagLastPulled time.Time `json:"tag_last_pulled"`
+	TagLastPushed time.Time `json:"tag_last_pushed"`
+	Images        []Image   `json:"images"`
+}
+
+// Image is one platform's image under a tag.
+type Image struct {
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Variant      string    `json:"variant"`
+	Digest       string    `json:"digest"`
+	Size         int64     `json:"size"`
+	Status       string    `json:"status"`
+	LastPulled   time.Time `json:"last_pulled"`
+	LastPushed   time.Time `json:"last_pushed"`
+}
+
+// Platform returns the image's platform, such as "linux/arm64/v8".
+func (i Image) Platform() string {
+	platform := i.OS + "/" + i.Architecture
+	if i.Variant != "" {
+		platform += "/" + i.Variant
+	}
+	return platform
+}
+
+// Sizes returns the compressed size of the tag's image on each platform.
+func (t Tag) Sizes() map[string]int64 {
+	sizes := make(map[string]int64, len(t.Images))
+	for _, image := range t.Images {
+		sizes[image.Platform()] = image.Size
+	}
+	return sizes
+}
+
+// TagIterator lists the tags of a repository one at a time. Obtain one with
+// ListTags.
+type TagIterator struct {
+	pager pager
+	buf   []Tag
+}
+
+// ListTags returns an iterator over the tags of a repository through
+// `/v2/repositories/{namespace}/{repository}/tags`, most recently updated
+// first. Official images are in the "library" namespace.
+func (c *Client) ListTags(namespace, repository string, opts ListOptions) *TagIterator {
+	path := fmt.Sprintf("/v2/repositories/%s/%s/tags", url.PathEscape(namespace), url.PathEscape(repository))
+	return &TagIterator{pager: newPager(c, path, opts)}
+}
+
+// Next returns the next tag, or registry.ErrIteratorDone once they have all
+// been returned.
+func (it *TagIterator) Next(ctx context.Context) (Tag, error) {
+	for len(it.buf) == 0 {
+		if err := it.pager.fetch(ctx, &it.buf); err != nil {
+			return Tag{}, err
+		}
+	}
+	tag := it.buf[0]
+	it.buf = it.buf[1:]
+	return tag, nil
+}
+
+// Count returns the total number of tags reported by the Hub, which is known
+// once Next has been called.
+func (it *TagIterator) Count() int {
+	return it.pager.count
+}
+
+// Tags returns every tag of a repository.
+func (c *Client) Tags(ctx context.Context, namespace, repository string) ([]Tag, error) {
+	it := c.ListTags(namespace, repository, ListOptions{})
+	var tags []Tag
+	for {
+		tag, err := it.Next(ctx)
+		if err == registry.ErrIteratorDone {
+			return tags, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+}
@@ -0,0 +1,225 @@
+// Package registrytest holds images in memory and serves enough of the
+// registry API to list, pull, push and delete them, for the tests of the
+// packages built on the registry client.
+package registrytest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	ManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+	IndexType    = "application/vnd.oci.image.index.v1+json"
+)
+
+// Registry is an in-memory registry. Manifests are deleted along with their
+// tags, as a real registry does. Lock it to change its fields while it's
+// serving.
+type Registry struct {
+	t *testing.T
+
+	sync.Mutex
+	Blobs     map[digest.Digest][]byte
+	Manifests map[string]map[string]digest.Digest // by repository, then tag
+	Payloads  map[digest.Digest][]byte
+	Types     map[digest.Digest]string
+	Deleted   []digest.Digest // manifests deleted
+	Pushed    int             // manifests pushed
+}
+
+// New starts a registry, and returns a client for it and a function to stop
+// it.
+func New(t *testing.T) (*Registry, *registry.Registry, func()) {
+	f := &Registry{
+		t:         t,
+		Blobs:     map[digest.Digest][]byte{},
+		Manifests: map[string]map[string]digest.Digest{},
+		Payloads:  map[digest.Digest][]byte{},
+		Types:     map[digest.Digest]string{},
+	}
+	ts := httptest.NewTLSServer(f)
+	reg, err := registry.NewWithTransport(ts.URL, "", "", &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Logf = registry.Quiet
+	return f, reg, ts.Close
+}
+
+// Push tags a single-layer linux/amd64 image built at created, and returns its
+// manifest's digest.
+func (f *Registry) Push(repository, tag string, created time.Time) digest.Digest {
+	return f.PushPlatform(repository, tag, created, registry.Platform{OS: "linux", Architecture: "amd64"})
+}
+
+// PushPlatform is Push for an image for platform.
+func (f *Registry) PushPlatform(repository, tag string, created time.Time, platform registry.Platform) digest.Digest {
+	f.Lock()
+	defer f.Unlock()
+
+	config, err := json.Marshal(struct {
+		registry.Platform
+		Created time.Time `json:"created"`
+	}{platform, created.UTC()})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	layer := []byte(repository + ":" + tag + "@" + created.String())
+	f.Blobs[digest.FromBytes(config)] = config
+	f.Blobs[digest.FromBytes(layer)] = layer
+
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"digest":%q,"size":%d},"layers":[{"digest":%q,"size":%d}]}`,
+		ManifestType, digest.FromBytes(config), len(config), digest.FromBytes(layer), len(layer)))
+	return f.put(repository, tag, ManifestType, manifest)
+}
+
+// PushIndex tags an index of the given manifests, each listed for the
+// platform of its image.
+func (f *Registry) PushIndex(repository, tag string, manifests ...digest.Digest) digest.Digest {
+	f.Lock()
+	defer f.Unlock()
+
+	var descriptors []string
+	for _, d := range manifests {
+		var manifest struct {
+			Config registry.Descriptor `json:"config"`
+		}
+		var platform registry.Platform
+		if err := json.Unmarshal(f.Payloads[d], &manifest); err != nil {
+			f.t.Fatal(err)
+		}
+		if err := json.Unmarshal(f.Blobs[manifest.Config.Digest], &platform); err != nil {
+			f.t.Fatal(err)
+		}
+		descriptor, _ := json.Marshal(registry.Descriptor{MediaType: f.Types[d], Digest: d, Size: int64(len(f.Payloads[d])), Platform: &platform})
+		descriptors = append(descriptors, string(descriptor))
+	}
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[%s]}`, IndexType, strings.Join(descriptors, ","))
+	return f.put(repository, tag, IndexType, []byte(index))
+}
+
+// Tag points tag at a manifest the registry has.
+func (f *Registry) Tag(repository, tag string, d digest.Digest) {
+	f.Lock()
+	defer f.Unlock()
+	f.put(repository, tag, f.Types[d], f.Payloads[d])
+}
+
+// put stores a manifest, and tags it unless reference is a digest.
+func (f *Registry) put(repository, reference, mediaType string, payload []byte) digest.Digest {
+	d := digest.FromBytes(payload)
+	f.Payloads[d] = payload
+	f.Types[d] = mediaType
+	if f.Manifests[repository] == nil {
+		f.Manifests[repository] = map[string]digest.Digest{}
+	}
+	if _, err := digest.Parse(reference); err != nil {
+		f.Manifests[repository][reference] = d
+	}
+	return d
+}
+
+func (f *Registry) tags(repository string) []string {
+	var tags []string
+	for tag := range f.Manifests[repository] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (f *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case path == "_catalog":
+		var repositories []string
+		for repository := range f.Manifests {
+			repositories = append(repositories, repository)
+		}
+		sort.Strings(repositories)
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": repositories})
+
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.TrimSuffix(path, "/tags/list")
+		if f.Manifests[repository] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": f.tags(repository)})
+
+	case strings.Contains(path, "/manifests/"):
+		i := strings.Index(path, "/manifests/")
+		repository, reference := path[:i], path[i+len("/manifests/"):]
+		if r.Method == "PUT" {
+			payload, _ := ioutil.ReadAll(r.Body)
+			f.put(repository, reference, r.Header.Get("Content-Type"), payload)
+			f.Pushed++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		d, err := digest.Parse(reference)
+		if err != nil {
+			d = f.Manifests[repository][reference]
+		}
+		payload, ok := f.Payloads[d]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			f.Deleted = append(f.Deleted, d)
+			delete(f.Payloads, d)
+			for tag, tagged := range f.Manifests[repository] {
+				if tagged == d {
+					delete(f.Manifests[repository], tag)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", f.Types[d])
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.Write(payload)
+
+	case strings.HasSuffix(path, "/blobs/uploads/"):
+		w.Header().Set("Location", "/v2/"+path+"session")
+		w.WriteHeader(http.StatusAccepted)
+
+	case strings.Contains(path, "/blobs/uploads/"):
+		content, _ := ioutil.ReadAll(r.Body)
+		f.Blobs[digest.FromBytes(content)] = content
+		w.WriteHeader(http.StatusCreated)
+
+	case strings.Contains(path, "/blobs/"):
+		content, ok := f.Blobs[digest.Digest(path[strings.Index(path, "/blobs/")+len("/blobs/"):])]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+
+	default:
+		f.t.Errorf("unexpected %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
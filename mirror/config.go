@@ -0,0 +1,165 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// Config is the declarative description of a mirror, as read by LoadConfig.
+type Config struct {
+	Source      Endpoint  `json:"source"`
+	Destination Endpoint  `json:"destination"`
+	Mappings    []Mapping `json:"mappings"`
+
+	// State is the file that records what was mirrored between runs.
+	State string `json:"state,omitempty"`
+}
+
+// Endpoint says how to reach a registry.
+type Endpoint struct {
+	URL      string `json:"url"`
+	BasePath string `json:"base_path,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// PasswordEnv names an environment variable to read the password from,
+	// to keep it out of the config file.
+	PasswordEnv string `json:"password_env,omitempty"`
+
+	// CertsDir is a Docker-style certs.d directory for the registry's CA and
+	// client certificates. Insecure turns certificate verification off.
+	CertsDir string `json:"certs_dir,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+}
+
+// Mapping selects repositories and tags in the source registry and says
+// where they go in the destination.
+type Mapping struct {
+	// Source is a repository name, or a path.Match pattern such as
+	// "library/*", which is matched against the source registry's catalog.
+	Source string `json:"source"`
+
+	// Destination is the prefix for the mirrored repositories, so that
+	// "library/alpine" with the prefix "mirror" becomes "mirror/library/alpine".
+	// When empty, repositories keep their names.
+	Destination string `json:"destination,omitempty"`
+
+	// Tags and ExcludeTags are regular expressions. A tag is mirrored if it
+	// matches any of Tags, or Tags is empty, and none of ExcludeTags.
+	Tags        []string `json:"tags,omitempty"`
+	ExcludeTags []string `json:"exclude_tags,omitempty"`
+
+	// Semver is a constraint such as ">=1.20 <2" or "^3.12 || ~3.10.2" that
+	// tags must satisfy; tags that aren't versions are skipped. See
+	// ParseConstraint.
+	Semver string `json:"semver,omitempty"`
+
+	// MaxAge skips images built longer ago than this, going by the created
+	// time in their config, such as "720h" or "30d".
+	MaxAge Duration `json:"max_age,omitempty"`
+
+	// Platforms limits which images are mirrored from multi-platform tags,
+	// written as "os/architecture[/variant]".
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// Duration is a time.Duration that reads from JSON as a string such as
+// "36h" or, for whole days, "30d".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfig reads a Config from a JSON file and checks it.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks that the config names both registries and that every
+// mapping's filters parse.
+func (c *Config) Validate() error {
+	if c.Source.URL == "" || c.Destination.URL == "" {
+		return fmt.Errorf("source and destination registries must both have a url")
+	}
+	if len(c.Mappings) == 0 {
+		return fmt.Errorf("no mappings")
+	}
+	for i, mapping := range c.Mappings {
+		if _, err := compileMapping(mapping); err != nil {
+			return fmt.Errorf("mapping %d (%s): %v", i, mapping.Source, err)
+		}
+	}
+	return nil
+}
+
+// Registry connects to the endpoint. Like registry.New, it doesn't contact
+// the registry until it's used.
+func (e Endpoint) Registry() (*registry.Registry, error) {
+	password := e.Password
+	if e.PasswordEnv != "" {
+		password = os.Getenv(e.PasswordEnv)
+	}
+
+	var reg *registry.Registry
+	var err error
+	switch {
+	case e.Insecure:
+		reg, err = registry.NewInsecure(e.URL, e.Username, password)
+	case e.CertsDir != "":
+		reg, err = registry.NewWithCertsDir(e.URL, e.Username, password, e.CertsDir)
+	default:
+		reg, err = registry.New(e.URL, e.Username, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reg.BasePath = e.BasePath
+	return reg, nil
+}
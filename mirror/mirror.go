@@ -0,0 +1,374 @@
+// Package mirror keeps images in one registry in step with another. A Config
+// maps source repositories, filtered by tag pattern, version and age, to
+// destination repositories; each Run compares manifest digests in the two
+// registries and copies only the images that changed since the last one.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Mirror copies the images selected by Mappings from Source to Destination.
+type Mirror struct {
+	Source      *registry.Registry
+	Destination *registry.Registry
+	Mappings    []Mapping
+
+	// State is what previous runs mirrored. Run updates it; save it with
+	// State.Save to carry it over to the next run. When nil, Run starts
+	// from an empty state.
+	State *State
+
+	// DryRun reports what would be copied without copying it.
+	DryRun bool
+
+	Logf registry.LogfCallback
+}
+
+// New creates a Mirror for config, connecting to both of its registries.
+func New(config *Config) (*Mirror, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	source, err := config.Source.Registry()
+	if err != nil {
+		return nil, fmt.Errorf("source: %v", err)
+	}
+	destination, err := config.Destination.Registry()
+	if err != nil {
+		return nil, fmt.Errorf("destination: %v", err)
+	}
+	return &Mirror{
+		Source:      source,
+		Destination: destination,
+		Mappings:    config.Mappings,
+		Logf:        registry.Log,
+	}, nil
+}
+
+// Action is what a run did with an image.
+type Action string
+
+const (
+	ActionCopied    Action = "copied"
+	ActionUnchanged Action = "unchanged"
+	ActionSkipped   Action = "skipped" // filtered out by age
+	ActionPending   Action = "pending" // would have been copied, in a dry run
+	ActionFailed    Action = "failed"
+)
+
+// Report is the machine-readable result of a run.
+type Report struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	DryRun   bool      `json:"dry_run,omitempty"`
+
+	Copied    int `json:"copied"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"`
+	Pending   int `json:"pending,omitempty"`
+	Failed    int `json:"failed"`
+
+	Images []ImageReport `json:"images"`
+}
+
+// ImageReport is what happened to one tag. When a repository couldn't be
+// listed, its report has no tag.
+type ImageReport struct {
+	Source       string        `json:"source"`
+	Destination  string        `json:"destination"`
+	Action       Action        `json:"action"`
+	SourceDigest digest.Digest `json:"source_digest,omitempty"`
+	Digest       digest.Digest `json:"digest,omitempty"`
+
+	// Reason explains skipped and failed images.
+	Reason string `json:"reason,omitempty"`
+
+	BlobsCopied  int   `json:"blobs_copied,omitempty"`
+	BlobsMounted int   `json:"blobs_mounted,omitempty"`
+	BlobsSkipped int   `json:"blobs_skipped,omitempty"`
+	BytesCopied  int64 `json:"bytes_copied,omitempty"`
+}
+
+func (r *Report) add(image ImageReport) {
+	switch image.Action {
+	case ActionCopied:
+		r.Copied++
+	case ActionUnchanged:
+		r.Unchanged++
+	case ActionSkipped:
+		r.Skipped++
+	case ActionPending:
+		r.Pending++
+	case ActionFailed:
+		r.Failed++
+	}
+	r.Images = append(r.Images, image)
+}
+
+/*
+ * Mirror every image the mappings select. Failures to list or copy are
+ * recorded in the report, which counts them in Failed, and don't stop the
+ * run; an error is only returned if the mappings are invalid or ctx is
+ * cancelled, along with the report so far.
+ */
+func (m *Mirror) Run(ctx context.Context) (*Report, error) {
+	if m.State == nil {
+		m.State = newState()
+	}
+	report := &Report{Started: time.Now().UTC(), DryRun: m.DryRun}
+	defer func() {
+		report.Finished = time.Now().UTC()
+	}()
+
+	for i, mapping := range m.Mappings {
+		compiled, err := compileMapping(mapping)
+		if err != nil {
+			return report, fmt.Errorf("mapping %d (%s): %v", i, mapping.Source, err)
+		}
+		if err := m.runMapping(ctx, compiled, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func (m *Mirror) runMapping(ctx context.Context, mapping *compiledMapping, report *Report) error {
+	repositories, err := m.repositories(ctx, mapping.Source)
+	if err != nil {
+		report.add(ImageReport{Source: mapping.Source, Action: ActionFailed, Reason: err.Error()})
+		return ctx.Err()
+	}
+
+	for _, repository := range repositories {
+		destination := repository
+		if mapping.Destination != "" {
+			destination = path.Join(mapping.Destination, repository)
+		}
+
+		tags, err := m.Source.TagsContext(ctx, repository)
+		if err != nil {
+			report.add(ImageReport{Source: repository, Destination: destination, Action: ActionFailed, Reason: err.Error()})
+			continue
+		}
+		sort.Strings(tags)
+
+		for _, tag := range tags {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !mapping.matchTag(tag) {
+				continue
+			}
+			report.add(m.syncImage(ctx, mapping, repository, destination, tag))
+		}
+	}
+	return nil
+}
+
+// repositories returns the source repositories a mapping names: the
+// repository itself, or those in the catalog that match its pattern.
+func (m *Mirror) repositories(ctx context.Context, source string) ([]string, error) {
+	if !strings.ContainsAny(source, "*?[\\") {
+		return []string{source}, nil
+	}
+
+	var repositories []string
+	it := m.Source.ListRepositoriesMatching(registry.RepositoryListOptions{Include: []string{source}})
+	for {
+		repository, err := it.Next(ctx)
+		if err == registry.ErrIteratorDone {
+			return repositories, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, repository)
+	}
+}
+
+// syncImage brings one destination tag up to date with the source.
+func (m *Mirror) syncImage(ctx context.Context, mapping *compiledMapping, repository, destination, tag string) ImageReport {
+	image := ImageReport{
+		Source:      repository + ":" + tag,
+		Destination: destination + ":" + tag,
+	}
+	fail := func(err error) ImageReport {
+		m.Logf("mirror.failed source=%s destination=%s err=%v", image.Source, image.Destination, err)
+		image.Action = ActionFailed
+		image.Reason = err.Error()
+		return image
+	}
+
+	sourceDigest, err := m.Source.ManifestDigestContext(ctx, repository, tag)
+	if err != nil {
+		return fail(err)
+	}
+	image.SourceDigest = sourceDigest
+
+	previous, seen := m.State.Images[image.Destination]
+	if !seen || previous.SourceDigest != sourceDigest {
+		previous = ImageState{}
+	}
+
+	if mapping.MaxAge > 0 {
+		if previous.Created == nil {
+			config, err := m.Source.ImageConfigForPlatformContext(ctx, repository, sourceDigest.String(), mapping.platform())
+			if err != nil {
+				return fail(err)
+			}
+			previous.Created = config.Created
+		}
+		if created := previous.Created; created != nil && time.Since(*created) > time.Duration(mapping.MaxAge) {
+			image.Action = ActionSkipped
+			image.Reason = fmt.Sprintf("built %s, more than %s ago", created.Format(time.RFC3339), time.Duration(mapping.MaxAge))
+			return image
+		}
+	}
+
+	destinationDigest, err := m.Destination.ManifestDigestContext(ctx, destination, tag)
+	if err != nil && !isNotFound(err) {
+		return fail(err)
+	}
+	if destinationDigest != "" && (destinationDigest == sourceDigest || destinationDigest == previous.Digest) {
+		image.Action = ActionUnchanged
+		image.Digest = destinationDigest
+		m.record(image, previous)
+		return image
+	}
+
+	if m.DryRun {
+		image.Action = ActionPending
+		return image
+	}
+
+	m.Logf("mirror.copy source=%s@%s destination=%s", image.Source, sourceDigest, image.Destination)
+	result, err := registry.Copy(ctx,
+		registry.CopyRef{Registry: m.Source, Reference: repository + "@" + sourceDigest.String()},
+		registry.CopyRef{Registry: m.Destination, Reference: image.Destination},
+		registry.CopyOptions{Platforms: mapping.platforms},
+	)
+	if err != nil {
+		return fail(err)
+	}
+
+	image.Action = ActionCopied
+	image.Digest = result.Digest
+	image.BlobsCopied = result.BlobsCopied
+	image.BlobsMounted = result.BlobsMounted
+	image.BlobsSkipped = result.BlobsSkipped
+	image.BytesCopied = result.BytesCopied
+	m.record(image, previous)
+	return image
+}
+
+func (m *Mirror) record(image ImageReport, previous ImageState) {
+	if m.DryRun {
+		return
+	}
+	m.State.Images[image.Destination] = ImageState{
+		Source:       image.Source,
+		SourceDigest: image.SourceDigest,
+		Digest:       image.Digest,
+		Created:      previous.Created,
+		Synced:       time.Now().UTC(),
+	}
+}
+
+func isNotFound(err error) bool {
+	var statusErr *registry.HttpStatusError
+	return errors.As(err, &statusErr) && statusErr.Response.StatusCode == http.StatusNotFound
+}
+
+// compiledMapping is a Mapping with its filters parsed.
+type compiledMapping struct {
+	Mapping
+	tags        []*regexp.Regexp
+	excludeTags []*regexp.Regexp
+	semver      *Constraint
+	platforms   []registry.Platform
+}
+
+func compileMapping(mapping Mapping) (*compiledMapping, error) {
+	if mapping.Source == "" {
+		return nil, errors.New("no source repository")
+	}
+	if _, err := path.Match(mapping.Source, ""); err != nil {
+		return nil, fmt.Errorf("invalid source pattern: %v", err)
+	}
+
+	compiled := &compiledMapping{Mapping: mapping}
+	for _, pattern := range mapping.Tags {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled.tags = append(compiled.tags, re)
+	}
+	for _, pattern := range mapping.ExcludeTags {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled.excludeTags = append(compiled.excludeTags, re)
+	}
+	if mapping.Semver != "" {
+		constraint, err := ParseConstraint(mapping.Semver)
+		if err != nil {
+			return nil, err
+		}
+		compiled.semver = constraint
+	}
+	for _, s := range mapping.Platforms {
+		platform, err := registry.ParsePlatform(s)
+		if err != nil {
+			return nil, err
+		}
+		compiled.platforms = append(compiled.platforms, platform)
+	}
+	return compiled, nil
+}
+
+func (mapping *compiledMapping) matchTag(tag string) bool {
+	if len(mapping.tags) > 0 && !matchAny(mapping.tags, tag) {
+		return false
+	}
+	if matchAny(mapping.excludeTags, tag) {
+		return false
+	}
+	if mapping.semver != nil {
+		version, err := ParseVersion(tag)
+		if err != nil || !mapping.semver.Check(version) {
+			return false
+		}
+	}
+	return true
+}
+
+// platform is the platform whose config decides an image's age.
+func (mapping *compiledMapping) platform() registry.Platform {
+	if len(mapping.platforms) > 0 {
+		return mapping.platforms[0]
+	}
+	return registry.DefaultPlatform
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
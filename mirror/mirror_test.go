@@ -0,0 +1,163 @@
+package mirror_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/internal/registrytest"
+	"github.com/heroku/docker-registry-client/mirror"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+func Test_Mirror_Run(t *testing.T) {
+	source, sourceReg, done := registrytest.New(t)
+	defer done()
+	destination, destinationReg, done := registrytest.New(t)
+	defer done()
+
+	now := time.Now().UTC()
+	for _, tag := range []string{"3.11", "3.12", "3.13", "3.14-rc.1", "latest"} {
+		source.Push("library/alpine", tag, now)
+	}
+	source.Push("library/busybox", "1.0", now.AddDate(-10, 0, 0))
+	source.Push("library/busybox", "1.1", now)
+	source.Push("library/busybox", "edge", now)
+	source.Push("other/app", "1.0", now)
+
+	var maxAge mirror.Duration
+	if err := json.Unmarshal([]byte(`"30d"`), &maxAge); err != nil {
+		t.Fatal(err)
+	}
+	m := &mirror.Mirror{
+		Source:      sourceReg,
+		Destination: destinationReg,
+		Mappings: []mirror.Mapping{
+			{Source: "library/alpine", Destination: "mirror", Semver: ">=3.12"},
+			{Source: "library/b*", Destination: "mirror", Tags: []string{`^1\.`}, MaxAge: maxAge},
+		},
+		Logf: registry.Quiet,
+	}
+
+	report, err := m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReport(t, report, map[string]mirror.Action{
+		"mirror/library/alpine:3.12": mirror.ActionCopied,
+		"mirror/library/alpine:3.13": mirror.ActionCopied,
+		"mirror/library/busybox:1.0": mirror.ActionSkipped,
+		"mirror/library/busybox:1.1": mirror.ActionCopied,
+	})
+	for _, image := range report.Images {
+		if image.Action == mirror.ActionCopied && image.Digest != image.SourceDigest {
+			t.Errorf("%s: digest changed from %s to %s", image.Destination, image.SourceDigest, image.Digest)
+		}
+	}
+
+	// The state carries over to the next run, which copies nothing.
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+	if err := m.State.Save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if m.State, err = mirror.LoadState(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	copies := destination.Pushed
+	report, err = m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReport(t, report, map[string]mirror.Action{
+		"mirror/library/alpine:3.12": mirror.ActionUnchanged,
+		"mirror/library/alpine:3.13": mirror.ActionUnchanged,
+		"mirror/library/busybox:1.0": mirror.ActionSkipped,
+		"mirror/library/busybox:1.1": mirror.ActionUnchanged,
+	})
+	if destination.Pushed != copies {
+		t.Errorf("expected nothing to be pushed, got %d manifests", destination.Pushed-copies)
+	}
+
+	// Moving a tag upstream copies just that tag; a dry run only reports it.
+	source.Push("library/alpine", "3.13", now.Add(time.Hour))
+	source.Push("library/alpine", "3.15", now)
+
+	m.DryRun = true
+	report, err = m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pending != 2 || destination.Pushed != copies {
+		t.Errorf("expected a dry run to leave the destination alone, got %+v", report)
+	}
+
+	m.DryRun = false
+	report, err = m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReport(t, report, map[string]mirror.Action{
+		"mirror/library/alpine:3.12": mirror.ActionUnchanged,
+		"mirror/library/alpine:3.13": mirror.ActionCopied,
+		"mirror/library/alpine:3.15": mirror.ActionCopied,
+		"mirror/library/busybox:1.0": mirror.ActionSkipped,
+		"mirror/library/busybox:1.1": mirror.ActionUnchanged,
+	})
+}
+
+func Test_Mirror_RecordsFailures(t *testing.T) {
+	_, sourceReg, done := registrytest.New(t)
+	defer done()
+	_, destinationReg, done := registrytest.New(t)
+	defer done()
+
+	m := &mirror.Mirror{
+		Source:      sourceReg,
+		Destination: destinationReg,
+		Mappings:    []mirror.Mapping{{Source: "missing/repository"}},
+		Logf:        registry.Quiet,
+	}
+	report, err := m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 1 || report.Images[0].Reason == "" {
+		t.Errorf("expected the missing repository to be reported as failed, got %+v", report)
+	}
+
+	m.Mappings = []mirror.Mapping{{Source: "x", Tags: []string{"("}}}
+	if _, err := m.Run(context.Background()); err == nil {
+		t.Error("expected an invalid mapping to fail the run")
+	}
+}
+
+func expectReport(t *testing.T, report *mirror.Report, expected map[string]mirror.Action) {
+	t.Helper()
+
+	actions := map[string]mirror.Action{}
+	for _, image := range report.Images {
+		actions[image.Destination] = image.Action
+	}
+	if len(actions) != len(expected) {
+		t.Errorf("expected %d images, got %v", len(expected), actions)
+	}
+	for destination, action := range expected {
+		if actions[destination] != action {
+			t.Errorf("%s: expected %s, got %s", destination, action, actions[destination])
+		}
+	}
+
+	if _, err := json.Marshal(report); err != nil {
+		t.Error(err)
+	}
+}
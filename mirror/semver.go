@@ -0,0 +1,243 @@
+package mirror
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version parsed from a tag. Tags commonly leave out
+// the minor or patch number, or start with "v", so "v3.12" is version 3.12.0.
+type Version struct {
+	Major, Minor, Patch int
+	Prerelease          []string
+
+	// parts is how many of major, minor and patch were given, which decides
+	// what ~ and ^ allow.
+	parts int
+}
+
+// ParseVersion parses a version such as "1.2.3", "v1.2" or "2.0.0-rc.1".
+// Build metadata after "+" is ignored.
+func ParseVersion(s string) (Version, error) {
+	v := Version{}
+	rest := strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		rest = rest[:i]
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		v.Prerelease = strings.Split(rest[i+1:], ".")
+		for _, identifier := range v.Prerelease {
+			if identifier == "" {
+				return Version{}, fmt.Errorf("invalid version %q", s)
+			}
+		}
+		rest = rest[:i]
+	}
+
+	numbers := strings.Split(rest, ".")
+	if len(numbers) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	for i, number := range numbers {
+		n, err := strconv.Atoi(number)
+		if err != nil || n < 0 || (len(number) > 1 && number[0] == '0') {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+		switch i {
+		case 0:
+			v.Major = n
+		case 1:
+			v.Minor = n
+		case 2:
+			v.Patch = n
+		}
+	}
+	v.parts = len(numbers)
+	return v, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 as v is lower than, equal to or higher than w,
+// by semantic version precedence.
+func (v Version) Compare(w Version) int {
+	for _, d := range []int{v.Major - w.Major, v.Minor - w.Minor, v.Patch - w.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+
+	// A prerelease comes before the release itself.
+	switch {
+	case len(v.Prerelease) == 0 && len(w.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(w.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(w.Prerelease); i++ {
+		if c := comparePrerelease(v.Prerelease[i], w.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(v.Prerelease) - len(w.Prerelease))
+}
+
+// comparePrerelease compares prerelease identifiers: numbers numerically and
+// below words, which compare lexically.
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return sign(an - bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// Constraint is a set of version ranges, as parsed by ParseConstraint.
+type Constraint struct {
+	// Any of the groups must be satisfied, and all of a group's comparators.
+	groups     []comparatorGroup
+	prerelease bool
+}
+
+type comparatorGroup []comparator
+
+type comparator struct {
+	op      string
+	version Version
+}
+
+/*
+ * Parse a version constraint. Comparators are separated by spaces or commas
+ * and must all hold; "||" separates alternatives. The operators are =, !=,
+ * <, <=, > and >=, plus ~ (patch updates: ~1.2 means >=1.2.0 <1.3.0) and ^
+ * (updates that don't change the leftmost non-zero number: ^1.2 means
+ * >=1.2.0 <2.0.0). A bare version means =. Prereleases only satisfy
+ * constraints that mention a prerelease.
+ */
+func ParseConstraint(s string) (*Constraint, error) {
+	c := &Constraint{}
+	for _, alternative := range strings.Split(s, "||") {
+		fields := strings.FieldsFunc(alternative, func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid constraint %q", s)
+		}
+
+		var group comparatorGroup
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			op := field[:len(field)-len(strings.TrimLeft(field, "=!<>~^"))]
+			if op == field && i+1 < len(fields) {
+				// An operator separated from its version, as in ">= 1.2".
+				i++
+				field += fields[i]
+			}
+			v, err := ParseVersion(field[len(op):])
+			if err != nil {
+				return nil, fmt.Errorf("invalid constraint %q: %v", s, err)
+			}
+			if len(v.Prerelease) > 0 {
+				c.prerelease = true
+			}
+
+			switch op {
+			case "", "=":
+				group = append(group, comparator{"=", v})
+			case "!=", "<", "<=", ">", ">=":
+				group = append(group, comparator{op, v})
+			case "~":
+				group = append(group, comparator{">=", v}, comparator{"<", tildeLimit(v)})
+			case "^":
+				group = append(group, comparator{">=", v}, comparator{"<", caretLimit(v)})
+			default:
+				return nil, fmt.Errorf("invalid constraint %q: unknown operator %q", s, op)
+			}
+		}
+		c.groups = append(c.groups, group)
+	}
+	return c, nil
+}
+
+// tildeLimit is the first version ~v excludes.
+func tildeLimit(v Version) Version {
+	if v.parts == 1 {
+		return Version{Major: v.Major + 1}
+	}
+	return Version{Major: v.Major, Minor: v.Minor + 1}
+}
+
+// caretLimit is the first version ^v excludes.
+func caretLimit(v Version) Version {
+	switch {
+	case v.Major > 0 || v.parts == 1:
+		return Version{Major: v.Major + 1}
+	case v.Minor > 0 || v.parts == 2:
+		return Version{Minor: v.Minor + 1}
+	default:
+		return Version{Patch: v.Patch + 1}
+	}
+}
+
+// Check reports whether v satisfies the constraint.
+func (c *Constraint) Check(v Version) bool {
+	if len(v.Prerelease) > 0 && !c.prerelease {
+		return false
+	}
+	for _, group := range c.groups {
+		if group.check(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (group comparatorGroup) check(v Version) bool {
+	for _, comparator := range group {
+		c := v.Compare(comparator.version)
+		var ok bool
+		switch comparator.op {
+		case "=":
+			ok = c == 0
+		case "!=":
+			ok = c != 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package mirror_test
+
+import (
+	"testing"
+
+	"github.com/heroku/docker-registry-client/mirror"
+)
+
+func Test_Constraint(t *testing.T) {
+	tcs := []struct {
+		constraint string
+		matches    []string
+		rejects    []string
+	}{
+		{constraint: ">=1.20 <2", matches: []string{"1.20", "v1.21.3", "1.99.0"}, rejects: []string{"1.19.9", "2.0.0", "2.0.0-rc.1"}},
+		{constraint: ">= 1.2, < 1.3", matches: []string{"1.2.0", "1.2.9"}, rejects: []string{"1.3"}},
+		{constraint: "~3.10.2", matches: []string{"3.10.2", "3.10.9"}, rejects: []string{"3.10.1", "3.11.0"}},
+		{constraint: "~3", matches: []string{"3.0", "3.9.9"}, rejects: []string{"4.0"}},
+		{constraint: "^3.12", matches: []string{"3.12", "3.20.1"}, rejects: []string{"3.11", "4"}},
+		{constraint: "^0.2.3", matches: []string{"0.2.3", "0.2.9"}, rejects: []string{"0.3.0", "0.2.2"}},
+		{constraint: "^0.0.3", matches: []string{"0.0.3"}, rejects: []string{"0.0.4"}},
+		{constraint: "^3.12 || ~3.10.2", matches: []string{"3.10.4", "3.15"}, rejects: []string{"3.11.0"}},
+		{constraint: "1.2.3", matches: []string{"1.2.3", "v1.2.3+build.5"}, rejects: []string{"1.2.4"}},
+		{constraint: "!=1.2.3", matches: []string{"1.2.4"}, rejects: []string{"1.2.3"}},
+		{constraint: ">=2.0.0-rc.1", matches: []string{"2.0.0-rc.2", "2.0.0-rc.10", "2.0.0"}, rejects: []string{"2.0.0-beta.5", "2.0.0-rc.0"}},
+	}
+
+	for _, tc := range tcs {
+		c, err := mirror.ParseConstraint(tc.constraint)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.constraint, err)
+		}
+		for _, s := range tc.matches {
+			v, err := mirror.ParseVersion(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.Check(v) {
+				t.Errorf("expected %s to satisfy %s", s, tc.constraint)
+			}
+		}
+		for _, s := range tc.rejects {
+			v, err := mirror.ParseVersion(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Check(v) {
+				t.Errorf("expected %s not to satisfy %s", s, tc.constraint)
+			}
+		}
+	}
+}
+
+func Test_ParseVersion_Invalid(t *testing.T) {
+	for _, s := range []string{"latest", "1.2.3.4", "01.2", "1.2-", "1.2-rc..1", "", "v"} {
+		if _, err := mirror.ParseVersion(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+	for _, s := range []string{"1.2 <", ">>1", "~"} {
+		if _, err := mirror.ParseConstraint(s); err == nil {
+			t.Errorf("expected constraint %q to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package mirror
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// State records what earlier runs mirrored, so that a run only copies what
+// changed. Images are keyed by their destination reference.
+type State struct {
+	Images map[string]ImageState `json:"images"`
+}
+
+// ImageState is what was last mirrored to a destination tag.
+type ImageState struct {
+	Source       string        `json:"source"`
+	SourceDigest digest.Digest `json:"source_digest"`
+
+	// Digest is the manifest digest in the destination. It differs from
+	// SourceDigest when a platform filter rewrote an index.
+	Digest digest.Digest `json:"digest"`
+
+	// Created is the image's build time, kept so that age filters don't
+	// need to fetch its config again while the source digest is unchanged.
+	Created *time.Time `json:"created,omitempty"`
+
+	Synced time.Time `json:"synced"`
+}
+
+func newState() *State {
+	return &State{Images: map[string]ImageState{}}
+}
+
+// LoadState reads the state saved by a previous run. A missing file is an
+// empty state, as for the first run.
+func LoadState(path string) (*State, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newState(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := newState()
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	if state.Images == nil {
+		state.Images = map[string]ImageState{}
+	}
+	return state, nil
+}
+
+// Save writes the state to path, replacing it atomically so that a run that
+// is interrupted leaves the previous state intact.
+func (s *State) Save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -13,6 +13,10 @@ type octetType byte
 type AuthorizationChallenge struct {
 	Scheme     string
 	Parameters map[string]string
+
+	// Token68 is the challenge's token68 value, as some schemes such as
+	// Negotiate send in place of parameters.
+	Token68 string
 }
 
 var octetTypes [256]octetType
@@ -20,6 +24,7 @@ var octetTypes [256]octetType
 const (
 	isToken octetType = 1 << iota
 	isSpace
+	isToken68
 )
 
 func init() {
@@ -38,6 +43,10 @@ func init() {
 	//              | "/" | "[" | "]" | "?" | "=" | "{" | "}" | SP | HT
 	// token      = 1*<any CHAR except CTLs or separators>
 	// qdtext     = <any TEXT except <">>
+	//
+	// and from RFC 7235:
+	//
+	// token68    = 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / "+" / "/" ) *"="
 
 	for c := 0; c < 256; c++ {
 		var t octetType
@@ -50,48 +59,75 @@ func init() {
 		if isChar && !isCtl && !isSeparator {
 			t |= isToken
 		}
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexRune("-._~+/", rune(c)) >= 0 {
+			t |= isToken68
+		}
 		octetTypes[c] = t
 	}
 }
 
+// parseAuthHeader returns the challenges in every WWW-Authenticate header,
+// in order.
 func parseAuthHeader(header http.Header) []*AuthorizationChallenge {
 	var challenges []*AuthorizationChallenge
 	for _, h := range header[http.CanonicalHeaderKey("WWW-Authenticate")] {
-		v, p := parseValueAndParams(h)
-		if v != "" {
-			challenges = append(challenges, &AuthorizationChallenge{Scheme: v, Parameters: p})
-		}
+		challenges = append(challenges, parseChallenges(h)...)
 	}
 	return challenges
 }
 
-func parseValueAndParams(header string) (value string, params map[string]string) {
-	params = make(map[string]string)
-	value, s := expectToken(header)
-	if value == "" {
-		return
-	}
-	value = strings.ToLower(value)
-	s = "," + skipSpace(s)
-	for strings.HasPrefix(s, ",") {
-		var pkey string
-		pkey, s = expectToken(skipSpace(s[1:]))
-		if pkey == "" {
-			return
+// parseChallenges parses a WWW-Authenticate header value as defined by RFC
+// 7235:
+//
+//	WWW-Authenticate = 1#challenge
+//	challenge        = auth-scheme [ 1*SP ( token68 / #auth-param ) ]
+//	auth-param       = token BWS "=" BWS ( token / quoted-string )
+//
+// Challenges and their parameters are both separated by commas; a token
+// followed by "=" is a parameter of the current challenge, and any other
+// token starts a new challenge. Malformed parameters are skipped. Schemes
+// and parameter names are lower-cased.
+func parseChallenges(header string) []*AuthorizationChallenge {
+	var challenges []*AuthorizationChallenge
+	var current *AuthorizationChallenge
+
+	s := header
+	for {
+		s = skipSpaceAndCommas(s)
+		if s == "" {
+			return challenges
 		}
-		if !strings.HasPrefix(s, "=") {
-			return
+
+		token, rest := expectToken(s)
+		if token == "" {
+			s = skipElement(s)
+			continue
 		}
-		var pvalue string
-		pvalue, s = expectTokenOrQuoted(s[1:])
-		if pvalue == "" {
-			return
+
+		if afterKey := skipSpace(rest); current != nil && strings.HasPrefix(afterKey, "=") {
+			// A challenge has either a token68 or parameters, not both.
+			value, rest, ok := expectTokenOrQuoted(skipSpace(afterKey[1:]))
+			if ok && current.Token68 == "" {
+				current.Parameters[strings.ToLower(token)] = value
+			}
+			s = skipElement(rest)
+			continue
+		}
+
+		current = &AuthorizationChallenge{
+			Scheme:     strings.ToLower(token),
+			Parameters: make(map[string]string),
+		}
+		challenges = append(challenges, current)
+
+		s = skipSpace(rest)
+		if token68, rest := expectToken68(s); token68 != "" {
+			if after := skipSpace(rest); after == "" || after[0] == ',' {
+				current.Token68 = token68
+				s = after
+			}
 		}
-		pkey = strings.ToLower(pkey)
-		params[pkey] = pvalue
-		s = skipSpace(s)
 	}
-	return
 }
 
 func skipSpace(s string) (rest string) {
@@ -104,6 +140,33 @@ func skipSpace(s string) (rest string) {
 	return s[i:]
 }
 
+func skipSpaceAndCommas(s string) (rest string) {
+	i := 0
+	for ; i < len(s); i++ {
+		if s[i] != ',' && octetTypes[s[i]]&isSpace == 0 {
+			break
+		}
+	}
+	return s[i:]
+}
+
+// skipElement skips to the comma that ends the current list element, minding
+// quoted strings.
+func skipElement(s string) (rest string) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ',':
+			return s[i:]
+		case '"':
+			if _, rest, ok := expectTokenOrQuoted(s[i:]); ok {
+				return skipElement(rest)
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
 func expectToken(s string) (token, rest string) {
 	i := 0
 	for ; i < len(s); i++ {
@@ -114,37 +177,42 @@ func expectToken(s string) (token, rest string) {
 	return s[:i], s[i:]
 }
 
-func expectTokenOrQuoted(s string) (value string, rest string) {
+func expectToken68(s string) (token68, rest string) {
+	i := 0
+	for ; i < len(s); i++ {
+		if octetTypes[s[i]]&isToken68 == 0 {
+			break
+		}
+	}
+	if i == 0 {
+		return "", s
+	}
+	for ; i < len(s) && s[i] == '='; i++ {
+	}
+	return s[:i], s[i:]
+}
+
+// expectTokenOrQuoted reads a token or a quoted string, unescaping
+// quoted-pairs. ok is false if there is neither, or the quoted string isn't
+// terminated.
+func expectTokenOrQuoted(s string) (value string, rest string, ok bool) {
 	if !strings.HasPrefix(s, "\"") {
-		return expectToken(s)
+		value, rest = expectToken(s)
+		return value, rest, value != ""
 	}
-	s = s[1:]
-	for i := 0; i < len(s); i++ {
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
 		switch s[i] {
 		case '"':
-			return s[:i], s[i+1:]
+			return b.String(), s[i+1:], true
 		case '\\':
-			p := make([]byte, len(s)-1)
-			j := copy(p, s[:i])
-			escape := true
-			for i = i + i; i < len(s); i++ {
-				b := s[i]
-				switch {
-				case escape:
-					escape = false
-					p[j] = b
-					j++
-				case b == '\\':
-					escape = true
-				case b == '"':
-					return string(p[:j]), s[i+1:]
-				default:
-					p[j] = b
-					j++
-				}
+			i++
+			if i == len(s) {
+				return "", "", false
 			}
-			return "", ""
 		}
+		b.WriteByte(s[i])
 	}
-	return "", ""
+	return "", "", false
 }
@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package registry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzParseChallenges(f *testing.F) {
+	for _, seed := range []string{
+		`Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`,
+		`Bearer realm="https://a/token", service="registry", Basic realm="registry"`,
+		`Negotiate YIIBhgYGKwYBBQUC+oIBejA/==, Basic realm="x"`,
+		`Basic realm="the \"special\" realm\\here"`,
+		`Bearer realm=, service="unterminated`,
+		`,, = "" \`,
+		`0 0,0=0`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, header string) {
+		challenges := parseChallenges(header)
+		for _, challenge := range challenges {
+			if challenge.Scheme == "" || challenge.Scheme != strings.ToLower(challenge.Scheme) {
+				t.Fatalf("bad scheme %q in %q", challenge.Scheme, header)
+			}
+			for key := range challenge.Parameters {
+				if key == "" || key != strings.ToLower(key) {
+					t.Fatalf("bad parameter name %q in %q", key, header)
+				}
+			}
+		}
+
+		// Whatever was parsed must survive formatting and parsing again.
+		formatted := formatChallenges(challenges)
+		if again := parseChallenges(formatted); !reflect.DeepEqual(again, challenges) {
+			t.Fatalf("%q parsed as %s, which parses as %s", header, formatted, formatChallenges(again))
+		}
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -250,3 +252,130 @@ func Test_AuthenticationDance(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParseAuthHeader(t *testing.T) {
+	tcs := []struct {
+		name     string
+		headers  []string
+		expected []*AuthorizationChallenge
+	}{
+		{
+			name:    "Docker Hub",
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull"}},
+			},
+		},
+		{
+			name:    "GCR",
+			headers: []string{`Bearer realm="https://gcr.io/v2/token",service="gcr.io",scope="repository:google-containers/pause:pull"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{"realm": "https://gcr.io/v2/token", "service": "gcr.io", "scope": "repository:google-containers/pause:pull"}},
+			},
+		},
+		{
+			name:    "ECR",
+			headers: []string{`Basic realm="https://123456789012.dkr.ecr.us-east-1.amazonaws.com/",service="ecr.amazonaws.com"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "basic", Parameters: map[string]string{"realm": "https://123456789012.dkr.ecr.us-east-1.amazonaws.com/", "service": "ecr.amazonaws.com"}},
+			},
+		},
+		{
+			name:    "Harbor",
+			headers: []string{`Bearer realm="https://harbor.example.com/service/token",service="harbor-registry",scope="repository:library/nginx:pull,push"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{"realm": "https://harbor.example.com/service/token", "service": "harbor-registry", "scope": "repository:library/nginx:pull,push"}},
+			},
+		},
+		{
+			name:    "Quay",
+			headers: []string{`Bearer realm="https://quay.io/v2/auth",service="quay.io",scope="repository:coreos/etcd:pull"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{"realm": "https://quay.io/v2/auth", "service": "quay.io", "scope": "repository:coreos/etcd:pull"}},
+			},
+		},
+		{
+			name:    "multiple challenges in one header",
+			headers: []string{`Bearer realm="https://auth.example.com/token", service="registry", Basic realm="registry"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{"realm": "https://auth.example.com/token", "service": "registry"}},
+				{Scheme: "basic", Parameters: map[string]string{"realm": "registry"}},
+			},
+		},
+		{
+			name:    "multiple headers",
+			headers: []string{`Negotiate`, `Basic realm=registry`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "negotiate", Parameters: map[string]string{}},
+				{Scheme: "basic", Parameters: map[string]string{"realm": "registry"}},
+			},
+		},
+		{
+			name:    "token68",
+			headers: []string{`Negotiate YIIBhgYGKwYBBQUC+oIBejA/==, Basic realm="x"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "negotiate", Parameters: map[string]string{}, Token68: "YIIBhgYGKwYBBQUC+oIBejA/=="},
+				{Scheme: "basic", Parameters: map[string]string{"realm": "x"}},
+			},
+		},
+		{
+			name:    "escaped quotes and backslashes",
+			headers: []string{`Basic realm="the \"special\" realm\\here", charset="UTF-8"`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "basic", Parameters: map[string]string{"realm": `the "special" realm\here`, "charset": "UTF-8"}},
+			},
+		},
+		{
+			name:    "spaces around equals and empty list elements",
+			headers: []string{`,Bearer  realm = "a" ,, service=b,`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{"realm": "a", "service": "b"}},
+			},
+		},
+		{
+			name:    "malformed parameters are skipped",
+			headers: []string{`Bearer realm="a", service=, scope="unterminated`, `Basic realm="ok", @=x`},
+			expected: []*AuthorizationChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{"realm": "a"}},
+				{Scheme: "basic", Parameters: map[string]string{"realm": "ok"}},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{"Www-Authenticate": tc.headers}
+			challenges := parseAuthHeader(header)
+			if !reflect.DeepEqual(challenges, tc.expected) {
+				t.Errorf("expected %s, got %s", formatChallenges(tc.expected), formatChallenges(challenges))
+			}
+		})
+	}
+}
+
+// formatChallenges writes challenges back out as a WWW-Authenticate value.
+func formatChallenges(challenges []*AuthorizationChallenge) string {
+	var parts []string
+	for _, challenge := range challenges {
+		part := challenge.Scheme
+		if challenge.Token68 != "" {
+			part += " " + challenge.Token68
+		}
+
+		keys := make([]string, 0, len(challenge.Parameters))
+		for key := range challenge.Parameters {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			sep := ", "
+			if i == 0 {
+				sep = " "
+			}
+			value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(challenge.Parameters[key])
+			part += fmt.Sprintf(`%s%s="%s"`, sep, key, value)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -15,7 +15,7 @@ type BasicTransport struct {
 }
 
 func (t *BasicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if t.preAuth && (t.Username != "" || t.Password != "") {
+	if t.preAuth && (t.Username != "" || t.Password != "") && req.Header.Get("Authorization") == "" {
 		req.SetBasicAuth(t.Username, t.Password)
 	}
 
@@ -25,16 +25,33 @@ func (t *BasicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 
 	if resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(req.URL.String(), t.URL) {
-		if strings.HasPrefix(strings.ToLower(resp.Header.Get("WWW-Authenticate")), "basic") {
+		if offersBasic(resp.Header) {
 			if t.Username != "" || t.Password != "" {
 				if resp.Body != nil {
 					resp.Body.Close()
 				}
 
+				req, err := rewind(req)
+				if err != nil {
+					return nil, err
+				}
 				req.SetBasicAuth(t.Username, t.Password)
-				return t.Transport.RoundTrip(req)
+				ctx, span := startChildSpan(req.Context(), "registry.retry")
+				defer span.End()
+				return t.Transport.RoundTrip(req.WithContext(ctx))
 			}
 		}
 	}
 	return resp, err
 }
+
+// offersBasic reports whether any of the response's challenges is for Basic
+// authentication.
+func offersBasic(header http.Header) bool {
+	for _, challenge := range parseAuthHeader(header) {
+		if challenge.Scheme == "basic" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,283 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// ErrLastUnsupported is returned by a repository listing given
+// ListOptions.Last when its catalog provider doesn't page by repository name,
+// as only `_catalog` does. Resume those listings with
+// RepositoryListOptions.Checkpoint instead.
+var ErrLastUnsupported = errors.New("catalog provider can't resume from ListOptions.Last; use a checkpoint")
+
+// Names of the built-in catalog providers.
+const (
+	CatalogDistribution = "distribution"
+	CatalogDTR          = "dtr"
+	CatalogHarbor       = "harbor"
+	CatalogHarborV2     = "harbor-v2"
+	CatalogQuay         = "quay"
+	CatalogGitLab       = "gitlab"
+	CatalogArtifactory  = "artifactory"
+	CatalogNexus        = "nexus"
+)
+
+// CatalogPage is one page of repository names.
+type CatalogPage struct {
+	Repositories []string
+
+	// Next is the cursor for the following page, or "" if this is the last
+	// page.
+	Next string
+}
+
+// CatalogProvider lists the repositories in a registry through one registry
+// flavour's API. Cursors are opaque to callers but meaningful to the
+// provider, such as the `last` parameter of `_catalog` or DTR's `pageStart`,
+// so they can be persisted and passed back later.
+type CatalogProvider interface {
+	// Name identifies the provider, such as CatalogDistribution.
+	Name() string
+
+	// ListPage returns the page of repositories starting at cursor, which is
+	// "" for the first page. n is the requested page size, or zero to leave
+	// it up to the registry.
+	ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error)
+}
+
+// NameCursorProvider is implemented by catalog providers whose cursor is the
+// name of the repository to list after, like the `last` parameter of
+// `_catalog`. Only those accept ListOptions.Last; other providers' listings
+// fail with ErrLastUnsupported when given it.
+type NameCursorProvider interface {
+	CatalogProvider
+
+	// NameCursor reports whether the provider's cursor is a repository name.
+	NameCursor() bool
+}
+
+var catalogProviders = struct {
+	sync.RWMutex
+	byName    map[string]CatalogProvider
+	fallbacks []CatalogProvider
+}{
+	byName: map[string]CatalogProvider{},
+}
+
+func init() {
+	RegisterCatalogProvider(DistributionCatalog{}, false)
+	RegisterCatalogProvider(DTRCatalog{}, true)
+	RegisterCatalogProvider(HarborCatalog{}, true)
+	RegisterCatalogProvider(HarborV2Catalog{}, true)
+	RegisterCatalogProvider(QuayCatalog{}, false)
+	RegisterCatalogProvider(GitLabCatalog{}, false)
+	RegisterCatalogProvider(ArtifactoryCatalog{}, false)
+	RegisterCatalogProvider(NexusCatalog{}, false)
+}
+
+// RegisterCatalogProvider makes p available through LookupCatalogProvider,
+// replacing any provider with the same name. When fallback is true, p is also
+// tried, in registration order, when auto-detection finds that `_catalog` is
+// unusable.
+func RegisterCatalogProvider(p CatalogProvider, fallback bool) {
+	catalogProviders.Lock()
+	defer catalogProviders.Unlock()
+
+	name := p.Name()
+	catalogProviders.byName[name] = p
+
+	fallbacks := catalogProviders.fallbacks[:0:0]
+	for _, existing := range catalogProviders.fallbacks {
+		if existing.Name() != name {
+			fallbacks = append(fallbacks, existing)
+		}
+	}
+	if fallback {
+		fallbacks = append(fallbacks, p)
+	}
+	catalogProviders.fallbacks = fallbacks
+}
+
+// LookupCatalogProvider returns the provider registered under name.
+func LookupCatalogProvider(name string) (CatalogProvider, bool) {
+	catalogProviders.RLock()
+	defer catalogProviders.RUnlock()
+
+	p, ok := catalogProviders.byName[name]
+	return p, ok
+}
+
+// CatalogProviders returns the names of all registered providers.
+func CatalogProviders() []string {
+	catalogProviders.RLock()
+	defer catalogProviders.RUnlock()
+
+	names := make([]string, 0, len(catalogProviders.byName))
+	for name := range catalogProviders.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fallbackCatalogProviders() []CatalogProvider {
+	catalogProviders.RLock()
+	defer catalogProviders.RUnlock()
+
+	return append([]CatalogProvider(nil), catalogProviders.fallbacks...)
+}
+
+// detectCatalog fetches the first page of `_catalog` and decides whether the
+// registry needs one of the fallback providers instead. It returns the
+// provider to use for the rest of the listing along with the cursor of its
+// first page and the page itself.
+func (registry *Registry) detectCatalog(ctx context.Context, opts ListOptions) (CatalogProvider, string, CatalogPage, error) {
+	distribution := DistributionCatalog{}
+
+	if caps := registry.Capabilities(); caps != nil {
+		switch {
+		case caps.Flavour == FlavourArtifactory:
+			page, err := ArtifactoryCatalog{}.ListPage(ctx, registry, opts.Last, opts.N)
+			return ArtifactoryCatalog{}, opts.Last, page, err
+		case caps.Catalog && caps.Flavour != FlavourDTR:
+			page, err := distribution.ListPage(ctx, registry, opts.Last, opts.N)
+			return distribution, opts.Last, page, err
+		}
+		for _, provider := range flavourCatalogProviders(caps.Flavour) {
+			if page, err := provider.ListPage(ctx, registry, "", opts.N); err == nil {
+				return provider, "", page, nil
+			}
+		}
+	}
+
+	page, err := distribution.ListPage(ctx, registry, opts.Last, opts.N)
+	switch {
+	case err == nil && page.Next == "":
+		// If we get 0 repositories back, it could be because there are
+		// legitimately 0 repositories or it could be because the registry is
+		// DTR and it wants us to use the DTR API instead.
+		//
+		// If the fallback fails, we'll assume that the _catalog response was
+		// right and return it without an error.
+		if len(page.Repositories) == 0 || registry.flavour() == FlavourDTR {
+			if provider, fallbackPage, fallbackErr := registry.catalogFallback(ctx, opts.N); fallbackErr == nil {
+				return provider, "", fallbackPage, nil
+			}
+		}
+		return distribution, opts.Last, page, nil
+
+	case err == nil:
+		// DTR is tricky. Sometimes it will respond to the _catalog API request
+		// with some repositories, but the list it gives is incomplete. If we
+		// have detected that the registry is DTR, then throw away the _catalog
+		// API response and try the fallback, which will use
+		// /api/v0/repositories instead.
+		if registry.flavour() == FlavourDTR {
+			if provider, fallbackPage, fallbackErr := registry.catalogFallback(ctx, opts.N); fallbackErr == nil {
+				return provider, "", fallbackPage, nil
+			}
+		}
+		return distribution, opts.Last, page, nil
+
+	default:
+		if isHttpStatus(err, http.StatusUnauthorized) {
+			if provider, fallbackPage, fallbackErr := registry.catalogFallback(ctx, opts.N); fallbackErr == nil {
+				return provider, "", fallbackPage, nil
+			}
+		}
+		return nil, "", CatalogPage{}, err
+	}
+}
+
+// catalogFallback tries each fallback provider in turn, starting with those
+// for the registry's flavour. The first one to return a page wins.
+func (registry *Registry) catalogFallback(ctx context.Context, n int) (CatalogProvider, CatalogPage, error) {
+	providers := flavourCatalogProviders(registry.flavour())
+	for _, provider := range fallbackCatalogProviders() {
+		if !containsProvider(providers, provider.Name()) {
+			providers = append(providers, provider)
+		}
+	}
+
+	var err error
+	for _, provider := range providers {
+		registry.Logf("registry.repositories attempting %s fallback", provider.Name())
+
+		var page CatalogPage
+		page, err = provider.ListPage(ctx, registry, "", n)
+		if err == nil {
+			return provider, page, nil
+		}
+		registry.Logf("registry.repositories %s fallback failed: %v", provider.Name(), err)
+	}
+	return nil, CatalogPage{}, fmt.Errorf("fallback didn't work: %v", err)
+}
+
+// flavourCatalogProviders returns the registered providers for a flavour
+// whose `_catalog` can't be relied on.
+func flavourCatalogProviders(flavour Flavour) []CatalogProvider {
+	var providers []CatalogProvider
+	for _, name := range flavourCatalogs[flavour] {
+		if provider, ok := LookupCatalogProvider(name); ok {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+func containsProvider(providers []CatalogProvider, name string) bool {
+	for _, provider := range providers {
+		if provider.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DistributionCatalog lists repositories through the standard `/v2/_catalog`
+// endpoint. Its cursor is the `last` parameter.
+type DistributionCatalog struct{}
+
+func (DistributionCatalog) Name() string {
+	return CatalogDistribution
+}
+
+func (DistributionCatalog) NameCursor() bool {
+	return true
+}
+
+func (DistributionCatalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	regurl := withListOptions(registry.url("/v2/_catalog"), ListOptions{N: n, Last: cursor})
+	registry.Logf("registry.repositories url=%s", regurl)
+
+	var response repositoriesResponse
+	next, err := registry.getPaginatedJson(ctx, regurl, &response)
+	if err != nil && err != ErrNoMorePages {
+		return CatalogPage{}, err
+	}
+
+	page := CatalogPage{Repositories: response.Repositories}
+	if err == nil {
+		page.Next = queryParam(next, "last")
+		if page.Next == "" && len(page.Repositories) > 0 {
+			// The spec says the next page starts after the last repository.
+			page.Next = page.Repositories[len(page.Repositories)-1]
+		}
+	}
+	return page, nil
+}
+
+// queryParam returns the value of key in the query string of rawurl.
+func queryParam(rawurl, key string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get(key)
+}
@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"context"
+	"net/url"
+)
+
+// ArtifactoryBasePath returns the Registry.BasePath under which JFrog
+// Artifactory serves the Docker API for the repository with the given key.
+func ArtifactoryBasePath(repoKey string) string {
+	return "/artifactory/api/docker/" + url.PathEscape(repoKey)
+}
+
+// ArtifactoryCatalog lists repositories through `_catalog` as served by JFrog
+// Artifactory, usually with Registry.BasePath set to ArtifactoryBasePath.
+// Some Artifactory versions ignore the `last` parameter and return the first
+// page again, which would make a plain `_catalog` listing loop forever. When
+// that happens this provider fetches the whole catalog in one request and
+// returns what follows the cursor. Its cursor is the `last` parameter.
+type ArtifactoryCatalog struct{}
+
+func (ArtifactoryCatalog) Name() string {
+	return CatalogArtifactory
+}
+
+func (ArtifactoryCatalog) NameCursor() bool {
+	return true
+}
+
+func (ArtifactoryCatalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	page, err := DistributionCatalog{}.ListPage(ctx, registry, cursor, n)
+	if err != nil || cursor == "" || len(page.Repositories) == 0 || page.Repositories[0] > cursor {
+		return page, err
+	}
+
+	// Artifactory sorts its catalog, so a page that doesn't start after the
+	// cursor means the registry ignored `last`. Ask for everything at once;
+	// Artifactory returns the complete catalog when no page size is given.
+	registry.Logf("registry.repositories registry ignored last=%s, fetching the whole catalog", cursor)
+	regurl := registry.url("/v2/_catalog")
+
+	var response repositoriesResponse
+	if _, err := registry.getJson(ctx, regurl, &response); err != nil {
+		return CatalogPage{}, err
+	}
+
+	rest := CatalogPage{}
+	for _, repo := range response.Repositories {
+		if repo > cursor {
+			rest.Repositories = append(rest.Repositories, repo)
+		}
+	}
+	return rest, nil
+}
@@ -0,0 +1,145 @@
+package registry_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// artifactoryDataSource serves `_catalog` under an Artifactory base path. Its
+// Link headers leave the base path out, and when ignoreLast is set it answers
+// every paged request with the first page, as some Artifactory versions do.
+func artifactoryDataSource(ignoreLast bool) func(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/artifactory/api/docker/docker-local/v2/_catalog" {
+				t.Errorf("unexpected path = %v", r.URL.Path)
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/json; charset=utf-8")
+			last := r.URL.Query().Get("last")
+			switch {
+			case r.URL.Query().Get("n") == "":
+				w.Write([]byte(`{"repositories":["project2/repo1","project2/repo2","project3/repo1","project3/repo2","project4/repo1","project4/repo2"]}`))
+			case last == "" || ignoreLast:
+				w.Header().Set("Link", `</v2/_catalog?last=project2%2Frepo2&n=2>; rel="next"`)
+				w.Write([]byte(`{"repositories":["project2/repo1","project2/repo2"]}`))
+			case last == "project2/repo2":
+				w.Header().Set("Link", `</v2/_catalog?last=project3%2Frepo2&n=2>; rel="next"`)
+				w.Write([]byte(`{"repositories":["project3/repo1","project3/repo2"]}`))
+			case last == "project3/repo2":
+				w.Write([]byte(`{"repositories":["project4/repo1","project4/repo2"]}`))
+			default:
+				t.Errorf("unexpected last = %v", last)
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+func nexusDataSource(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/service/rest/v1/search" {
+			t.Errorf("unexpected path = %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			t.Errorf("expected basic auth, got %q", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("format") != "docker" || r.URL.Query().Get("repository") != "docker-hosted" {
+			t.Errorf("unexpected query = %v", r.URL.RawQuery)
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		// One item per tag, so names repeat within and across pages.
+		switch r.URL.Query().Get("continuationToken") {
+		case "":
+			w.Write([]byte(`{"items":[{"name":"project2/repo1","version":"1"},{"name":"project2/repo1","version":"2"},{"name":"project2/repo2","version":"1"}],"continuationToken":"abc"}`))
+		case "abc":
+			w.Write([]byte(`{"items":[{"name":"project2/repo2","version":"2"},{"name":"project3/repo1","version":"1"},{"name":"project3/repo2","version":"1"}],"continuationToken":"def"}`))
+		case "def":
+			w.Write([]byte(`{"items":[{"name":"project4/repo1","version":"1"},{"name":"project4/repo2","version":"1"}],"continuationToken":null}`))
+		default:
+			t.Errorf("unexpected continuationToken = %v", r.URL.Query().Get("continuationToken"))
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_ArtifactoryNexusCatalogs(t *testing.T) {
+	tcs := []struct {
+		name     string
+		provider registry.CatalogProvider
+		basePath string
+		handler  func(t *testing.T) func(w http.ResponseWriter, r *http.Request)
+	}{
+		{
+			name:     "artifactory",
+			provider: registry.ArtifactoryCatalog{},
+			basePath: registry.ArtifactoryBasePath("docker-local"),
+			handler:  artifactoryDataSource(false),
+		},
+		{
+			name:     "artifactory ignoring last",
+			provider: registry.ArtifactoryCatalog{},
+			basePath: registry.ArtifactoryBasePath("docker-local"),
+			handler:  artifactoryDataSource(true),
+		},
+		{
+			name:     "nexus",
+			provider: registry.NexusCatalog{Repository: "docker-hosted"},
+			basePath: "/repository/docker-hosted",
+			handler:  nexusDataSource,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, tc.handler(t), tc.provider)
+			defer done()
+			reg.BasePath = tc.basePath
+
+			repos, err := reg.Repositories()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repos, allTestRepositories) {
+				t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+			}
+
+			repos = listAllPages(t, reg, tc.provider, 2)
+			if !reflect.DeepEqual(repos, allTestRepositories) {
+				t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+			}
+		})
+	}
+}
+
+func Test_DistributionCatalog_UnsortedPages(t *testing.T) {
+	// A registry that sorts its catalog without regard to case.
+	reg, done := newCatalogTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `</v2/_catalog?n=2&last=base>; rel="next"`)
+			w.Write(mustJSON(t, map[string][]string{"repositories": {"app", "base"}}))
+			return
+		}
+		w.Write(mustJSON(t, map[string][]string{"repositories": {"Cache"}}))
+	}, registry.DistributionCatalog{})
+	defer done()
+
+	page, err := registry.DistributionCatalog{}.ListPage(context.Background(), reg, "base", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Repositories, []string{"Cache"}) {
+		t.Errorf("expected the page after base, got %v", page.Repositories)
+	}
+}
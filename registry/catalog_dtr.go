@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+type dtrRepository struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+}
+
+// DTRCatalog lists repositories through Docker Trusted Registry's (now Mirantis
+// Secure Registry's) `/api/v0/repositories/` endpoint, which is complete where
+// DTR's `_catalog` is not. Its cursor is DTR's `pageStart` parameter.
+type DTRCatalog struct{}
+
+func (DTRCatalog) Name() string {
+	return CatalogDTR
+}
+
+func (DTRCatalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	q := url.Values{}
+	if n > 0 {
+		q.Set("pageSize", strconv.Itoa(n))
+	}
+	if cursor != "" {
+		q.Set("pageStart", cursor)
+	}
+	regurl := registry.apiURL("/api/v0/repositories/")
+	if len(q) > 0 {
+		regurl += "?" + q.Encode()
+	}
+	registry.Logf("registry.repositories url=%s", regurl)
+
+	var response struct {
+		Repositories []dtrRepository `json:"repositories"`
+	}
+	next, err := registry.getPaginatedJson(ctx, regurl, &response)
+	if err != nil && err != ErrNoMorePages {
+		return CatalogPage{}, err
+	}
+
+	page := CatalogPage{
+		Repositories: make([]string, 0, len(response.Repositories)),
+	}
+	for _, r := range response.Repositories {
+		page.Repositories = append(page.Repositories, fmt.Sprintf("%s/%s", r.Namespace, r.Name))
+	}
+	if err == nil {
+		page.Next = queryParam(next, "pageStart")
+	}
+	return page, nil
+}
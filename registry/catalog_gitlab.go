@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitLabRepository is a container registry repository as described by the
+// GitLab API.
+type GitLabRepository struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"` // the repository name in the registry, e.g. "group/project/image"
+	ProjectID int       `json:"project_id"`
+	Location  string    `json:"location"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type gitlabTag struct {
+	Name string `json:"name"`
+	// there are more fields but we don't care about them
+}
+
+// GitLabCatalog lists repositories through the GitLab API, because GitLab's
+// registry has `_catalog` disabled. It lists the registry repositories of
+// every project in each of Groups (GitLab includes subgroups), then of each
+// of Projects, and yields their registry paths, the same names `_catalog`
+// would.
+//
+// Its cursor records which group or project is being listed and the next
+// page of it.
+type GitLabCatalog struct {
+	// APIURL is the GitLab instance, e.g. "https://gitlab.example.com".
+	// GitLab usually serves its registry from a different host; when empty,
+	// the registry's own URL is used.
+	APIURL string
+
+	// Groups and Projects are numeric IDs or URL paths such as
+	// "my-group/sub-group".
+	Groups   []string
+	Projects []string
+
+	// PrivateToken is a personal, group or project access token. JobToken is
+	// a CI job token ($CI_JOB_TOKEN). Set one of them.
+	PrivateToken string
+	JobToken     string
+}
+
+func (GitLabCatalog) Name() string {
+	return CatalogGitLab
+}
+
+// gitlabSources returns the API paths listed by the catalog, in order.
+func (c GitLabCatalog) gitlabSources() []string {
+	sources := make([]string, 0, len(c.Groups)+len(c.Projects))
+	for _, group := range c.Groups {
+		sources = append(sources, fmt.Sprintf("/api/v4/groups/%s/registry/repositories", url.PathEscape(group)))
+	}
+	for _, project := range c.Projects {
+		sources = append(sources, fmt.Sprintf("/api/v4/projects/%s/registry/repositories", url.PathEscape(project)))
+	}
+	return sources
+}
+
+func (c GitLabCatalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	sources := c.gitlabSources()
+	if len(sources) == 0 {
+		return CatalogPage{}, errors.New("gitlab catalog needs at least one group or project")
+	}
+
+	source, page := 0, ""
+	if cursor != "" {
+		q, err := url.ParseQuery(cursor)
+		if err != nil {
+			return CatalogPage{}, err
+		}
+		if source, err = strconv.Atoi(q.Get("source")); err != nil || source < 0 || source >= len(sources) {
+			return CatalogPage{}, fmt.Errorf("invalid gitlab catalog cursor %q", cursor)
+		}
+		page = q.Get("page")
+	}
+
+	var repos []GitLabRepository
+	next, err := c.getPage(ctx, registry, sources[source], page, n, &repos)
+	if err != nil {
+		return CatalogPage{}, err
+	}
+
+	result := CatalogPage{
+		Repositories: make([]string, 0, len(repos)),
+	}
+	for _, r := range repos {
+		result.Repositories = append(result.Repositories, r.Path)
+	}
+
+	if next == "" {
+		source++
+	}
+	if source < len(sources) {
+		q := url.Values{}
+		q.Set("source", strconv.Itoa(source))
+		if next != "" {
+			q.Set("page", next)
+		}
+		result.Next = q.Encode()
+	}
+	return result, nil
+}
+
+// Repositories returns every registry repository in the catalog's groups and
+// projects with the metadata GitLab keeps for it. The IDs are needed to list
+// tags with Tags.
+func (c GitLabCatalog) Repositories(ctx context.Context, registry *Registry) ([]GitLabRepository, error) {
+	var all []GitLabRepository
+	for _, source := range c.gitlabSources() {
+		for page := ""; ; {
+			var repos []GitLabRepository
+			next, err := c.getPage(ctx, registry, source, page, 0, &repos)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, repos...)
+			if next == "" {
+				break
+			}
+			page = next
+		}
+	}
+	return all, nil
+}
+
+// Tags lists the tags of a repository through the GitLab API, which works
+// where the registry's own tag listing needs a registry token.
+func (c GitLabCatalog) Tags(ctx context.Context, registry *Registry, repository GitLabRepository) ([]string, error) {
+	source := fmt.Sprintf("/api/v4/projects/%d/registry/repositories/%d/tags", repository.ProjectID, repository.ID)
+
+	var tags []string
+	for page := ""; ; {
+		var response []gitlabTag
+		next, err := c.getPage(ctx, registry, source, page, 0, &response)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range response {
+			tags = append(tags, tag.Name)
+		}
+		if next == "" {
+			return tags, nil
+		}
+		page = next
+	}
+}
+
+// getPage fetches one page of a GitLab API listing and returns the number of
+// the next page, or "" if this is the last one.
+func (c GitLabCatalog) getPage(ctx context.Context, registry *Registry, path, page string, n int, response interface{}) (string, error) {
+	base := c.APIURL
+	if base == "" {
+		base = registry.URL
+	}
+
+	q := url.Values{}
+	if page != "" {
+		q.Set("page", page)
+	}
+	if n > 0 {
+		q.Set("per_page", strconv.Itoa(n))
+	}
+	u := strings.TrimSuffix(base, "/") + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	registry.Logf("registry.repositories url=%s", u)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	if c.PrivateToken != "" {
+		req.Header.Set("PRIVATE-TOKEN", c.PrivateToken)
+	}
+	if c.JobToken != "" {
+		req.Header.Set("JOB-TOKEN", c.JobToken)
+	}
+
+	resp, err := registry.doJson(req, response)
+	if err != nil {
+		return "", err
+	}
+
+	next, err := getNextLink(u, resp)
+	if err == nil {
+		return queryParam(next, "page"), nil
+	}
+	// GitLab also sends the next page number in `X-Next-Page`, which
+	// survives proxies that drop the Link header.
+	return resp.Header.Get("X-Next-Page"), nil
+}
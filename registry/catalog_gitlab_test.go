@@ -0,0 +1,139 @@
+package registry_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// gitlabDataSource serves the GitLab registry API for one group with two
+// pages of repositories and one extra project, paginated with X-Next-Page
+// only.
+func gitlabDataSource(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "glpat-token" && r.Header.Get("JOB-TOKEN") != "job-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"401 Unauthorized"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		page := r.URL.Query().Get("page")
+
+		switch r.URL.EscapedPath() {
+		case "/api/v4/groups/project%2Fgroup/registry/repositories":
+			switch page {
+			case "", "1":
+				w.Header().Set("X-Next-Page", "2")
+				w.Write([]byte(`[{"id":1,"name":"","path":"project2/repo1","project_id":2},{"id":2,"name":"repo2","path":"project2/repo2","project_id":2}]`))
+			case "2":
+				w.Header().Set("X-Next-Page", "")
+				w.Write([]byte(`[{"id":3,"name":"","path":"project3/repo1","project_id":3},{"id":4,"name":"repo2","path":"project3/repo2","project_id":3}]`))
+			default:
+				t.Errorf("Invalid page number %v", page)
+				w.WriteHeader(http.StatusNotFound)
+			}
+
+		case "/api/v4/projects/4/registry/repositories":
+			w.Write([]byte(`[{"id":5,"name":"","path":"project4/repo1","project_id":4},{"id":6,"name":"repo2","path":"project4/repo2","project_id":4}]`))
+
+		case "/api/v4/projects/3/registry/repositories/4/tags":
+			w.Write([]byte(`[{"name":"latest","path":"project3/repo2:latest"},{"name":"v1","path":"project3/repo2:v1"}]`))
+
+		default:
+			t.Errorf("unexpected path = %v", r.URL.EscapedPath())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func Test_GitLabCatalog(t *testing.T) {
+	tcs := []struct {
+		name     string
+		provider registry.GitLabCatalog
+	}{
+		{
+			name:     "private token",
+			provider: registry.GitLabCatalog{Groups: []string{"project/group"}, Projects: []string{"4"}, PrivateToken: "glpat-token"},
+		},
+		{
+			name:     "job token",
+			provider: registry.GitLabCatalog{Groups: []string{"project/group"}, Projects: []string{"4"}, JobToken: "job-token"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, gitlabDataSource(t), tc.provider)
+			defer done()
+
+			repos, err := reg.Repositories()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repos, allTestRepositories) {
+				t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+			}
+		})
+
+		t.Run(tc.name+" cursors", func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, gitlabDataSource(t), tc.provider)
+			defer done()
+
+			repos := listAllPages(t, reg, tc.provider, 2)
+			if !reflect.DeepEqual(repos, allTestRepositories) {
+				t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+			}
+		})
+	}
+
+	t.Run("separate api url", func(t *testing.T) {
+		api, done := newCatalogTestRegistry(t, gitlabDataSource(t), nil)
+		defer done()
+
+		provider := registry.GitLabCatalog{APIURL: api.URL, Projects: []string{"4"}, PrivateToken: "glpat-token"}
+		reg := &registry.Registry{URL: "https://registry.invalid", Client: api.Client, Logf: registry.Quiet, Catalog: provider}
+
+		repos, err := reg.Repositories()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(repos, []string{"project4/repo1", "project4/repo2"}) {
+			t.Errorf("unexpected repositories %v", repos)
+		}
+	})
+
+	t.Run("no groups or projects", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, gitlabDataSource(t), registry.GitLabCatalog{PrivateToken: "glpat-token"})
+		defer done()
+
+		if _, err := reg.Repositories(); err == nil {
+			t.Fatal("expected an error but did not get one")
+		}
+	})
+}
+
+func Test_GitLabCatalog_Tags(t *testing.T) {
+	provider := registry.GitLabCatalog{Groups: []string{"project/group"}, PrivateToken: "glpat-token"}
+	reg, done := newCatalogTestRegistry(t, gitlabDataSource(t), provider)
+	defer done()
+
+	repos, err := provider.Repositories(context.Background(), reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 4 || repos[3].Path != "project3/repo2" {
+		t.Fatalf("unexpected repositories %+v", repos)
+	}
+
+	tags, err := provider.Tags(context.Background(), reg, repos[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"latest", "v1"}) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
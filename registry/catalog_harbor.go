@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type harborProject struct {
+	ID        int `json:"project_id"`
+	RepoCount int `json:"repo_count"`
+	// there are more fields but we don't care about them
+}
+
+type harborRepo struct {
+	Name string `json:"name"`
+	// there are more fields but we don't care about them
+}
+
+// HarborCatalog lists repositories through the Harbor 1.x API, walking
+// `/api/projects` and then `/api/repositories` for every project that has
+// repositories. Harbor wants HTTP Basic credentials up front, so this switches
+// the registry's transport to pre-emptive Basic authentication.
+//
+// Its cursor records the next page of projects, the projects still to be
+// listed from the current page, and the next page of the first of those.
+type HarborCatalog struct{}
+
+func (HarborCatalog) Name() string {
+	return CatalogHarbor
+}
+
+type harborCursor struct {
+	projectsPage string   // next page of projects, "" when there are no more
+	pending      []string // projects still to list from the current page
+	reposPage    string   // next page of pending[0]'s repositories
+}
+
+func parseHarborCursor(cursor string) (harborCursor, error) {
+	q, err := url.ParseQuery(cursor)
+	if err != nil {
+		return harborCursor{}, err
+	}
+
+	c := harborCursor{
+		projectsPage: q.Get("projects"),
+		reposPage:    q.Get("repos"),
+	}
+	if pending := q.Get("pending"); pending != "" {
+		c.pending = strings.Split(pending, ",")
+	}
+	return c, nil
+}
+
+func (c harborCursor) String() string {
+	if c.projectsPage == "" && len(c.pending) == 0 {
+		return ""
+	}
+
+	q := url.Values{}
+	if c.projectsPage != "" {
+		q.Set("projects", c.projectsPage)
+	}
+	if len(c.pending) > 0 {
+		q.Set("pending", strings.Join(c.pending, ","))
+	}
+	if c.reposPage != "" {
+		q.Set("repos", c.reposPage)
+	}
+	return q.Encode()
+}
+
+func (HarborCatalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	registry.useBasicPreAuth()
+
+	var c harborCursor
+	if cursor == "" {
+		registry.resetToken()
+		c.projectsPage = "1"
+	} else {
+		var err error
+		if c, err = parseHarborCursor(cursor); err != nil {
+			return CatalogPage{}, err
+		}
+	}
+
+	for len(c.pending) == 0 {
+		if c.projectsPage == "" {
+			return CatalogPage{}, nil
+		}
+
+		u := registry.apiURL("/api/projects") + harborPageQuery("", c.projectsPage, n)
+		registry.Logf("registry.repositories url=%s", u)
+
+		var projects []harborProject
+		next, err := registry.getPaginatedJson(ctx, u, &projects)
+		if err != nil && err != ErrNoMorePages {
+			return CatalogPage{}, err
+		}
+
+		c.projectsPage = ""
+		if err == nil {
+			c.projectsPage = queryParam(next, "page")
+		}
+		for _, project := range projects {
+			if project.RepoCount > 0 {
+				c.pending = append(c.pending, strconv.Itoa(project.ID))
+			}
+		}
+	}
+
+	u := registry.apiURL("/api/repositories") + harborPageQuery(c.pending[0], c.reposPage, n)
+	registry.Logf("registry.repositories url=%s", u)
+
+	var repos []harborRepo
+	next, err := registry.getPaginatedJson(ctx, u, &repos)
+	if err != nil && err != ErrNoMorePages {
+		return CatalogPage{}, err
+	}
+
+	page := CatalogPage{
+		Repositories: make([]string, 0, len(repos)),
+	}
+	for _, r := range repos {
+		page.Repositories = append(page.Repositories, r.Name)
+	}
+
+	c.reposPage = ""
+	if err == nil {
+		c.reposPage = queryParam(next, "page")
+	}
+	if c.reposPage == "" {
+		c.pending = c.pending[1:]
+	}
+	page.Next = c.String()
+	return page, nil
+}
+
+// harborPageQuery builds the query string for one page of a Harbor listing.
+// The first page is requested without a page number, as Harbor's own UI does.
+func harborPageQuery(projectID, page string, n int) string {
+	q := url.Values{}
+	if projectID != "" {
+		q.Set("project_id", projectID)
+	}
+	if page != "" && page != "1" {
+		q.Set("page", page)
+	}
+	if n > 0 {
+		q.Set("page_size", strconv.Itoa(n))
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
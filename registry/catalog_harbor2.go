@@ -0,0 +1,186 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Harbor refuses page sizes over 100.
+const harborMaxPageSize = 100
+
+// HarborProject is a project as described by the Harbor 2.x API.
+type HarborProject struct {
+	ID        int    `json:"project_id"`
+	Name      string `json:"name"`
+	RepoCount int    `json:"repo_count"`
+	// there are more fields but we don't care about them
+}
+
+// HarborRepository is a repository as described by the Harbor 2.x API, with
+// the metadata Harbor keeps alongside it.
+type HarborRepository struct {
+	ID            int       `json:"id"`
+	ProjectID     int       `json:"project_id"`
+	Name          string    `json:"name"` // includes the project, e.g. "library/alpine"
+	Description   string    `json:"description"`
+	ArtifactCount int64     `json:"artifact_count"`
+	PullCount     int64     `json:"pull_count"`
+	CreationTime  time.Time `json:"creation_time"`
+	UpdateTime    time.Time `json:"update_time"`
+}
+
+// HarborV2Catalog lists repositories through the Harbor 2.x API, walking
+// `/api/v2.0/projects` and then `/api/v2.0/projects/{name}/repositories` for
+// every project that has repositories. Like HarborCatalog, it switches the
+// registry's transport to pre-emptive Basic authentication.
+//
+// Its cursor has the same shape as HarborCatalog's, with project names in
+// place of IDs.
+type HarborV2Catalog struct{}
+
+func (HarborV2Catalog) Name() string {
+	return CatalogHarborV2
+}
+
+func (HarborV2Catalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	registry.useBasicPreAuth()
+	if n > harborMaxPageSize {
+		n = harborMaxPageSize
+	}
+
+	var c harborCursor
+	if cursor == "" {
+		registry.resetToken()
+		c.projectsPage = "1"
+	} else {
+		var err error
+		if c, err = parseHarborCursor(cursor); err != nil {
+			return CatalogPage{}, err
+		}
+	}
+
+	for len(c.pending) == 0 {
+		if c.projectsPage == "" {
+			return CatalogPage{}, nil
+		}
+
+		var projects []HarborProject
+		next, err := registry.getHarborPage(ctx, registry.apiURL("/api/v2.0/projects"), c.projectsPage, n, &projects)
+		if err != nil {
+			return CatalogPage{}, err
+		}
+
+		c.projectsPage = next
+		for _, project := range projects {
+			if project.RepoCount > 0 {
+				c.pending = append(c.pending, project.Name)
+			}
+		}
+	}
+
+	var repos []HarborRepository
+	next, err := registry.getHarborPage(ctx, harborV2ReposURL(registry, c.pending[0]), c.reposPage, n, &repos)
+	if err != nil {
+		return CatalogPage{}, err
+	}
+
+	page := CatalogPage{
+		Repositories: make([]string, 0, len(repos)),
+	}
+	for _, r := range repos {
+		page.Repositories = append(page.Repositories, r.Name)
+	}
+
+	c.reposPage = next
+	if c.reposPage == "" {
+		c.pending = c.pending[1:]
+	}
+	page.Next = c.String()
+	return page, nil
+}
+
+// HarborProjects returns every project visible to the registry's credentials
+// through the Harbor 2.x API.
+func (registry *Registry) HarborProjects(ctx context.Context) ([]HarborProject, error) {
+	registry.useBasicPreAuth()
+
+	var projects []HarborProject
+	for page := "1"; page != ""; {
+		var response []HarborProject
+		next, err := registry.getHarborPage(ctx, registry.apiURL("/api/v2.0/projects"), page, harborMaxPageSize, &response)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, response...)
+		page = next
+	}
+	return projects, nil
+}
+
+// HarborRepositories returns the repositories in a Harbor 2.x project along
+// with their artifact and pull counts and update times.
+func (registry *Registry) HarborRepositories(ctx context.Context, project string) ([]HarborRepository, error) {
+	registry.useBasicPreAuth()
+
+	var repos []HarborRepository
+	for page := "1"; page != ""; {
+		var response []HarborRepository
+		next, err := registry.getHarborPage(ctx, harborV2ReposURL(registry, project), page, harborMaxPageSize, &response)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, response...)
+		page = next
+	}
+	return repos, nil
+}
+
+func harborV2ReposURL(registry *Registry, project string) string {
+	return registry.apiURL("/api/v2.0/projects/%s/repositories", url.PathEscape(project))
+}
+
+// getHarborPage fetches one page of a Harbor 2.x listing and returns the
+// number of the next page, or "" if this is the last one. Harbor sends a Link
+// header, but also the total number of items in X-Total-Count, which is used
+// when the Link header is missing.
+func (registry *Registry) getHarborPage(ctx context.Context, u, page string, n int, response interface{}) (string, error) {
+	if page == "" {
+		page = "1"
+	}
+	u += harborPageQuery("", page, n)
+	registry.Logf("registry.repositories url=%s", u)
+
+	resp, err := registry.getJson(ctx, u, response)
+	if err != nil {
+		return "", err
+	}
+
+	if next, err := getNextLink(u, resp); err == nil {
+		return queryParam(next, "page"), nil
+	}
+
+	return harborNextPageFromTotal(resp, page, n), nil
+}
+
+// harborNextPageFromTotal works out whether there is a page after page from
+// the X-Total-Count header. Harbor's default page size is 10.
+func harborNextPageFromTotal(resp *http.Response, page string, n int) string {
+	total, err := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+	if err != nil {
+		return ""
+	}
+	current, err := strconv.Atoi(page)
+	if err != nil {
+		return ""
+	}
+	if n <= 0 {
+		n = 10
+	}
+	if current*n >= total {
+		return ""
+	}
+	return strconv.Itoa(current + 1)
+}
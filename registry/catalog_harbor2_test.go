@@ -0,0 +1,190 @@
+package registry_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// harborV2DataSource serves a Harbor 2.x install. Projects are paginated with
+// X-Total-Count only, repositories with Link headers. The Harbor 1.x API is
+// gone, as it is in real Harbor 2.x installs, and page sizes over 100 are
+// refused.
+func harborV2DataSource(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/v2.0/") {
+			if h, ok := r.Header["Authorization"]; !ok || len(h) < 1 || h[0] != "Basic dXNlcjpwYXNz" {
+				t.Errorf("should use basic pre-auth for Harbor, got request for %v", r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		q := r.URL.Query()
+		page := q.Get("page")
+		if page == "" {
+			page = "1"
+		}
+		if pageSize, err := strconv.Atoi(q.Get("page_size")); err == nil && pageSize > 100 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/_catalog":
+			w.WriteHeader(http.StatusUnauthorized)
+
+		case "/api/v0/repositories/", "/api/projects":
+			w.WriteHeader(http.StatusNotFound)
+
+		case "/api/v2.0/projects":
+			projects := []string{
+				`{"project_id":1,"name":"project1","repo_count":0}`,
+				`{"project_id":2,"name":"project2","repo_count":2}`,
+				`{"project_id":3,"name":"project3","repo_count":2}`,
+				`{"project_id":4,"name":"project4","repo_count":2}`,
+			}
+			pageNumber, _ := strconv.Atoi(page)
+			pageSize, err := strconv.Atoi(q.Get("page_size"))
+			if err != nil {
+				pageSize = 10
+			}
+			start, end := (pageNumber-1)*pageSize, pageNumber*pageSize
+			if start >= len(projects) {
+				t.Errorf("Invalid page number %v", page)
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if end > len(projects) {
+				end = len(projects)
+			}
+			w.Header().Set("X-Total-Count", strconv.Itoa(len(projects)))
+			w.Write([]byte("[" + strings.Join(projects[start:end], ",") + "]"))
+
+		case "/api/v2.0/projects/project2/repositories", "/api/v2.0/projects/project3/repositories", "/api/v2.0/projects/project4/repositories":
+			project := r.URL.Path[len("/api/v2.0/projects/") : len(r.URL.Path)-len("/repositories")]
+			switch page {
+			case "1":
+				w.Header().Set("Link", `<`+r.URL.Path+`?page=2&page_size=2>; rel="next"`)
+				w.Write([]byte(`[{"id":1,"name":"` + project + `/repo1","artifact_count":3,"pull_count":` + strconv.Itoa(len(project)) + `,"update_time":"2023-04-05T06:07:08.000Z"}]`))
+			case "2":
+				w.Write([]byte(`[{"id":2,"name":"` + project + `/repo2","artifact_count":1,"pull_count":0,"update_time":"2023-04-05T06:07:08.000Z"}]`))
+			default:
+				t.Errorf("Invalid page number %v", page)
+				w.WriteHeader(http.StatusNotFound)
+			}
+
+		default:
+			t.Errorf("unexpected path = %v", r.URL.Path)
+			w.WriteHeader(http.StatusPaymentRequired)
+		}
+	}
+}
+
+func Test_HarborV2Catalog(t *testing.T) {
+	t.Run("pinned", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, harborV2DataSource(t), registry.HarborV2Catalog{})
+		defer done()
+
+		repos, err := reg.Repositories()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(repos, allTestRepositories) {
+			t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+		}
+	})
+
+	t.Run("cursors", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, harborV2DataSource(t), registry.HarborV2Catalog{})
+		defer done()
+
+		repos := listAllPages(t, reg, registry.HarborV2Catalog{}, 2)
+		if !reflect.DeepEqual(repos, allTestRepositories) {
+			t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+		}
+	})
+
+	t.Run("oversized pages", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, harborV2DataSource(t), registry.HarborV2Catalog{})
+		defer done()
+
+		repos, err := drainRepositories(reg.ListRepositories(registry.ListOptions{N: 500}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(repos, allTestRepositories) {
+			t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+		}
+	})
+
+	t.Run("auto-detected", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, harborV2DataSource(t), nil)
+		defer done()
+
+		it := reg.ListRepositories(registry.ListOptions{N: 2})
+		repos, err := drainRepositories(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(repos, allTestRepositories) {
+			t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+		}
+		if it.Provider().Name() != registry.CatalogHarborV2 {
+			t.Errorf("expected provider %v, got %v", registry.CatalogHarborV2, it.Provider().Name())
+		}
+	})
+}
+
+func Test_HarborRepositories(t *testing.T) {
+	reg, done := newCatalogTestRegistry(t, harborV2DataSource(t), nil)
+	defer done()
+
+	repos, err := reg.HarborRepositories(context.Background(), "project3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 2 {
+		t.Fatalf("expected 2 repositories, got %+v", repos)
+	}
+
+	expected := registry.HarborRepository{
+		ID:            1,
+		Name:          "project3/repo1",
+		ArtifactCount: 3,
+		PullCount:     8,
+		UpdateTime:    time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(repos[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, repos[0])
+	}
+
+	projects, err := reg.HarborProjects(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 4 || projects[3].Name != "project4" {
+		t.Errorf("unexpected projects %+v", projects)
+	}
+}
+
+func drainRepositories(it *registry.RepositoryIterator) ([]string, error) {
+	var repos []string
+	for {
+		repo, err := it.Next(context.Background())
+		switch err {
+		case nil:
+			repos = append(repos, repo)
+		case registry.ErrIteratorDone:
+			return repos, nil
+		default:
+			return repos, err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"context"
+	"net/url"
+)
+
+type nexusSearchResponse struct {
+	Items []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"items"`
+	ContinuationToken string `json:"continuationToken"`
+}
+
+// NexusCatalog lists the images in a Sonatype Nexus Repository Manager docker
+// repository through the Nexus search API, because Nexus does not page
+// `_catalog`. Nexus serves its REST API at the root of the host, even when
+// the Docker API is reached under Registry.BasePath (such as
+// "/repository/<name>"), and wants HTTP Basic credentials up front.
+//
+// Nexus returns one search item per tag, sorted by name, in pages of a fixed
+// size, so n is ignored. The cursor holds Nexus's continuation token along
+// with the last name returned, to skip duplicates across pages.
+type NexusCatalog struct {
+	// Repository is the name of the Nexus docker repository.
+	Repository string
+}
+
+func (NexusCatalog) Name() string {
+	return CatalogNexus
+}
+
+func (c NexusCatalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	registry.useBasicPreAuth()
+
+	state, err := url.ParseQuery(cursor)
+	if err != nil {
+		return CatalogPage{}, err
+	}
+	token, last := state.Get("token"), state.Get("last")
+
+	q := url.Values{}
+	q.Set("format", "docker")
+	q.Set("sort", "name")
+	q.Set("direction", "asc")
+	if c.Repository != "" {
+		q.Set("repository", c.Repository)
+	}
+	if token != "" {
+		q.Set("continuationToken", token)
+	}
+	regurl := registry.apiURL("/service/rest/v1/search?%s", q.Encode())
+	registry.Logf("registry.repositories url=%s", regurl)
+
+	var response nexusSearchResponse
+	if _, err := registry.getJson(ctx, regurl, &response); err != nil {
+		return CatalogPage{}, err
+	}
+
+	page := CatalogPage{}
+	for _, item := range response.Items {
+		if item.Name == last {
+			continue
+		}
+		page.Repositories = append(page.Repositories, item.Name)
+		last = item.Name
+	}
+
+	if response.ContinuationToken != "" {
+		next := url.Values{}
+		next.Set("token", response.ContinuationToken)
+		if last != "" {
+			next.Set("last", last)
+		}
+		page.Next = next.Encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type quayRepository struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// there are more fields but we don't care about them
+}
+
+// QuayCatalog lists repositories through Quay's `/api/v1/repository`
+// endpoint, since Quay only serves `_catalog` to a few users. Its cursor is
+// Quay's `next_page` token.
+//
+// Exactly what is listed depends on the fields: the repositories of
+// Namespace, the caller's starred repositories, or (with Public, or when
+// nothing else is set) every repository visible to the caller, including
+// public ones.
+type QuayCatalog struct {
+	Namespace string
+	Public    bool
+	Starred   bool
+
+	// Token is an OAuth application token, sent as a bearer token. Without
+	// one, the registry's credentials, typically a robot account, are sent
+	// with HTTP Basic authentication.
+	Token string
+}
+
+func (QuayCatalog) Name() string {
+	return CatalogQuay
+}
+
+func (c QuayCatalog) ListPage(ctx context.Context, registry *Registry, cursor string, n int) (CatalogPage, error) {
+	q := url.Values{}
+	if c.Namespace != "" {
+		q.Set("namespace", c.Namespace)
+	}
+	if c.Starred {
+		q.Set("starred", "true")
+	}
+	if c.Public || (c.Namespace == "" && !c.Starred) {
+		q.Set("public", "true")
+	}
+	if cursor != "" {
+		q.Set("next_page", cursor)
+	}
+	regurl := registry.apiURL("/api/v1/repository?%s", q.Encode())
+	registry.Logf("registry.repositories url=%s", regurl)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", regurl, nil)
+	if err != nil {
+		return CatalogPage{}, err
+	}
+	registry.resetToken()
+	if c.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	} else {
+		registry.useBasicPreAuth()
+	}
+
+	var response struct {
+		Repositories []quayRepository `json:"repositories"`
+		NextPage     string           `json:"next_page"`
+	}
+	if _, err := registry.doJson(req, &response); err != nil {
+		return CatalogPage{}, err
+	}
+
+	page := CatalogPage{
+		Repositories: make([]string, 0, len(response.Repositories)),
+		Next:         response.NextPage,
+	}
+	for _, r := range response.Repositories {
+		page.Repositories = append(page.Repositories, fmt.Sprintf("%s/%s", r.Namespace, r.Name))
+	}
+	return page, nil
+}
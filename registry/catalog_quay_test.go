@@ -0,0 +1,125 @@
+package registry_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// quayDataSource serves Quay's repository API, paginated with next_page
+// tokens. It accepts either an OAuth token or robot credentials.
+func quayDataSource(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/repository" {
+			t.Errorf("unexpected path = %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Header.Get("Authorization") {
+		case "Bearer oauth-token", "Basic dXNlcjpwYXNz":
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "Requires authentication"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		q := r.URL.Query()
+		switch {
+		case q.Get("starred") == "true":
+			w.Write([]byte(`{"repositories":[{"namespace":"project3","name":"repo2"}]}`))
+
+		case q.Get("public") == "true":
+			w.Write([]byte(`{"repositories":[{"namespace":"coreos","name":"etcd"},{"namespace":"project2","name":"repo1"}]}`))
+
+		case q.Get("namespace") != "":
+			ns := q.Get("namespace")
+			if ns != "project" {
+				w.Write([]byte(`{"repositories":[]}`))
+				return
+			}
+			switch q.Get("next_page") {
+			case "":
+				w.Write([]byte(`{"repositories":[{"namespace":"project2","name":"repo1"},{"namespace":"project2","name":"repo2"}],"next_page":"gAAAAABk1"}`))
+			case "gAAAAABk1":
+				w.Write([]byte(`{"repositories":[{"namespace":"project3","name":"repo1"},{"namespace":"project3","name":"repo2"}],"next_page":"gAAAAABk2"}`))
+			case "gAAAAABk2":
+				w.Write([]byte(`{"repositories":[{"namespace":"project4","name":"repo1"},{"namespace":"project4","name":"repo2"}]}`))
+			default:
+				t.Errorf("unexpected next_page = %v", q.Get("next_page"))
+				w.WriteHeader(http.StatusBadRequest)
+			}
+
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error_message": "namespace, starred or public are required for this API call"}`))
+		}
+	}
+}
+
+func Test_QuayCatalog(t *testing.T) {
+	tcs := []struct {
+		name     string
+		provider registry.QuayCatalog
+		expected []string
+	}{
+		{
+			name:     "namespace with oauth token",
+			provider: registry.QuayCatalog{Namespace: "project", Token: "oauth-token"},
+			expected: allTestRepositories,
+		},
+		{
+			name:     "namespace with robot credentials",
+			provider: registry.QuayCatalog{Namespace: "project"},
+			expected: allTestRepositories,
+		},
+		{
+			name:     "starred",
+			provider: registry.QuayCatalog{Starred: true, Token: "oauth-token"},
+			expected: []string{"project3/repo2"},
+		},
+		{
+			name:     "public by default",
+			provider: registry.QuayCatalog{},
+			expected: []string{"coreos/etcd", "project2/repo1"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, quayDataSource(t), tc.provider)
+			defer done()
+
+			repos, err := reg.Repositories()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repos, tc.expected) {
+				t.Errorf("Got %v but expected %v", repos, tc.expected)
+			}
+		})
+
+		t.Run(tc.name+" cursors", func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, quayDataSource(t), tc.provider)
+			defer done()
+
+			repos := listAllPages(t, reg, tc.provider, 0)
+			if !reflect.DeepEqual(repos, tc.expected) {
+				t.Errorf("Got %v but expected %v", repos, tc.expected)
+			}
+		})
+	}
+
+	t.Run("bad token", func(t *testing.T) {
+		provider := registry.QuayCatalog{Namespace: "project", Token: "wrong"}
+		reg, done := newCatalogTestRegistry(t, quayDataSource(t), provider)
+		defer done()
+
+		if _, err := reg.Repositories(); err == nil {
+			t.Fatal("expected an error but did not get one")
+		}
+	})
+}
@@ -0,0 +1,403 @@
+package registry_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// newCatalogTestRegistry starts a TLS test server with handler and returns a
+// registry pointed at it, pinned to provider unless provider is nil.
+func newCatalogTestRegistry(t *testing.T, handler http.HandlerFunc, provider registry.CatalogProvider) (*registry.Registry, func()) {
+	ts := httptest.NewTLSServer(handler)
+
+	u, _ := url.Parse(ts.URL)
+	reg, err := registry.NewWithTransport(fmt.Sprintf("https://%s", u.Host), "user", "pass", &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	reg.Logf = registry.Quiet
+	reg.Catalog = provider
+
+	return reg, ts.Close
+}
+
+// listAllPages walks provider page by page, checking that every cursor it
+// hands out can be used to continue the listing.
+func listAllPages(t *testing.T, reg *registry.Registry, provider registry.CatalogProvider, n int) []string {
+	var repos []string
+	cursor := ""
+	for i := 0; i < 100; i++ {
+		page, err := provider.ListPage(context.Background(), reg, cursor, n)
+		if err != nil {
+			t.Fatalf("unexpected error listing page at cursor %q: %v", cursor, err)
+		}
+		repos = append(repos, page.Repositories...)
+		if page.Next == "" {
+			return repos
+		}
+		cursor = page.Next
+	}
+	t.Fatal("provider never reached the last page")
+	return nil
+}
+
+func distributionDataSource(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_catalog" {
+			t.Errorf("unexpected path = %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		switch r.URL.Query().Get("last") {
+		case "":
+			w.Header().Set("Link", `</v2/_catalog?last=project2%2Frepo2&n=2>; rel="next"`)
+			w.Write([]byte(`{"repositories":["project2/repo1","project2/repo2"]}`))
+		case "project2/repo2":
+			w.Header().Set("Link", `</v2/_catalog?last=project3%2Frepo2&n=2>; rel="next"`)
+			w.Write([]byte(`{"repositories":["project3/repo1","project3/repo2"]}`))
+		case "project3/repo2":
+			w.Write([]byte(`{"repositories":["project4/repo1","project4/repo2"]}`))
+		default:
+			t.Errorf("unexpected last = %v", r.URL.Query().Get("last"))
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+}
+
+var allTestRepositories = []string{"project2/repo1", "project2/repo2", "project3/repo1", "project3/repo2", "project4/repo1", "project4/repo2"}
+
+func Test_CatalogProviders(t *testing.T) {
+	tcs := []struct {
+		name     string
+		provider registry.CatalogProvider
+		handler  func(t *testing.T) func(w http.ResponseWriter, r *http.Request)
+	}{
+		{
+			name:     "distribution",
+			provider: registry.DistributionCatalog{},
+			handler:  distributionDataSource,
+		},
+		{
+			name:     "dtr",
+			provider: registry.DTRCatalog{},
+			handler:  dtrDataSource(2),
+		},
+		{
+			name:     "harbor",
+			provider: registry.HarborCatalog{},
+			handler:  harborDataSource,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name+" pinned", func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, tc.handler(t), tc.provider)
+			defer done()
+
+			repos, err := reg.Repositories()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repos, allTestRepositories) {
+				t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+			}
+		})
+
+		t.Run(tc.name+" cursors", func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, tc.handler(t), tc.provider)
+			defer done()
+
+			repos := listAllPages(t, reg, tc.provider, 0)
+			if !reflect.DeepEqual(repos, allTestRepositories) {
+				t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+			}
+		})
+	}
+}
+
+func Test_CatalogProviders_AutoDetection(t *testing.T) {
+	tcs := []struct {
+		name     string
+		handler  func(t *testing.T) func(w http.ResponseWriter, r *http.Request)
+		provider string
+	}{
+		{name: "distribution", handler: distributionDataSource, provider: registry.CatalogDistribution},
+		{name: "dtr", handler: dtrDataSource(1), provider: registry.CatalogDTR},
+		{name: "harbor", handler: harborDataSource, provider: registry.CatalogHarbor},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, tc.handler(t), nil)
+			defer done()
+
+			it := reg.ListRepositories(registry.ListOptions{})
+			if _, err := it.Next(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if it.Provider() == nil || it.Provider().Name() != tc.provider {
+				t.Errorf("expected provider %v, got %v", tc.provider, it.Provider())
+			}
+		})
+	}
+}
+
+func Test_LookupCatalogProvider(t *testing.T) {
+	for _, name := range []string{registry.CatalogDistribution, registry.CatalogDTR, registry.CatalogHarbor} {
+		p, ok := registry.LookupCatalogProvider(name)
+		if !ok {
+			t.Errorf("provider %v is not registered", name)
+			continue
+		}
+		if p.Name() != name {
+			t.Errorf("expected provider %v, got %v", name, p.Name())
+		}
+	}
+
+	if _, ok := registry.LookupCatalogProvider("nonexistent"); ok {
+		t.Error("expected lookup of an unregistered provider to fail")
+	}
+}
+
+func Test_CatalogProviders_FromCapabilities(t *testing.T) {
+	tcs := []struct {
+		name     string
+		handler  func(t *testing.T) func(w http.ResponseWriter, r *http.Request)
+		basePath string
+		caps     registry.Capabilities
+		provider string
+	}{
+		{
+			name:     "dtr",
+			handler:  dtrDataSource(2),
+			caps:     registry.Capabilities{Flavour: registry.FlavourDTR, Catalog: true},
+			provider: registry.CatalogDTR,
+		},
+		{
+			name:     "harbor without _catalog",
+			handler:  harborV2DataSource,
+			caps:     registry.Capabilities{Flavour: registry.FlavourHarbor},
+			provider: registry.CatalogHarborV2,
+		},
+		{
+			name:     "artifactory",
+			handler:  artifactoryDataSource(true),
+			basePath: registry.ArtifactoryBasePath("docker-local"),
+			caps:     registry.Capabilities{Flavour: registry.FlavourArtifactory, Catalog: true},
+			provider: registry.CatalogArtifactory,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, tc.handler(t), nil)
+			defer done()
+			reg.BasePath = tc.basePath
+			reg.SetCapabilities(&tc.caps)
+
+			it := reg.ListRepositories(registry.ListOptions{N: 2})
+			var repos []string
+			for {
+				repo, err := it.Next(context.Background())
+				if err == registry.ErrIteratorDone {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				repos = append(repos, repo)
+			}
+			if it.Provider() == nil || it.Provider().Name() != tc.provider {
+				t.Errorf("expected provider %v, got %v", tc.provider, it.Provider())
+			}
+			if !reflect.DeepEqual(repos, allTestRepositories) {
+				t.Errorf("Got %v but expected %v", repos, allTestRepositories)
+			}
+		})
+	}
+}
+
+func Test_ListRepositoriesMatching(t *testing.T) {
+	tcs := []struct {
+		name     string
+		opts     registry.RepositoryListOptions
+		expected []string
+	}{
+		{
+			name:     "globs",
+			opts:     registry.RepositoryListOptions{Include: []string{"project[23]/*"}, Exclude: []string{"*/repo2"}},
+			expected: []string{"project2/repo1", "project3/repo1"},
+		},
+		{
+			name:     "regexps",
+			opts:     registry.RepositoryListOptions{IncludeRegexp: []*regexp.Regexp{regexp.MustCompile(`^project[34]/`)}, ExcludeRegexp: []*regexp.Regexp{regexp.MustCompile(`^project3/repo1$`)}},
+			expected: []string{"project3/repo2", "project4/repo1", "project4/repo2"},
+		},
+		{
+			name:     "exclude only",
+			opts:     registry.RepositoryListOptions{Exclude: []string{"project2/*", "project3/*"}},
+			expected: []string{"project4/repo1", "project4/repo2"},
+		},
+		{
+			name:     "no filters",
+			expected: allTestRepositories,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, distributionDataSource(t), nil)
+			defer done()
+
+			repos, err := drainRepositoryIterator(reg.ListRepositoriesMatching(tc.opts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repos, tc.expected) {
+				t.Errorf("Got %v but expected %v", repos, tc.expected)
+			}
+		})
+	}
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, distributionDataSource(t), nil)
+		defer done()
+
+		it := reg.ListRepositoriesMatching(registry.RepositoryListOptions{Include: []string{"["}})
+		if _, err := it.Next(context.Background()); err == nil {
+			t.Error("expected an error for an invalid pattern")
+		}
+	})
+}
+
+func Test_RepositoryIterator_Checkpoint(t *testing.T) {
+	tcs := []struct {
+		name     string
+		handler  func(t *testing.T) func(w http.ResponseWriter, r *http.Request)
+		provider registry.CatalogProvider
+	}{
+		{name: "distribution", handler: distributionDataSource},
+		{name: "dtr", handler: dtrDataSource(2)},
+		{name: "harbor", handler: harborDataSource},
+		{name: "dtr pinned", handler: dtrDataSource(2), provider: registry.DTRCatalog{}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, tc.handler(t), tc.provider)
+			defer done()
+
+			// Stop after every possible number of repositories, then resume
+			// from the checkpoint with a fresh iterator.
+			for stop := 0; stop <= len(allTestRepositories); stop++ {
+				it := reg.ListRepositoriesMatching(registry.RepositoryListOptions{})
+				var repos []string
+				for len(repos) < stop {
+					repo, err := it.Next(context.Background())
+					if err != nil {
+						t.Fatal(err)
+					}
+					repos = append(repos, repo)
+				}
+
+				checkpoint := it.Checkpoint()
+				rest, err := drainRepositoryIterator(reg.ListRepositoriesMatching(registry.RepositoryListOptions{Checkpoint: checkpoint}))
+				if err != nil {
+					t.Fatalf("resuming from %q: %v", checkpoint, err)
+				}
+				if repos = append(repos, rest...); !reflect.DeepEqual(repos, allTestRepositories) {
+					t.Errorf("stopping after %d and resuming from %q, got %v", stop, checkpoint, repos)
+				}
+			}
+		})
+	}
+
+	t.Run("wrong provider", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, distributionDataSource(t), registry.DistributionCatalog{})
+		defer done()
+
+		it := reg.ListRepositoriesMatching(registry.RepositoryListOptions{Checkpoint: "provider=dtr&cursor=x"})
+		if _, err := it.Next(context.Background()); err == nil {
+			t.Error("expected an error for a checkpoint from another provider")
+		}
+	})
+}
+
+func Test_RepositoryIterator_Last(t *testing.T) {
+	tcs := []struct {
+		name     string
+		handler  func(t *testing.T) func(w http.ResponseWriter, r *http.Request)
+		provider registry.CatalogProvider
+		err      error
+	}{
+		{name: "distribution", handler: distributionDataSource},
+		{name: "harbor", handler: harborDataSource, err: registry.ErrLastUnsupported},
+		{name: "dtr pinned", handler: dtrDataSource(2), provider: registry.DTRCatalog{}, err: registry.ErrLastUnsupported},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, done := newCatalogTestRegistry(t, tc.handler(t), tc.provider)
+			defer done()
+
+			last := allTestRepositories[1]
+			repos, err := drainRepositoryIterator(reg.ListRepositories(registry.ListOptions{Last: last}))
+			if err != tc.err {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if expected := allTestRepositories[2:]; err == nil && !reflect.DeepEqual(repos, expected) {
+				t.Errorf("resuming after %s, got %v but expected %v", last, repos, expected)
+			}
+		})
+	}
+
+	t.Run("checkpoints take precedence", func(t *testing.T) {
+		reg, done := newCatalogTestRegistry(t, dtrDataSource(2)(t), registry.DTRCatalog{})
+		defer done()
+
+		it := reg.ListRepositoriesMatching(registry.RepositoryListOptions{})
+		if _, err := it.Next(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		repos, err := drainRepositoryIterator(reg.ListRepositoriesMatching(registry.RepositoryListOptions{
+			ListOptions: registry.ListOptions{Last: allTestRepositories[0]},
+			Checkpoint:  it.Checkpoint(),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := allTestRepositories[1:]; !reflect.DeepEqual(repos, expected) {
+			t.Errorf("got %v but expected %v", repos, expected)
+		}
+	})
+}
+
+func drainRepositoryIterator(it *registry.RepositoryIterator) ([]string, error) {
+	var repos []string
+	for {
+		repo, err := it.Next(context.Background())
+		if err == registry.ErrIteratorDone {
+			return repos, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+}
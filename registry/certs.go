@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultCertsDir is where the Docker daemon looks for per-registry TLS
+// material on Linux.
+const DefaultCertsDir = "/etc/docker/certs.d"
+
+// LoadCertsDir builds a tls.Config for host from a directory laid out like
+// Docker's certs.d:
+//
+//	<certsDir>/<host[:port]>/ca.crt        extra CA certificates (any *.crt)
+//	<certsDir>/<host[:port]>/client.cert   client certificate
+//	<certsDir>/<host[:port]>/client.key    matching private key
+//
+// CA certificates are added to the system pool rather than replacing it. Every
+// *.cert file must have a *.key file with the same base name and vice versa.
+// A missing host directory is not an error; the returned config then behaves
+// like the default one.
+func LoadCertsDir(certsDir, host string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	hostDir := filepath.Join(certsDir, host)
+	files, err := ioutil.ReadDir(hostDir)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(hostDir, name)
+
+		switch filepath.Ext(name) {
+		case ".crt":
+			if err := AppendCAFile(config, path); err != nil {
+				return nil, err
+			}
+		case ".cert":
+			keyPath := strings.TrimSuffix(path, ".cert") + ".key"
+			if _, err := os.Stat(keyPath); err != nil {
+				return nil, fmt.Errorf("missing key %s for client certificate %s", keyPath, path)
+			}
+			if err := AppendClientCertificate(config, path, keyPath); err != nil {
+				return nil, err
+			}
+		case ".key":
+			certPath := strings.TrimSuffix(path, ".key") + ".cert"
+			if _, err := os.Stat(certPath); err != nil {
+				return nil, fmt.Errorf("missing client certificate %s for key %s", certPath, path)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// AppendCAFile adds the PEM-encoded certificates in path to the root CAs
+// trusted by config, starting from the system pool if config has none yet.
+func AppendCAFile(config *tls.Config, path string) error {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if config.RootCAs == nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		config.RootCAs = pool
+	}
+
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", path)
+	}
+	return nil
+}
+
+// AppendClientCertificate loads a PEM-encoded certificate and key pair and
+// adds it to the certificates config presents to servers.
+func AppendClientCertificate(config *tls.Config, certPath, keyPath string) error {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("loading client certificate %s: %v", certPath, err)
+	}
+
+	config.Certificates = append(config.Certificates, cert)
+	return nil
+}
+
+// certsDirHost returns the directory name certs.d uses for registryUrl, which
+// is the host with its port if one was given.
+func certsDirHost(registryUrl string) (string, error) {
+	u, err := url.Parse(registryUrl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("registry url %q has no host", registryUrl)
+	}
+	return u.Host, nil
+}
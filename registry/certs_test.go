@@ -0,0 +1,221 @@
+package registry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if !isCA {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, path string, content []byte) {
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_CertsDir_MutualTLS(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, true, 0)
+	serverCert := newTestCert(t, "127.0.0.1", ca, false, x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, "client", ca, false, x509.ExtKeyUsageClientAuth)
+
+	serverPair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			t.Errorf("expected a client certificate")
+		}
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	certsDir, err := ioutil.TempDir("", "certs.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certsDir)
+
+	host, err := certsDirHost(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostDir := filepath.Join(certsDir, host)
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any material for the host, verification of the private CA fails.
+	r, err := NewWithCertsDir(server.URL, "", "", certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Ping(); err == nil {
+		t.Fatal("expected ping to fail without the CA certificate")
+	}
+
+	writeTestFile(t, filepath.Join(hostDir, "ca.crt"), ca.certPEM)
+	writeTestFile(t, filepath.Join(hostDir, "client.cert"), clientCert.certPEM)
+	writeTestFile(t, filepath.Join(hostDir, "client.key"), clientCert.keyPEM)
+
+	r, err = NewWithCertsDir(server.URL, "", "", certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Ping(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func Test_LoadCertsDir(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, true, 0)
+	clientCert := newTestCert(t, "client", ca, false, x509.ExtKeyUsageClientAuth)
+
+	tcs := []struct {
+		name         string
+		files        map[string][]byte
+		expectErr    bool
+		expectCAs    bool
+		expectClient int
+	}{
+		{
+			name:  "missing host directory",
+			files: nil,
+		},
+		{
+			name:      "ca only",
+			files:     map[string][]byte{"ca.crt": ca.certPEM},
+			expectCAs: true,
+		},
+		{
+			name:         "client pair",
+			files:        map[string][]byte{"client.cert": clientCert.certPEM, "client.key": clientCert.keyPEM},
+			expectClient: 1,
+		},
+		{
+			name:      "certificate without key",
+			files:     map[string][]byte{"client.cert": clientCert.certPEM},
+			expectErr: true,
+		},
+		{
+			name:      "key without certificate",
+			files:     map[string][]byte{"client.key": clientCert.keyPEM},
+			expectErr: true,
+		},
+		{
+			name:      "ca file without certificates",
+			files:     map[string][]byte{"ca.crt": []byte("not a certificate")},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			certsDir, err := ioutil.TempDir("", "certs.d")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(certsDir)
+
+			if tc.files != nil {
+				hostDir := filepath.Join(certsDir, "registry.example.com:5000")
+				if err := os.MkdirAll(hostDir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				for name, content := range tc.files {
+					writeTestFile(t, filepath.Join(hostDir, name), content)
+				}
+			}
+
+			config, err := LoadCertsDir(certsDir, "registry.example.com:5000")
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected an error but did not get one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (config.RootCAs != nil) != tc.expectCAs {
+				t.Errorf("expected root CAs to be set: %v, got %v", tc.expectCAs, config.RootCAs != nil)
+			}
+			if len(config.Certificates) != tc.expectClient {
+				t.Errorf("expected %d client certificates, got %d", tc.expectClient, len(config.Certificates))
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	manifestV1 "github.com/docker/distribution/manifest/schema1"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Media types of layers that live outside the registry, such as Windows base
+// layers, and so are never copied.
+var foreignLayerMediaTypes = map[string]bool{
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": true,
+}
+
+// CopyRef names an image in a registry for Copy.
+type CopyRef struct {
+	Registry *Registry
+
+	// Reference is parsed with Registry.ParseReference, so it may leave out
+	// the domain. A destination without a tag or digest takes the source's.
+	Reference string
+}
+
+// CopyOptions changes how Copy works.
+type CopyOptions struct {
+	// Platforms limits which images are copied from a manifest list or OCI
+	// index. The index is rewritten to list only those images, which gives
+	// it a new digest. When empty, every image is copied and the index is
+	// pushed unchanged.
+	Platforms []Platform
+
+	// MountFrom lists repositories in the destination registry that may
+	// already hold the blobs, to mount them from rather than upload them.
+	// When both references are in the same registry, the source repository
+	// is always tried first.
+	MountFrom []string
+}
+
+// CopyResult describes what Copy did.
+type CopyResult struct {
+	// Digest and MediaType are those of the manifest pushed to the
+	// destination reference.
+	Digest    digest.Digest
+	MediaType string
+
+	Manifests    int   // manifests pushed, including those in an index
+	BlobsCopied  int   // blobs streamed from the source
+	BlobsMounted int   // blobs mounted from another repository
+	BlobsSkipped int   // blobs the destination already had
+	BytesCopied  int64 // bytes of the blobs that were streamed
+}
+
+/*
+ * Copy an image, with all of its blobs, from one registry or repository to
+ * another. Blobs are streamed straight from the source to the destination,
+ * skipped when the destination already has them, and mounted when they can
+ * be found in another repository of the destination registry. Manifest lists
+ * and OCI indexes are copied with every image they list, or those selected
+ * by opts.Platforms. Manifests are pushed byte for byte, so their digests are
+ * preserved.
+ */
+func Copy(ctx context.Context, src, dst CopyRef, opts CopyOptions) (*CopyResult, error) {
+	srcRef, err := src.Registry.ParseReference(src.Reference)
+	if err != nil {
+		return nil, err
+	}
+	dstRef, err := dst.Registry.ParseReference(dst.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if dstRef.Tag == "" && dstRef.Digest == "" {
+		dstRef.Tag, dstRef.Digest = srcRef.Tag, srcRef.Digest
+	}
+
+	ctx, span := dst.Registry.startSpan(ctx, "registry.Copy", "source", srcRef.String(), "destination", dstRef.String())
+	defer span.End()
+
+	c := &copier{
+		src:     src.Registry,
+		dst:     dst.Registry,
+		srcRepo: srcRef.Repository,
+		dstRepo: dstRef.Repository,
+		opts:    opts,
+		result:  &CopyResult{},
+	}
+	if sameRegistry(c.src, c.dst) && c.srcRepo != c.dstRepo {
+		c.mountFrom = append(c.mountFrom, c.srcRepo)
+	}
+	for _, repo := range opts.MountFrom {
+		if repo != c.dstRepo && !containsString(c.mountFrom, repo) {
+			c.mountFrom = append(c.mountFrom, repo)
+		}
+	}
+
+	c.result.Digest, c.result.MediaType, err = c.copyManifest(ctx, srcRef.Reference(), dstRef.Reference(), 0)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("copying %s to %s: %w", srcRef, dstRef, err)
+	}
+	return c.result, nil
+}
+
+// CopyRef is Copy for two full image references in this registry.
+func (registry *Registry) CopyRef(ctx context.Context, src, dst string, opts CopyOptions) (*CopyResult, error) {
+	return Copy(ctx, CopyRef{Registry: registry, Reference: src}, CopyRef{Registry: registry, Reference: dst}, opts)
+}
+
+type copier struct {
+	src, dst         *Registry
+	srcRepo, dstRepo string
+	mountFrom        []string
+	opts             CopyOptions
+	result           *CopyResult
+}
+
+// copyManifest copies the manifest at srcReference and everything it refers
+// to, then pushes it to dstReference.
+func (c *copier) copyManifest(ctx context.Context, srcReference, dstReference string, depth int) (digest.Digest, string, error) {
+	if depth > 4 {
+		return "", "", fmt.Errorf("%s: indexes nested too deeply", srcReference)
+	}
+
+	raw, err := c.src.manifestRaw(ctx, c.srcRepo, srcReference)
+	if err != nil {
+		return "", "", err
+	}
+	payload := raw.Payload
+
+	switch raw.MediaType {
+	case MediaTypeManifestList, MediaTypeOCIIndex:
+		payload, err = filterIndex(payload, c.opts.Platforms, func(descriptor Descriptor) error {
+			_, _, err := c.copyManifest(ctx, descriptor.Digest.String(), descriptor.Digest.String(), depth+1)
+			return err
+		})
+		if err != nil {
+			return "", "", err
+		}
+		if len(c.opts.Platforms) > 0 && digest.FromBytes(payload) != raw.Digest {
+			// The filtered index can't be pushed by the source's digest.
+			if _, err := digest.Parse(dstReference); err == nil {
+				dstReference = digest.FromBytes(payload).String()
+			}
+		}
+
+	default:
+		blobs, err := manifestBlobs(raw)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %w", srcReference, err)
+		}
+		for _, blob := range blobs {
+			if err := c.copyBlob(ctx, blob); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	dgst, err := c.dst.pushManifest(ctx, c.dstRepo, dstReference, raw.MediaType, payload, nil)
+	if err != nil {
+		return "", "", err
+	}
+	c.result.Manifests++
+	return dgst, raw.MediaType, nil
+}
+
+// filterIndex calls visit for each image an index lists on one of platforms,
+// or on any platform when platforms is empty, and returns the index with only
+// those images: the original, or a rewritten one if some were left out.
+func filterIndex(payload []byte, platforms []Platform, visit func(Descriptor) error) ([]byte, error) {
+	// Keep every field of the index and its entries, including those this
+	// library doesn't know about, in case the index has to be rewritten.
+	var index map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &index); err != nil {
+		return nil, err
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(index["manifests"], &entries); err != nil {
+		return nil, err
+	}
+
+	kept := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		var descriptor Descriptor
+		if err := json.Unmarshal(entry, &descriptor); err != nil {
+			return nil, err
+		}
+		if !wantPlatform(platforms, descriptor.Platform) {
+			continue
+		}
+		if err := visit(descriptor); err != nil {
+			return nil, err
+		}
+		kept = append(kept, entry)
+	}
+
+	if len(kept) == len(entries) {
+		return payload, nil
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("%w among %s", ErrPlatformNotFound, platformsString(platforms))
+	}
+
+	manifests, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	index["manifests"] = manifests
+	return json.Marshal(index)
+}
+
+func wantPlatform(platforms []Platform, platform *Platform) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	if platform == nil {
+		return false
+	}
+	for _, want := range platforms {
+		if platform.matches(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestBlobs returns the blobs an image manifest refers to, leaving out
+// foreign layers. The sizes of schema 1 layers aren't known, and are -1.
+func manifestBlobs(raw *RawManifest) ([]Descriptor, error) {
+	switch raw.MediaType {
+	case manifestV2.MediaTypeManifest, MediaTypeOCIManifest:
+		manifest := &imageManifest{}
+		if err := json.Unmarshal(raw.Payload, manifest); err != nil {
+			return nil, err
+		}
+		blobs := []Descriptor{manifest.Config}
+		for _, layer := range manifest.Layers {
+			if !foreignLayerMediaTypes[layer.MediaType] {
+				blobs = append(blobs, layer)
+			}
+		}
+		return blobs, nil
+
+	case manifestV1.MediaTypeManifest, manifestV1.MediaTypeSignedManifest:
+		manifest := &manifestV1.Manifest{}
+		if err := json.Unmarshal(raw.Payload, manifest); err != nil {
+			return nil, err
+		}
+		var blobs []Descriptor
+		for _, layer := range manifest.FSLayers {
+			blobs = append(blobs, Descriptor{Digest: layer.BlobSum, Size: -1})
+		}
+		return blobs, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported manifest type %q", raw.MediaType)
+	}
+}
+
+// copyBlob makes sure the destination has a blob, by finding it there,
+// mounting it from another repository or streaming it from the source.
+func (c *copier) copyBlob(ctx context.Context, descriptor Descriptor) error {
+	dgst := descriptor.Digest
+
+	exists, err := c.dst.hasLayer(ctx, c.dstRepo, dgst)
+	if err != nil {
+		return err
+	}
+	if exists {
+		c.dst.Logf("registry.copy.skip repository=%s digest=%s", c.dstRepo, dgst)
+		c.result.BlobsSkipped++
+		return nil
+	}
+
+	// A declined mount starts an upload session, which the blob is streamed
+	// to. Only the last one is kept.
+	var uploadUrl *url.URL
+	for _, from := range c.mountFrom {
+		mounted, sessionUrl, err := c.dst.mountLayer(ctx, c.dstRepo, dgst, from)
+		if err != nil {
+			// Mounting is only an optimisation; fall back to copying.
+			c.dst.Logf("registry.copy.mount repository=%s digest=%s from=%s err=%v", c.dstRepo, dgst, from, err)
+			continue
+		}
+		if mounted {
+			if uploadUrl != nil {
+				c.dst.cancelUpload(ctx, uploadUrl)
+			}
+			c.result.BlobsMounted++
+			return nil
+		}
+		if sessionUrl != nil {
+			if uploadUrl != nil {
+				c.dst.cancelUpload(ctx, uploadUrl)
+			}
+			uploadUrl = sessionUrl
+		}
+	}
+
+	resp, err := c.src.downloadLayer(ctx, c.srcRepo, dgst)
+	if err != nil {
+		if uploadUrl != nil {
+			c.dst.cancelUpload(ctx, uploadUrl)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	size := descriptor.Size
+	if size < 0 {
+		size = resp.ContentLength
+	}
+	content := &countingReader{ReadCloser: resp.Body}
+	if err := c.dst.uploadLayer(ctx, c.dstRepo, dgst, content, size, uploadUrl); err != nil {
+		return err
+	}
+	c.result.BlobsCopied++
+	c.result.BytesCopied += content.n
+	return nil
+}
+
+// sameRegistry reports whether two registries serve the same API, so that
+// blobs can be mounted from one repository into another.
+func sameRegistry(a, b *Registry) bool {
+	return a.URL == b.URL && a.basePath() == b.basePath()
+}
+
+func platformsString(platforms []Platform) string {
+	s := make([]string, len(platforms))
+	for i, platform := range platforms {
+		s[i] = platform.String()
+	}
+	return fmt.Sprint(s)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,368 @@
+package registry_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// memoryRegistry is just enough of a registry to push and pull images: it
+// supports monolithic uploads, cross-repository mounts, manifests of any
+// type, tag listing and deletes. Upload locations are relative, as the spec
+// allows.
+type memoryRegistry struct {
+	t *testing.T
+
+	// tagDeletion allows deleting tags by name; without it, only manifests
+	// can be deleted, with all of their tags, as in older registries.
+	tagDeletion bool
+
+	// etags serves manifest digests as ETags and honours If-Match and
+	// If-None-Match on pushes.
+	etags bool
+
+	// beforePut, when set, runs before a manifest push is handled, to
+	// simulate a concurrent push.
+	beforePut func(repo, reference string)
+
+	sync.Mutex
+	blobs     map[string]map[digest.Digest][]byte // by repository
+	manifests map[string]map[string][]byte        // by repository, then tag or digest
+	types     map[digest.Digest]string
+	uploads   int
+}
+
+func newMemoryRegistry(t *testing.T) *memoryRegistry {
+	return &memoryRegistry{
+		t:         t,
+		blobs:     map[string]map[digest.Digest][]byte{},
+		manifests: map[string]map[string][]byte{},
+		types:     map[digest.Digest]string{},
+	}
+}
+
+func (m *memoryRegistry) putBlob(repo string, content []byte) digest.Digest {
+	d := digest.FromBytes(content)
+	if m.blobs[repo] == nil {
+		m.blobs[repo] = map[digest.Digest][]byte{}
+	}
+	m.blobs[repo][d] = content
+	return d
+}
+
+func (m *memoryRegistry) putManifest(repo, reference, mediaType string, payload []byte) digest.Digest {
+	d := digest.FromBytes(payload)
+	if m.manifests[repo] == nil {
+		m.manifests[repo] = map[string][]byte{}
+	}
+	m.manifests[repo][reference] = payload
+	m.manifests[repo][d.String()] = payload
+	m.types[d] = mediaType
+	return d
+}
+
+func (m *memoryRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		tags := []string{}
+		for reference := range m.manifests[repo] {
+			if _, err := digest.Parse(reference); err != nil {
+				tags = append(tags, reference)
+			}
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repo, "tags": tags})
+
+	case strings.Contains(path, "/manifests/"):
+		i := strings.Index(path, "/manifests/")
+		repo, reference := path[:i], path[i+len("/manifests/"):]
+		switch r.Method {
+		case "GET", "HEAD":
+			payload, ok := m.manifests[repo][reference]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", m.types[digest.FromBytes(payload)])
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(payload).String())
+			if m.etags {
+				w.Header().Set("Etag", fmt.Sprintf("%q", digest.FromBytes(payload)))
+			}
+			w.Write(payload)
+		case "PUT":
+			if m.beforePut != nil {
+				m.beforePut(repo, reference)
+			}
+			if m.etags && !m.preconditionHolds(r, m.manifests[repo][reference]) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			payload, _ := ioutil.ReadAll(r.Body)
+			if d, err := digest.Parse(reference); err == nil && d != digest.FromBytes(payload) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			m.putManifest(repo, reference, r.Header.Get("Content-Type"), payload)
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			if _, ok := m.manifests[repo][reference]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			d, err := digest.Parse(reference)
+			if err != nil {
+				if !m.tagDeletion {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				delete(m.manifests[repo], reference)
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			for other, payload := range m.manifests[repo] {
+				if digest.FromBytes(payload) == d {
+					delete(m.manifests[repo], other)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}
+
+	case strings.HasSuffix(path, "/blobs/uploads/"):
+		repo := strings.TrimSuffix(path, "/blobs/uploads/")
+		if mount := digest.Digest(r.URL.Query().Get("mount")); mount != "" {
+			if content, ok := m.blobs[r.URL.Query().Get("from")][mount]; ok {
+				m.putBlob(repo, content)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		m.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repo, m.uploads))
+		w.WriteHeader(http.StatusAccepted)
+
+	case strings.Contains(path, "/blobs/uploads/"):
+		repo := path[:strings.Index(path, "/blobs/uploads/")]
+		switch r.Method {
+		case "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		case "PUT":
+			if r.ContentLength < 0 {
+				m.t.Errorf("upload of %s has no Content-Length", r.URL.Query().Get("digest"))
+			}
+			content, _ := ioutil.ReadAll(r.Body)
+			if digest.FromBytes(content).String() != r.URL.Query().Get("digest") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			m.putBlob(repo, content)
+			w.WriteHeader(http.StatusCreated)
+		}
+
+	case strings.Contains(path, "/blobs/"):
+		i := strings.Index(path, "/blobs/")
+		repo, d := path[:i], digest.Digest(path[i+len("/blobs/"):])
+		content, ok := m.blobs[repo][d]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+
+	default:
+		m.t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (m *memoryRegistry) preconditionHolds(r *http.Request, current []byte) bool {
+	if r.Header.Get("If-None-Match") == "*" && current != nil {
+		return false
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		return current != nil && match == fmt.Sprintf("%q", digest.FromBytes(current))
+	}
+	return true
+}
+
+// pushTestImage stores a single-layer image for platform in repo and returns
+// its manifest's descriptor.
+func pushTestImage(t *testing.T, m *memoryRegistry, repo, mediaType string, platform registry.Platform) registry.Descriptor {
+	config := mustJSON(t, map[string]interface{}{"architecture": platform.Architecture, "os": platform.OS})
+	layer := []byte("layer for " + platform.String())
+	manifest := mustJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaType,
+		"config":        map[string]interface{}{"digest": m.putBlob(repo, config), "size": len(config)},
+		"layers":        []interface{}{map[string]interface{}{"digest": m.putBlob(repo, layer), "size": len(layer)}},
+	})
+	return registry.Descriptor{
+		MediaType: mediaType,
+		Digest:    m.putManifest(repo, platform.Architecture, mediaType, manifest),
+		Size:      int64(len(manifest)),
+		Platform:  &platform,
+	}
+}
+
+// pushTestIndex stores an index of amd64 and arm64 images as repo:latest.
+func pushTestIndex(t *testing.T, m *memoryRegistry, repo string) digest.Digest {
+	amd64 := pushTestImage(t, m, repo, "application/vnd.docker.distribution.manifest.v2+json", registry.Platform{OS: "linux", Architecture: "amd64"})
+	arm64 := pushTestImage(t, m, repo, registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+
+	// Pretty-printed, so that re-encoding it would change its digest.
+	index, err := json.MarshalIndent(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     registry.MediaTypeOCIIndex,
+		"manifests":     []registry.Descriptor{amd64, arm64},
+	}, "", "   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.putManifest(repo, "latest", registry.MediaTypeOCIIndex, index)
+}
+
+func Test_Copy(t *testing.T) {
+	src := newMemoryRegistry(t)
+	indexDigest := pushTestIndex(t, src, "app")
+	srcReg, srcDone := newCatalogTestRegistry(t, src.ServeHTTP, nil)
+	defer srcDone()
+
+	dst := newMemoryRegistry(t)
+	dstReg, dstDone := newCatalogTestRegistry(t, dst.ServeHTTP, nil)
+	defer dstDone()
+
+	result, err := registry.Copy(context.Background(), registry.CopyRef{Registry: srcReg, Reference: "app:latest"}, registry.CopyRef{Registry: dstReg, Reference: "promoted/app"}, registry.CopyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Digest != indexDigest || result.MediaType != registry.MediaTypeOCIIndex {
+		t.Errorf("expected %s %s, got %s %s", registry.MediaTypeOCIIndex, indexDigest, result.MediaType, result.Digest)
+	}
+	if result.Manifests != 3 || result.BlobsCopied != 4 || result.BlobsSkipped != 0 || result.BytesCopied == 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// Every manifest arrives byte for byte.
+	for reference, payload := range src.manifests["app"] {
+		if _, err := digest.Parse(reference); err != nil {
+			continue
+		}
+		if string(dst.manifests["promoted/app"][reference]) != string(payload) {
+			t.Errorf("manifest %s differs", reference)
+		}
+	}
+	if digest.FromBytes(dst.manifests["promoted/app"]["latest"]) != indexDigest {
+		t.Error("index digest changed")
+	}
+
+	t.Run("existing blobs are skipped", func(t *testing.T) {
+		result, err := dstReg.CopyRef(context.Background(), "promoted/app:latest", "promoted/app:again", registry.CopyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.BlobsSkipped != 4 || result.BlobsCopied != 0 {
+			t.Errorf("unexpected result %+v", result)
+		}
+	})
+
+	t.Run("blobs are mounted within a registry", func(t *testing.T) {
+		result, err := dstReg.CopyRef(context.Background(), "promoted/app@"+indexDigest.String(), "other/app", registry.CopyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.BlobsMounted != 4 || result.BlobsCopied != 0 {
+			t.Errorf("unexpected result %+v", result)
+		}
+		if _, ok := dst.manifests["other/app"][indexDigest.String()]; !ok {
+			t.Error("index was not pushed by digest")
+		}
+	})
+
+	t.Run("declined mounts' upload sessions are used", func(t *testing.T) {
+		dst := newMemoryRegistry(t)
+		dstReg, dstDone := newCatalogTestRegistry(t, dst.ServeHTTP, nil)
+		defer dstDone()
+
+		result, err := registry.Copy(context.Background(), registry.CopyRef{Registry: srcReg, Reference: "app:latest"}, registry.CopyRef{Registry: dstReg, Reference: "app"}, registry.CopyOptions{
+			MountFrom: []string{"empty"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.BlobsCopied != 4 || result.BlobsMounted != 0 {
+			t.Errorf("unexpected result %+v", result)
+		}
+		if dst.uploads != 4 {
+			t.Errorf("expected an upload session per blob, got %d", dst.uploads)
+		}
+	})
+
+	t.Run("platform filter", func(t *testing.T) {
+		result, err := registry.Copy(context.Background(), registry.CopyRef{Registry: srcReg, Reference: "app"}, registry.CopyRef{Registry: dstReg, Reference: "arm/app:latest"}, registry.CopyOptions{
+			Platforms: []registry.Platform{{OS: "linux", Architecture: "arm64"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Manifests != 2 || result.BlobsCopied+result.BlobsMounted+result.BlobsSkipped != 2 {
+			t.Errorf("unexpected result %+v", result)
+		}
+		if result.Digest == indexDigest {
+			t.Error("expected the filtered index to have a new digest")
+		}
+
+		config, err := dstReg.ImageConfigForPlatform("arm/app", "latest", registry.Platform{OS: "linux", Architecture: "arm64"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Architecture != "arm64" {
+			t.Errorf("expected arm64, got %s", config.Architecture)
+		}
+		if _, err := dstReg.ImageConfigForPlatform("arm/app", "latest", registry.Platform{OS: "linux", Architecture: "amd64"}); err == nil {
+			t.Error("expected amd64 to have been filtered out")
+		}
+	})
+
+	t.Run("missing platform", func(t *testing.T) {
+		_, err := registry.Copy(context.Background(), registry.CopyRef{Registry: srcReg, Reference: "app"}, registry.CopyRef{Registry: dstReg, Reference: "s390x/app"}, registry.CopyOptions{
+			Platforms: []registry.Platform{{OS: "linux", Architecture: "s390x"}},
+		})
+		if err == nil {
+			t.Error("expected an error when no platform matches")
+		}
+	})
+}
+
+func Test_PushManifest_DigestMismatch(t *testing.T) {
+	m := newMemoryRegistry(t)
+	reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+	defer done()
+
+	payload := []byte(`{"schemaVersion": 2}`)
+	if _, err := reg.PushManifest("app", digest.FromString("other").String(), registry.MediaTypeOCIManifest, payload); err == nil {
+		t.Error("expected an error pushing a manifest by the wrong digest")
+	}
+	d, err := reg.PushManifest("app", "v1", registry.MediaTypeOCIManifest, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != digest.FromBytes(payload) {
+		t.Errorf("unexpected digest %s", d)
+	}
+}
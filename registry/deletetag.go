@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+)
+
+/*
+ * Delete a tag without touching any other tag. Where the registry supports
+ * it, the tag itself is deleted. Otherwise the manifest it points to is
+ * deleted, unless another tag points to it too, or to an index or manifest
+ * list that lists it; then the tag is first moved onto a placeholder manifest
+ * of its own, with PushManifestIf, and the placeholder deleted. The
+ * placeholder's config blob is left for the registry's garbage collection.
+ *
+ * If the tag is moved while it's being deleted, a *ConflictError is returned
+ * rather than deleting the manifest it was moved to, subject to the same gap
+ * as PushManifestIf.
+ *
+ * Harbor deletes the whole artifact when asked to delete a tag, so tags are
+ * never deleted directly there.
+ */
+func (registry *Registry) DeleteTag(repository, tag string) error {
+	return registry.deleteTag(context.Background(), repository, tag, "")
+}
+
+// deleteTag deletes tag, which must point to expected unless that's empty.
+func (registry *Registry) deleteTag(ctx context.Context, repository, tag string, expected digest.Digest) error {
+	ctx, span := registry.startSpan(ctx, "registry.DeleteTag", "repository", repository, "tag", tag)
+	defer span.End()
+
+	if _, err := digest.Parse(tag); err == nil {
+		return fmt.Errorf("%s is a digest, not a tag", tag)
+	}
+
+	// Make sure the tag exists before deleting anything.
+	dgst, err := registry.manifestDigest(ctx, repository, tag)
+	if err != nil {
+		return err
+	}
+	if expected != "" && dgst != expected {
+		return &ConflictError{Repository: repository, Tag: tag, Expected: expected, Actual: dgst}
+	}
+
+	if registry.mayDeleteTags() {
+		err := registry.deleteManifest(ctx, repository, tag)
+		if err == nil {
+			return nil
+		}
+		// Registries that only delete by digest reject tags as invalid
+		// digests or refuse the method.
+		if !isHttpStatus(err, http.StatusBadRequest) && !isHttpStatus(err, http.StatusMethodNotAllowed) {
+			return err
+		}
+		registry.Logf("registry.tag.delete repository=%s tag=%s falling back to deleting by digest", repository, tag)
+	}
+
+	shared, err := registry.sharesManifest(ctx, repository, tag, dgst)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		// Another tag may have been pushed onto the manifest while the
+		// others were checked.
+		actual, _, err := registry.tagState(ctx, repository, tag)
+		if err != nil {
+			return err
+		}
+		if actual != dgst {
+			return &ConflictError{Repository: repository, Tag: tag, Expected: dgst, Actual: actual}
+		}
+		return registry.deleteManifest(ctx, repository, dgst.String())
+	}
+
+	placeholder, err := registry.pushPlaceholder(ctx, repository, tag, dgst)
+	if err != nil {
+		return fmt.Errorf("moving %s:%s onto a placeholder: %w", repository, tag, err)
+	}
+	return registry.deleteManifest(ctx, repository, placeholder.String())
+}
+
+// mayDeleteTags reports whether deleting a tag directly is worth trying.
+func (registry *Registry) mayDeleteTags() bool {
+	if registry.flavour() == FlavourHarbor {
+		return false
+	}
+	if caps := registry.Capabilities(); caps != nil && caps.TagDeletion == Unsupported {
+		return false
+	}
+	return true
+}
+
+// sharesManifest reports whether any tag other than tag points to dgst, or to
+// an index that lists it, so that deleting dgst would break that tag.
+func (registry *Registry) sharesManifest(ctx context.Context, repository, tag string, dgst digest.Digest) (bool, error) {
+	tags, err := drain(ctx, registry.ListTags(repository, ListOptions{}).Next)
+	if err != nil {
+		return false, err
+	}
+	checked := map[digest.Digest]bool{dgst: true}
+	for _, other := range tags {
+		if other == tag {
+			continue
+		}
+		otherDigest, err := registry.manifestDigest(ctx, repository, other)
+		if isHttpStatus(err, http.StatusNotFound) {
+			// Deleted since the tags were listed.
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if otherDigest == dgst {
+			return true, nil
+		}
+		if checked[otherDigest] {
+			continue
+		}
+		checked[otherDigest] = true
+
+		lists, err := registry.indexLists(ctx, repository, otherDigest, dgst)
+		if err != nil || lists {
+			return lists, err
+		}
+	}
+	return false, nil
+}
+
+// indexLists reports whether the manifest at index is an index or manifest
+// list that lists dgst.
+func (registry *Registry) indexLists(ctx context.Context, repository string, index, dgst digest.Digest) (bool, error) {
+	raw, err := registry.manifestRaw(ctx, repository, index.String())
+	if isHttpStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if raw.MediaType != MediaTypeManifestList && raw.MediaType != MediaTypeOCIIndex {
+		return false, nil
+	}
+	parsed := &imageIndex{}
+	if err := json.Unmarshal(raw.Payload, parsed); err != nil {
+		return false, err
+	}
+	for _, descriptor := range parsed.Manifests {
+		if descriptor.Digest == dgst {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pushPlaceholder moves tag from expected onto a new, empty image that nothing
+// else can refer to, and returns its manifest's digest. It uses the Docker
+// schema 2 format, which every registry accepts.
+func (registry *Registry) pushPlaceholder(ctx context.Context, repository, tag string, expected digest.Digest) (digest.Digest, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	// The nonce makes the config, and so the manifest, unique.
+	config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","config":{"Labels":{"placeholder":%q}},"rootfs":{"type":"layers","diff_ids":[]}}`, hex.EncodeToString(nonce)))
+	configDigest := digest.FromBytes(config)
+	if err := registry.uploadLayer(ctx, repository, configDigest, bytes.NewReader(config), int64(len(config)), nil); err != nil {
+		return "", err
+	}
+
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"size":%d,"digest":%q},"layers":[]}`,
+		manifestV2.MediaTypeManifest, manifestV2.MediaTypeImageConfig, len(config), configDigest))
+	return registry.pushManifestIf(ctx, repository, tag, expected, manifestV2.MediaTypeManifest, manifest)
+}
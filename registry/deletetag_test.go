@@ -0,0 +1,133 @@
+package registry_test
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+func Test_DeleteTag(t *testing.T) {
+	for _, tagDeletion := range []bool{true, false} {
+		name := "by digest"
+		if tagDeletion {
+			name = "by tag"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			m := newMemoryRegistry(t)
+			m.tagDeletion = tagDeletion
+			image := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "amd64"})
+			m.putManifest("app", "v1.4.0", image.MediaType, m.manifests["app"]["amd64"])
+			m.putManifest("app", "pr-123", image.MediaType, m.manifests["app"]["amd64"])
+			alone := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "arm64"})
+
+			reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+			defer done()
+
+			// The siblings of a shared manifest survive.
+			if err := reg.DeleteTag("app", "pr-123"); err != nil {
+				t.Fatal(err)
+			}
+			for _, tag := range []string{"amd64", "v1.4.0"} {
+				d, err := reg.ManifestDigest("app", tag)
+				if err != nil {
+					t.Fatalf("%s was lost: %v", tag, err)
+				}
+				if d != image.Digest {
+					t.Errorf("%s moved to %s", tag, d)
+				}
+			}
+
+			// A manifest with a single tag goes along with it.
+			if err := reg.DeleteTagRef("app:arm64"); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := m.manifests["app"][alone.Digest.String()]; ok != tagDeletion {
+				t.Errorf("expected the manifest to remain only when tags can be deleted by name")
+			}
+
+			tags, err := reg.Tags("app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := []string{"amd64", "v1.4.0"}; !reflect.DeepEqual(tags, expected) {
+				t.Errorf("expected tags %v, got %v", expected, tags)
+			}
+		})
+	}
+
+	t.Run("manifests an index lists", func(t *testing.T) {
+		m := newMemoryRegistry(t)
+		indexDigest := pushTestIndex(t, m, "app")
+		reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+		defer done()
+		amd64, err := reg.ManifestDigest("app", "amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := reg.DeleteTag("app", "amd64"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.manifests["app"][amd64.String()]; !ok {
+			t.Error("a manifest app:latest lists was deleted")
+		}
+		if _, err := reg.ManifestDigest("app", "amd64"); err == nil {
+			t.Error("the tag wasn't deleted")
+		}
+		if d, err := reg.ManifestDigest("app", "latest"); err != nil || d != indexDigest {
+			t.Errorf("app:latest changed: %s, %v", d, err)
+		}
+	})
+
+	t.Run("retagged while being deleted", func(t *testing.T) {
+		for _, shared := range []bool{true, false} {
+			m := newMemoryRegistry(t)
+			m.etags = true
+			image := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "amd64"})
+			other := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "arm64"})
+			m.putManifest("app", "release", image.MediaType, m.manifests["app"]["amd64"])
+			if !shared {
+				delete(m.manifests["app"], "amd64")
+			}
+
+			// Someone moves the tag while the other tags are being checked.
+			reg, done := newCatalogTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/tags/list") {
+					m.Lock()
+					m.putManifest("app", "release", other.MediaType, m.manifests["app"]["arm64"])
+					m.Unlock()
+				}
+				m.ServeHTTP(w, r)
+			}, nil)
+			defer done()
+
+			var conflict *registry.ConflictError
+			if err := reg.DeleteTag("app", "release"); !errors.As(err, &conflict) {
+				t.Errorf("shared=%v: expected a conflict, got %v", shared, err)
+			}
+			if d, err := reg.ManifestDigest("app", "release"); err != nil || d != other.Digest {
+				t.Errorf("shared=%v: the moved tag was lost: %s, %v", shared, d, err)
+			}
+			if _, ok := m.manifests["app"][other.Digest.String()]; !ok {
+				t.Errorf("shared=%v: the manifest the tag was moved to was deleted", shared)
+			}
+		}
+	})
+
+	t.Run("missing tag", func(t *testing.T) {
+		m := newMemoryRegistry(t)
+		reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+		defer done()
+
+		err := reg.DeleteTag("app", "missing")
+		var statusErr *registry.HttpStatusError
+		if !errors.As(err, &statusErr) || statusErr.Response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected a 404, got %v", err)
+		}
+	})
+}
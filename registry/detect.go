@@ -0,0 +1,361 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// Flavour identifies a registry implementation.
+type Flavour string
+
+const (
+	FlavourUnknown      Flavour = ""
+	FlavourDistribution Flavour = "distribution" // CNCF Distribution (Docker's registry:2) or a compatible server
+	FlavourHarbor       Flavour = "harbor"
+	FlavourDTR          Flavour = "dtr" // Docker Trusted Registry, now Mirantis Secure Registry
+	FlavourQuay         Flavour = "quay"
+	FlavourGitLab       Flavour = "gitlab"
+	FlavourECR          Flavour = "ecr" // Amazon Elastic Container Registry
+	FlavourGAR          Flavour = "gar" // Google Artifact Registry and Container Registry
+	FlavourACR          Flavour = "acr" // Azure Container Registry
+	FlavourArtifactory  Flavour = "artifactory"
+	FlavourNexus        Flavour = "nexus"
+	FlavourZot          Flavour = "zot"
+)
+
+// flavourCatalogs names the catalog providers to use for flavours whose
+// `_catalog` is missing or incomplete, in order of preference. Flavours whose
+// providers need configuration, such as GitLab and Quay, aren't listed.
+var flavourCatalogs = map[Flavour][]string{
+	FlavourDTR:         {CatalogDTR},
+	FlavourHarbor:      {CatalogHarborV2, CatalogHarbor},
+	FlavourArtifactory: {CatalogArtifactory},
+}
+
+// Support is the answer to whether a registry supports a feature, which can
+// be unknown when the registry didn't let Detect find out.
+type Support int
+
+const (
+	SupportUnknown Support = iota
+	Supported
+	Unsupported
+)
+
+func (s Support) String() string {
+	switch s {
+	case Supported:
+		return "supported"
+	case Unsupported:
+		return "unsupported"
+	default:
+		return "unknown"
+	}
+}
+
+// Capabilities describes a registry as found by Detect.
+type Capabilities struct {
+	Flavour Flavour
+
+	// Catalog reports whether `/v2/_catalog` answers. DTR answers with an
+	// incomplete list, so ListRepositories uses the DTR API there anyway.
+	Catalog bool
+
+	// Delete and TagDeletion report whether manifests can be deleted by
+	// digest and whether tags can be deleted. Detect never sends deletes, so
+	// they're unknown until ProbeDelete has run.
+	Delete      Support
+	TagDeletion Support
+
+	// Referrers reports whether the OCI referrers API is served. It's probed
+	// against Repository, and is unknown when there is no repository to
+	// probe or the credentials don't allow the probe.
+	Referrers  Support
+	Repository string
+
+	// AuthSchemes are the lower-case schemes the registry offers in its
+	// WWW-Authenticate challenges, such as "basic" or "bearer". They're empty
+	// when the registry allows anonymous access. AuthService is the service
+	// parameter of the bearer challenge.
+	AuthSchemes []string
+	AuthService string
+}
+
+// A digest no manifest has, so deleting it can't do any harm.
+const probeDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+/*
+ * Probe the registry and report what it is and what it supports. The
+ * repository-level capabilities are probed against the first repository in
+ * `_catalog`; use DetectRepository to pick one. The result is recorded as
+ * the registry's Capabilities, so that later calls such as ListRepositories
+ * can use it instead of guessing.
+ */
+func (registry *Registry) Detect(ctx context.Context) (*Capabilities, error) {
+	return registry.DetectRepository(ctx, "")
+}
+
+/*
+ * Detect the registry's capabilities, as with Detect, probing the referrers
+ * API against the given repository. It only sends reads; use ProbeDelete to
+ * find out whether deletes are allowed.
+ */
+func (registry *Registry) DetectRepository(ctx context.Context, repository string) (*Capabilities, error) {
+	ctx, span := registry.startSpan(ctx, "registry.Detect")
+	defer span.End()
+
+	caps := &Capabilities{}
+
+	// Ask for /v2/ without credentials, to see the registry's challenges.
+	url := registry.url("/v2/")
+	registry.Logf("registry.detect url=%s", url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := registry.baseTransport().RoundTrip(req)
+	if err != nil {
+		// The registry's own transport may have turned a 401 into an error.
+		if he, ok := err.(*HttpStatusError); ok {
+			resp = he.Response
+		} else {
+			return nil, err
+		}
+	} else {
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &HttpStatusError{Response: resp, Body: body}
+	}
+
+	challenges := parseAuthHeader(resp.Header)
+	for _, challenge := range challenges {
+		caps.AuthSchemes = append(caps.AuthSchemes, challenge.Scheme)
+		if challenge.Scheme == "bearer" {
+			caps.AuthService = challenge.Parameters["service"]
+		}
+	}
+	caps.Flavour = classifyFlavour(registry.URL, resp.Header, challenges)
+
+	// Then ask for the first repository, with credentials.
+	registry.resetToken()
+	var catalog repositoriesResponse
+	url = registry.url("/v2/_catalog?n=1")
+	registry.Logf("registry.detect url=%s", url)
+	if _, err := registry.getJson(ctx, url, &catalog); err == nil {
+		caps.Catalog = true
+		if repository == "" && len(catalog.Repositories) > 0 {
+			repository = catalog.Repositories[0]
+		}
+	}
+
+	if caps.Flavour == FlavourUnknown || caps.Flavour == FlavourDistribution {
+		if flavour := registry.observedFlavour(); flavour != FlavourUnknown {
+			caps.Flavour = flavour
+		} else if registry.probe(ctx, "GET", registry.url("/v2/_zot/ext/discover")) == http.StatusOK {
+			caps.Flavour = FlavourZot
+		}
+	}
+
+	if repository != "" {
+		caps.Repository = repository
+		caps.Referrers = referrersSupport(registry.probe(ctx, "GET", registry.url("/v2/%s/referrers/%s", repository, probeDigest)))
+	}
+
+	registry.SetCapabilities(caps)
+	return caps, nil
+}
+
+/*
+ * Probe whether manifests and tags can be deleted in repository, by deleting
+ * a digest and a random tag that can't exist. These are real, authenticated
+ * deletes, which a registry that resolved them loosely could act on, so
+ * Detect never sends them; pick a repository where that would do no harm.
+ * The answers are recorded in the registry's Capabilities, which are
+ * detected first if Detect hasn't run.
+ */
+func (registry *Registry) ProbeDelete(ctx context.Context, repository string) (*Capabilities, error) {
+	detected := registry.Capabilities()
+	if detected == nil {
+		var err error
+		if detected, err = registry.DetectRepository(ctx, repository); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, span := registry.startSpan(ctx, "registry.ProbeDelete", "repository", repository)
+	defer span.End()
+
+	// Others may be reading the recorded capabilities, so update a copy.
+	caps := *detected
+	caps.Delete = deleteSupport(registry.probe(ctx, "DELETE", registry.url("/v2/%s/manifests/%s", repository, probeDigest)))
+	caps.TagDeletion = deleteSupport(registry.probe(ctx, "DELETE", registry.url("/v2/%s/manifests/%s", repository, probeTag())))
+	if caps.Delete == Unsupported {
+		caps.TagDeletion = Unsupported
+	}
+	registry.SetCapabilities(&caps)
+	return &caps, nil
+}
+
+// probe sends a request through the registry's client and returns the
+// response's status code, or zero if there was no response.
+func (registry *Registry) probe(ctx context.Context, method, url string) int {
+	registry.Logf("registry.detect method=%s url=%s", method, url)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return 0
+	}
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		status, _ := httpStatus(err)
+		return status
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// probeTag returns a tag name that no repository has.
+func probeTag() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "detect-" + hex.EncodeToString(b)
+}
+
+// deleteSupport interprets the response to deleting something that doesn't
+// exist: a registry that doesn't allow deletes refuses the method. A 404 could
+// come from a registry that looked the manifest up, or from one that doesn't
+// know the repository, so it says nothing.
+func deleteSupport(status int) Support {
+	switch status {
+	case http.StatusOK, http.StatusAccepted:
+		return Supported
+	case http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return Unsupported
+	default:
+		return SupportUnknown
+	}
+}
+
+// referrersSupport interprets the response to asking for the referrers of a
+// digest that doesn't exist, which is an empty index where the API is served.
+func referrersSupport(status int) Support {
+	switch status {
+	case http.StatusOK:
+		return Supported
+	case http.StatusNotFound, http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return Unsupported
+	default:
+		return SupportUnknown
+	}
+}
+
+// classifyFlavour works out the registry implementation from its URL, the
+// headers of a response and the challenges in it.
+func classifyFlavour(registryURL string, header http.Header, challenges []*AuthorizationChallenge) Flavour {
+	host := ""
+	if u, err := neturl.Parse(registryURL); err == nil {
+		host = strings.ToLower(u.Hostname())
+	}
+	switch {
+	case strings.Contains(host, ".dkr.ecr.") && strings.HasSuffix(host, ".amazonaws.com"):
+		return FlavourECR
+	case strings.HasSuffix(host, "-docker.pkg.dev") || host == "gcr.io" || strings.HasSuffix(host, ".gcr.io"):
+		return FlavourGAR
+	case strings.HasSuffix(host, ".azurecr.io"):
+		return FlavourACR
+	case host == "quay.io":
+		return FlavourQuay
+	}
+
+	if header.Get("X-Artifactory-Id") != "" || header.Get("X-JFrog-Version") != "" {
+		return FlavourArtifactory
+	}
+	if strings.HasPrefix(header.Get("Server"), "Nexus/") {
+		return FlavourNexus
+	}
+
+	for _, challenge := range challenges {
+		realm := strings.ToLower(challenge.Parameters["realm"])
+		service := strings.ToLower(challenge.Parameters["service"])
+		switch {
+		case service == "dtr":
+			return FlavourDTR
+		case service == "harbor-registry" || strings.HasSuffix(realm, "/service/token"):
+			return FlavourHarbor
+		case service == "container_registry" || strings.HasSuffix(realm, "/jwt/auth"):
+			return FlavourGitLab
+		case service == "ecr.amazonaws.com":
+			return FlavourECR
+		case strings.HasSuffix(service, ".azurecr.io"):
+			return FlavourACR
+		case strings.Contains(realm, "/artifactory/"):
+			return FlavourArtifactory
+		case strings.Contains(realm, "sonatype nexus"):
+			return FlavourNexus
+		case strings.HasSuffix(realm, "/v2/auth"):
+			return FlavourQuay
+		case realm == "zot":
+			return FlavourZot
+		}
+	}
+
+	if strings.HasPrefix(header.Get("Docker-Distribution-Api-Version"), "registry/2.") {
+		return FlavourDistribution
+	}
+	return FlavourUnknown
+}
+
+// observedFlavour classifies the registry from what its transport has seen
+// so far: the registry's URL and the last bearer challenge it answered. It
+// sends no requests.
+func (registry *Registry) observedFlavour() Flavour {
+	var challenges []*AuthorizationChallenge
+	if t := registry.tokenTransport(); t != nil {
+		if service := t.lastAuthService(); service != nil {
+			challenges = append(challenges, &AuthorizationChallenge{
+				Scheme: "bearer",
+				Parameters: map[string]string{
+					"realm":   service.Realm,
+					"service": service.Service,
+				},
+			})
+		}
+	}
+	return classifyFlavour(registry.URL, http.Header{}, challenges)
+}
+
+// Capabilities returns what Detect found out about the registry, or nil if
+// it hasn't run. They must not be modified.
+func (registry *Registry) Capabilities() *Capabilities {
+	caps, _ := registry.capabilities.Load().(*Capabilities)
+	return caps
+}
+
+// SetCapabilities records caps as the registry's capabilities, as Detect
+// does, so that they're used to choose a catalog provider instead of
+// guessing. Use it to skip detection for a registry that's already known.
+func (registry *Registry) SetCapabilities(caps *Capabilities) {
+	registry.capabilities.Store(caps)
+}
+
+// flavour returns the registry's flavour from its Capabilities if Detect has
+// run, and from what it has seen so far otherwise.
+func (registry *Registry) flavour() Flavour {
+	if caps := registry.Capabilities(); caps != nil && caps.Flavour != FlavourUnknown {
+		return caps.Flavour
+	}
+	return registry.observedFlavour()
+}
+
+func (caps *Capabilities) String() string {
+	return fmt.Sprintf("flavour=%s catalog=%t delete=%s tag-deletion=%s referrers=%s auth=%s",
+		caps.Flavour, caps.Catalog, caps.Delete, caps.TagDeletion, caps.Referrers, strings.Join(caps.AuthSchemes, ","))
+}
@@ -0,0 +1,275 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ClassifyFlavour(t *testing.T) {
+	tcs := []struct {
+		name     string
+		url      string
+		header   http.Header
+		auth     string
+		expected Flavour
+	}{
+		{name: "ecr", url: "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com", auth: `Basic realm="https://123456789012.dkr.ecr.eu-west-1.amazonaws.com/",service="ecr.amazonaws.com"`, expected: FlavourECR},
+		{name: "gar", url: "https://europe-docker.pkg.dev", auth: `Bearer realm="https://europe-docker.pkg.dev/v2/token"`, expected: FlavourGAR},
+		{name: "gcr", url: "https://eu.gcr.io", auth: `Bearer realm="https://eu.gcr.io/v2/token",service="eu.gcr.io"`, expected: FlavourGAR},
+		{name: "acr", url: "https://example.azurecr.io", auth: `Bearer realm="https://example.azurecr.io/oauth2/token",service="example.azurecr.io"`, expected: FlavourACR},
+		{name: "quay.io", url: "https://quay.io", auth: `Bearer realm="https://quay.io/v2/auth",service="quay.io"`, expected: FlavourQuay},
+		{name: "quay", url: "https://quay.example.com", auth: `Bearer realm="https://quay.example.com/v2/auth",service="quay.example.com"`, expected: FlavourQuay},
+		{name: "harbor", url: "https://harbor.example.com", auth: `Bearer realm="https://harbor.example.com/service/token",service="harbor-registry"`, expected: FlavourHarbor},
+		{name: "dtr", url: "https://dtr.example.com", auth: `Bearer realm="https://dtr.example.com/auth/token",service="dtr"`, expected: FlavourDTR},
+		{name: "gitlab", url: "https://registry.gitlab.com", auth: `Bearer realm="https://gitlab.com/jwt/auth",service="container_registry"`, expected: FlavourGitLab},
+		{name: "artifactory header", url: "https://example.jfrog.io", header: http.Header{"X-Jfrog-Version": {"Artifactory/7.77.5"}}, expected: FlavourArtifactory},
+		{name: "artifactory realm", url: "https://artifactory.example.com", auth: `Bearer realm="https://artifactory.example.com/artifactory/api/docker/docker-local/v2/token",service="artifactory.example.com"`, expected: FlavourArtifactory},
+		{name: "nexus", url: "https://nexus.example.com", header: http.Header{"Server": {"Nexus/3.61.0-02 (OSS)"}}, auth: `BASIC realm="Sonatype Nexus Repository Manager"`, expected: FlavourNexus},
+		{name: "distribution", url: "https://registry.example.com", header: http.Header{"Docker-Distribution-Api-Version": {"registry/2.0"}}, auth: `Basic realm="registry"`, expected: FlavourDistribution},
+		{name: "unknown", url: "https://registry.example.com", expected: FlavourUnknown},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tc.header {
+				header[k] = v
+			}
+			if tc.auth != "" {
+				header.Set("WWW-Authenticate", tc.auth)
+			}
+
+			if flavour := classifyFlavour(tc.url, header, parseAuthHeader(header)); flavour != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, flavour)
+			}
+		})
+	}
+}
+
+func Test_Registry_Detect(t *testing.T) {
+	tcs := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected Capabilities
+	}{
+		{
+			name: "distribution with deletes disabled",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+				switch {
+				case r.URL.Path == "/v2/":
+					w.Write([]byte(`{}`))
+				case r.URL.Path == "/v2/_catalog":
+					w.Write([]byte(`{"repositories":["library/alpine"]}`))
+				case r.Method == "DELETE":
+					w.WriteHeader(http.StatusMethodNotAllowed)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			},
+			expected: Capabilities{
+				Flavour:     FlavourDistribution,
+				Catalog:     true,
+				Delete:      Unsupported,
+				TagDeletion: Unsupported,
+				Referrers:   Unsupported,
+				Repository:  "library/alpine",
+			},
+		},
+		{
+			name: "harbor",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+				if r.URL.Path == "/service/token" {
+					w.Write([]byte(`{"token":"x"}`))
+					return
+				}
+				if r.Header.Get("Authorization") != "Bearer x" {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/service/token",service="harbor-registry"`, r.Host))
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				switch {
+				case r.URL.Path == "/v2/_catalog":
+					w.Write([]byte(`{"repositories":["library/alpine"]}`))
+				case strings.Contains(r.URL.Path, "/referrers/"):
+					w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+					w.Write([]byte(`{"schemaVersion":2,"manifests":[]}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			},
+			expected: Capabilities{
+				Flavour:     FlavourHarbor,
+				Catalog:     true,
+				Delete:      SupportUnknown, // 404s could mean there's no such repository
+				TagDeletion: SupportUnknown,
+				Referrers:   Supported,
+				Repository:  "library/alpine",
+				AuthSchemes: []string{"bearer"},
+				AuthService: "harbor-registry",
+			},
+		},
+		{
+			name: "zot without repositories",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+				switch r.URL.Path {
+				case "/v2/", "/v2/_zot/ext/discover":
+					w.Write([]byte(`{}`))
+				case "/v2/_catalog":
+					w.Write([]byte(`{"repositories":[]}`))
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			},
+			expected: Capabilities{
+				Flavour: FlavourZot,
+				Catalog: true,
+			},
+		},
+		{
+			name: "nexus",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Server", "Nexus/3.61.0-02 (OSS)")
+				if _, _, ok := r.BasicAuth(); !ok {
+					w.Header().Set("WWW-Authenticate", `BASIC realm="Sonatype Nexus Repository Manager"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				switch {
+				case r.URL.Path == "/v2/_catalog":
+					w.Write([]byte(`{"repositories":["app"]}`))
+				case r.Method == "DELETE" && strings.Contains(r.URL.Path, "/manifests/sha256:"):
+					w.WriteHeader(http.StatusNotFound)
+				case r.Method == "DELETE":
+					w.WriteHeader(http.StatusBadRequest)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			},
+			expected: Capabilities{
+				Flavour:     FlavourNexus,
+				Catalog:     true,
+				Delete:      SupportUnknown,
+				TagDeletion: Unsupported,
+				Referrers:   Unsupported,
+				Repository:  "app",
+				AuthSchemes: []string{"basic"},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			deleting := false
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "DELETE" && !deleting {
+					t.Errorf("Detect sent %s %s", r.Method, r.URL)
+				}
+				tc.handler(w, r)
+			}))
+			defer ts.Close()
+
+			reg, err := NewWithTransport(ts.URL, "user", "pass", &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg.Logf = Quiet
+
+			caps, err := reg.Detect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			detected := tc.expected
+			detected.Delete, detected.TagDeletion = SupportUnknown, SupportUnknown
+			if !reflect.DeepEqual(*caps, detected) {
+				t.Errorf("expected %v, got %v", &detected, caps)
+			}
+			if reg.Capabilities() != caps {
+				t.Error("expected Detect to record the capabilities on the registry")
+			}
+			if caps.Repository == "" {
+				return
+			}
+
+			deleting = true
+			caps, err = reg.ProbeDelete(context.Background(), caps.Repository)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*caps, tc.expected) {
+				t.Errorf("expected %v after probing deletes, got %v", &tc.expected, caps)
+			}
+		})
+	}
+}
+
+func Test_Registry_Detect_NotARegistry(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	reg, err := NewWithTransport(ts.URL, "", "", &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Logf = Quiet
+
+	if _, err := reg.Detect(context.Background()); !isHttpStatus(err, http.StatusNotFound) {
+		t.Errorf("expected a 404, got %v", err)
+	}
+}
+
+func Test_Registry_ProbeDelete_Concurrent(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/_catalog":
+			w.Write([]byte(`{"repositories":["app"]}`))
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer ts.Close()
+
+	reg, err := NewWithTransport(ts.URL, "user", "pass", &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Logf = Quiet
+	if _, err := reg.Detect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run with -race: probing must not write capabilities others are reading.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reg.ProbeDelete(context.Background(), "app")
+	}()
+	for probing := true; probing; {
+		select {
+		case <-done:
+			probing = false
+		default:
+			reg.mayDeleteTags()
+		}
+	}
+	if reg.mayDeleteTags() {
+		t.Error("expected tag deletion to be unsupported after probing")
+	}
+}
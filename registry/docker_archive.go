@@ -0,0 +1,414 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DockerArchiveImage is an image in a `docker save` tarball, as the tarball's
+// manifest.json lists it.
+type DockerArchiveImage struct {
+	// Config is the path of the image config in the tarball. It is empty
+	// for images of tarballs without manifest.json, whose config is built
+	// from their layers' legacy json files.
+	Config string
+
+	// RepoTags are the names the image is loaded as, such as
+	// "heroku/cedar:14".
+	RepoTags []string
+
+	// Layers are the paths of the layer tars in the tarball, base first.
+	Layers []string
+}
+
+/*
+ * DockerArchive is a tarball as `docker save` writes and `docker load` reads,
+ * optionally gzipped. Tarballs from Docker 1.10 and later list their images in
+ * manifest.json. Older ones only have a `repositories` file naming each
+ * image's top layer, and a legacy `json` file per layer pointing to its
+ * parent; their images are read from those.
+ */
+type DockerArchive struct {
+	tarArchive
+
+	Images []DockerArchiveImage
+}
+
+// OpenDockerArchive opens a tarball written by `docker save`.
+func OpenDockerArchive(path string) (*DockerArchive, error) {
+	tarArchive, err := openTarArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	archive := &DockerArchive{tarArchive: *tarArchive}
+
+	b, err := archive.readFile("manifest.json")
+	switch {
+	case err == nil:
+		err = json.Unmarshal(b, &archive.Images)
+		for i := range archive.Images {
+			image := &archive.Images[i]
+			image.Config = archivePath(image.Config)
+			for j, layer := range image.Layers {
+				image.Layers[j] = archivePath(layer)
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		archive.Images, err = archive.legacyImages()
+	}
+	if err != nil {
+		archive.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return archive, nil
+}
+
+// legacyImage is the legacy json file of a layer, which for the top layer of
+// an image also holds the image's config.
+type legacyImage struct {
+	Parent          string     `json:"parent,omitempty"`
+	Created         *time.Time `json:"created,omitempty"`
+	Author          string     `json:"author,omitempty"`
+	Comment         string     `json:"comment,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd,omitempty"`
+	} `json:"container_config"`
+}
+
+// legacyImages finds the images of a tarball without manifest.json.
+func (archive *DockerArchive) legacyImages() ([]DockerArchiveImage, error) {
+	b, err := archive.readFile("repositories")
+	if err != nil {
+		return nil, err
+	}
+	var repositories map[string]map[string]string
+	if err := json.Unmarshal(b, &repositories); err != nil {
+		return nil, fmt.Errorf("repositories: %v", err)
+	}
+
+	repoTags := map[string][]string{}
+	for repository, tags := range repositories {
+		for tag, id := range tags {
+			repoTags[id] = append(repoTags[id], repository+":"+tag)
+		}
+	}
+	var ids []string
+	for id := range repoTags {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var images []DockerArchiveImage
+	for _, id := range ids {
+		sort.Strings(repoTags[id])
+		image := DockerArchiveImage{RepoTags: repoTags[id]}
+		for layer := id; layer != ""; {
+			if len(image.Layers) > 1000 {
+				return nil, fmt.Errorf("layer %s: parent chain too long", id)
+			}
+			b, err := archive.readFile(path.Join(layer, "json"))
+			if err != nil {
+				return nil, err
+			}
+			v1 := &legacyImage{}
+			if err := json.Unmarshal(b, v1); err != nil {
+				return nil, fmt.Errorf("%s/json: %v", layer, err)
+			}
+			image.Layers = append([]string{path.Join(layer, "layer.tar")}, image.Layers...)
+			layer = v1.Parent
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+/*
+ * Push the images of a `docker save` tarball to a repository, without a
+ * Docker daemon, as Docker schema 2 images. Each image is tagged with the
+ * tags of its RepoTags, or as opts.Tags maps its RepoTags; images without
+ * RepoTags are pushed by digest alone. Nothing is pushed if two images would
+ * get the same tag. Layers are gzipped, as `docker push`
+ * does, and blobs the repository already has are skipped. The layers are
+ * checked against the diff IDs in the image config.
+ */
+func (registry *Registry) ImportDockerArchive(ctx context.Context, archive *DockerArchive, repository string, opts ImportOptions) (*ImportResult, error) {
+	ctx, span := registry.startSpan(ctx, "registry.ImportDockerArchive", "repository", repository)
+	defer span.End()
+
+	names := make([][]string, len(archive.Images))
+	for i, image := range archive.Images {
+		names[i] = image.RepoTags
+	}
+	// Images from different repositories can share a tag, such as
+	// a:latest and b:latest.
+	targets, err := importTargets(names, opts, repository, "the tarball", func(i, j int) bool {
+		return sameArchiveImage(archive.Images[i], archive.Images[j])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	im := &importer{
+		registry:   registry,
+		repository: repository,
+		pushed:     map[digest.Digest]bool{},
+		blobs:      map[digest.Digest]bool{},
+		result:     &ImportResult{},
+	}
+	layers := map[string]*archiveLayer{}
+	for i, image := range archive.Images {
+		if len(targets[i]) == 0 {
+			continue
+		}
+
+		manifest, err := archive.importImage(ctx, im, image, layers)
+		if err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("importing %s: %w", strings.Join(image.RepoTags, ", "), err)
+		}
+		descriptor := Descriptor{
+			MediaType: manifestV2.MediaTypeManifest,
+			Digest:    digest.FromBytes(manifest),
+			Size:      int64(len(manifest)),
+		}
+		for _, target := range targets[i] {
+			reference := target.Tag
+			if reference == "" {
+				reference = descriptor.Digest.String()
+			}
+			if _, err := registry.pushManifest(ctx, repository, reference, manifestV2.MediaTypeManifest, manifest, nil); err != nil {
+				return nil, err
+			}
+			im.result.Manifests++
+			target.Descriptor = descriptor
+			im.result.Images = append(im.result.Images, target)
+		}
+	}
+	return im.result, nil
+}
+
+// sameArchiveImage reports whether two entries of manifest.json are the same
+// image, which can be listed once per repository it was saved from.
+func sameArchiveImage(a, b DockerArchiveImage) bool {
+	return a.Config != "" && a.Config == b.Config && reflect.DeepEqual(a.Layers, b.Layers)
+}
+
+// importImage uploads an image's layers and config, and returns the schema 2
+// manifest to push for it. layers caches the layers already inspected, by
+// path.
+func (archive *DockerArchive) importImage(ctx context.Context, im *importer, image DockerArchiveImage, layers map[string]*archiveLayer) ([]byte, error) {
+	var diffIDs []digest.Digest
+	for _, name := range image.Layers {
+		layer, ok := layers[name]
+		if !ok {
+			var err error
+			if layer, err = archive.inspectLayer(name); err != nil {
+				return nil, err
+			}
+			layers[name] = layer
+		}
+		diffIDs = append(diffIDs, layer.diffID)
+	}
+
+	var config []byte
+	var err error
+	if image.Config != "" {
+		config, err = archive.readFile(image.Config)
+	} else {
+		config, err = archive.legacyConfig(image.Layers, diffIDs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDiffIDs(config, diffIDs); err != nil {
+		return nil, err
+	}
+
+	manifest := imageManifest{
+		SchemaVersion: 2,
+		MediaType:     manifestV2.MediaTypeManifest,
+		Config: Descriptor{
+			MediaType: manifestV2.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []Descriptor{},
+	}
+	for _, name := range image.Layers {
+		name, layer := name, layers[name]
+		err := im.uploadBlob(ctx, layer.descriptor, func() (io.ReadCloser, int64, error) {
+			f, err := archive.openLayer(name, layer)
+			return f, layer.descriptor.Size, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, layer.descriptor)
+	}
+	err = im.uploadBlob(ctx, manifest.Config, func() (io.ReadCloser, int64, error) {
+		return ioutil.NopCloser(bytes.NewReader(config)), int64(len(config)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(manifest)
+}
+
+// checkDiffIDs makes sure that the layers are those the config expects.
+func checkDiffIDs(config []byte, diffIDs []digest.Digest) error {
+	parsed := &ImageConfig{}
+	if err := json.Unmarshal(config, parsed); err != nil {
+		return fmt.Errorf("image config: %v", err)
+	}
+	expected := parsed.RootFS.DiffIDs
+	if len(expected) != len(diffIDs) {
+		return fmt.Errorf("image config lists %d layers, the tarball has %d", len(expected), len(diffIDs))
+	}
+	for i := range expected {
+		if expected[i] != diffIDs[i] {
+			return fmt.Errorf("%w: layer %d is %s, the image config expects %s", ErrDigestMismatch, i, diffIDs[i], expected[i])
+		}
+	}
+	return nil
+}
+
+// legacyConfig builds the config of an image from its layers' legacy json
+// files, as Docker does when it loads a tarball without manifest.json: the
+// top layer's, with the legacy fields left out, and the others as history.
+func (archive *DockerArchive) legacyConfig(layers []string, diffIDs []digest.Digest) ([]byte, error) {
+	var config map[string]json.RawMessage
+	var history []History
+	for i, layer := range layers {
+		b, err := archive.readFile(path.Join(path.Dir(layer), "json"))
+		if err != nil {
+			return nil, err
+		}
+		v1 := &legacyImage{}
+		if err := json.Unmarshal(b, v1); err != nil {
+			return nil, err
+		}
+		history = append(history, History{
+			Created:   v1.Created,
+			CreatedBy: strings.Join(v1.ContainerConfig.Cmd, " "),
+			Author:    v1.Author,
+			Comment:   v1.Comment,
+		})
+		if i == len(layers)-1 {
+			if err := json.Unmarshal(b, &config); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, key := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"} {
+		delete(config, key)
+	}
+	var err error
+	if config["rootfs"], err = json.Marshal(RootFS{Type: "layers", DiffIDs: diffIDs}); err != nil {
+		return nil, err
+	}
+	if config["history"], err = json.Marshal(history); err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
+
+// archiveLayer is a layer of a docker archive as it is pushed: gzipped, as
+// `docker push` does, unless it already was in the tarball.
+type archiveLayer struct {
+	descriptor Descriptor
+	diffID     digest.Digest
+	compressed bool
+}
+
+// inspectLayer reads a layer to find its diff ID and the digest and size it
+// has once gzipped. Gzipping is deterministic, so openLayer gzips it to the
+// same bytes again.
+func (archive *DockerArchive) inspectLayer(name string) (*archiveLayer, error) {
+	f, size, err := archive.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content := bufio.NewReader(f)
+	diffID := digest.SHA256.Digester()
+	blob := digest.SHA256.Digester()
+	layer := &archiveLayer{descriptor: Descriptor{MediaType: manifestV2.MediaTypeLayer}}
+
+	if isGzip(content) {
+		gz, err := gzip.NewReader(io.TeeReader(content, blob.Hash()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err := io.Copy(diffID.Hash(), gz); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err := io.Copy(blob.Hash(), content); err != nil {
+			return nil, err
+		}
+		layer.compressed = true
+		layer.descriptor.Size = size
+	} else {
+		compressed := &countingWriter{Writer: blob.Hash()}
+		gz := gzip.NewWriter(compressed)
+		if _, err := io.Copy(gz, io.TeeReader(content, diffID.Hash())); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		layer.descriptor.Size = compressed.n
+	}
+
+	layer.descriptor.Digest = blob.Digest()
+	layer.diffID = diffID.Digest()
+	return layer, nil
+}
+
+// openLayer opens a layer for upload, gzipping it on the fly if needed.
+func (archive *DockerArchive) openLayer(name string, layer *archiveLayer) (io.ReadCloser, error) {
+	f, _, err := archive.open(name)
+	if err != nil || layer.compressed {
+		return f, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer f.Close()
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, f)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,248 @@
+package registry_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// pushTestDockerImage stores a two-layer Docker image as repo:tag, with a
+// config whose diff IDs match its uncompressed layers, and returns its
+// config's digest.
+func pushTestDockerImage(t *testing.T, m *memoryRegistry, repo, tag string) digest.Digest {
+	base, top := []byte("base layer"), []byte("top layer")
+	config := mustJSON(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Cmd": []string{"/bin/app"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []digest.Digest{digest.FromBytes(base), digest.FromBytes(top)}},
+		"history":      []map[string]string{{"created_by": "ADD base"}, {"created_by": "ADD app"}},
+	})
+	manifest := mustJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.docker.container.image.v1+json", "digest": m.putBlob(repo, config), "size": len(config)},
+		"layers": []interface{}{
+			map[string]interface{}{"mediaType": "application/vnd.docker.image.rootfs.diff.tar", "digest": m.putBlob(repo, base), "size": len(base)},
+			map[string]interface{}{"mediaType": "application/vnd.docker.image.rootfs.diff.tar", "digest": m.putBlob(repo, top), "size": len(top)},
+		},
+	})
+	m.putManifest(repo, tag, "application/vnd.docker.distribution.manifest.v2+json", manifest)
+	return digest.FromBytes(config)
+}
+
+// readTar returns the files in a tarball.
+func readTar(t *testing.T, path string) map[string][]byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			files[header.Name], _ = ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// writeTar writes files to a new tarball and returns its path.
+func writeTar(t *testing.T, files map[string][]byte) string {
+	f, err := ioutil.TempFile("", "archive-*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(content)), Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func Test_DockerArchive(t *testing.T) {
+	src := newMemoryRegistry(t)
+	configDigest := pushTestDockerImage(t, src, "app", "v1")
+	srcReg, srcDone := newCatalogTestRegistry(t, src.ServeHTTP, nil)
+	defer srcDone()
+
+	f, err := ioutil.TempFile("", "saved-*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err := srcReg.SaveDockerArchive(context.Background(), f, []string{"app:v1"}, registry.SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The tarball has what docker load reads, and the legacy layer chain.
+	files := readTar(t, f.Name())
+	var manifest []registry.DockerArchiveImage
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || len(manifest[0].Layers) != 2 || !strings.HasSuffix(manifest[0].RepoTags[0], "/app:v1") {
+		t.Fatalf("unexpected manifest.json %+v", manifest)
+	}
+	if digest.FromBytes(files[manifest[0].Config]) != configDigest {
+		t.Error("config differs")
+	}
+	var top struct {
+		ID     string `json:"id"`
+		Parent string `json:"parent"`
+	}
+	if err := json.Unmarshal(files[strings.TrimSuffix(manifest[0].Layers[1], "layer.tar")+"json"], &top); err != nil {
+		t.Fatal(err)
+	}
+	if top.Parent+"/layer.tar" != manifest[0].Layers[0] || top.ID+"/layer.tar" != manifest[0].Layers[1] {
+		t.Errorf("unexpected legacy ids %+v", top)
+	}
+	if !strings.Contains(string(files["repositories"]), top.ID) {
+		t.Errorf("repositories doesn't name the top layer: %s", files["repositories"])
+	}
+
+	for _, legacy := range []bool{false, true} {
+		name := "manifest.json"
+		if legacy {
+			name = "legacy"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			path := f.Name()
+			if legacy {
+				withoutManifest := map[string][]byte{}
+				for name, content := range files {
+					if name != "manifest.json" {
+						withoutManifest[name] = content
+					}
+				}
+				path = writeTar(t, withoutManifest)
+				defer os.Remove(path)
+			}
+
+			archive, err := registry.OpenDockerArchive(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer archive.Close()
+
+			dst := newMemoryRegistry(t)
+			dstReg, dstDone := newCatalogTestRegistry(t, dst.ServeHTTP, nil)
+			defer dstDone()
+
+			result, err := dstReg.ImportDockerArchive(context.Background(), archive, "loaded/app", registry.ImportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Images) != 1 || result.Images[0].Tag != "v1" || result.BlobsUploaded != 3 {
+				t.Errorf("unexpected result %+v", result)
+			}
+
+			config, err := dstReg.ImageConfig("loaded/app", "v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !legacy && config.Digest != configDigest {
+				t.Error("config changed")
+			}
+			if len(config.Layers) != 2 || len(config.Config.Cmd) != 1 || config.Config.Cmd[0] != "/bin/app" {
+				t.Errorf("unexpected config %+v", config)
+			}
+		})
+	}
+
+	t.Run("images sharing a tag", func(t *testing.T) {
+		// a:latest and b:latest are different images.
+		other := strings.Replace(string(files[manifest[0].Config]), "/bin/app", "/bin/other", 1)
+		shared := map[string][]byte{"other.json": []byte(other)}
+		for name, content := range files {
+			shared[name] = content
+		}
+		shared["manifest.json"] = mustJSON(t, []registry.DockerArchiveImage{
+			{Config: manifest[0].Config, RepoTags: []string{"a:latest"}, Layers: manifest[0].Layers},
+			{Config: "other.json", RepoTags: []string{"b:latest"}, Layers: manifest[0].Layers},
+		})
+		path := writeTar(t, shared)
+		defer os.Remove(path)
+
+		archive, err := registry.OpenDockerArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer archive.Close()
+
+		dst := newMemoryRegistry(t)
+		dstReg, dstDone := newCatalogTestRegistry(t, dst.ServeHTTP, nil)
+		defer dstDone()
+		_, err = dstReg.ImportDockerArchive(context.Background(), archive, "loaded", registry.ImportOptions{})
+		if err == nil || !strings.Contains(err.Error(), "ImportOptions.Tags") {
+			t.Errorf("expected the shared tag to be refused, got %v", err)
+		}
+		if len(dst.manifests) > 0 || len(dst.blobs) > 0 {
+			t.Error("images were pushed")
+		}
+
+		result, err := dstReg.ImportDockerArchive(context.Background(), archive, "loaded", registry.ImportOptions{
+			Tags: map[string]string{"a:latest": "a", "b:latest": "b"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Images) != 2 || result.Images[0].Descriptor.Digest == result.Images[1].Descriptor.Digest {
+			t.Errorf("unexpected result %+v", result)
+		}
+	})
+
+	t.Run("corrupt layers are rejected", func(t *testing.T) {
+		corrupt := map[string][]byte{}
+		for name, content := range files {
+			corrupt[name] = content
+		}
+		corrupt[manifest[0].Layers[1]] = []byte("tampered")
+		path := writeTar(t, corrupt)
+		defer os.Remove(path)
+
+		archive, err := registry.OpenDockerArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer archive.Close()
+
+		dst := newMemoryRegistry(t)
+		dstReg, dstDone := newCatalogTestRegistry(t, dst.ServeHTTP, nil)
+		defer dstDone()
+		_, err = dstReg.ImportDockerArchive(context.Background(), archive, "loaded/app", registry.ImportOptions{})
+		if !errors.Is(err, registry.ErrDigestMismatch) {
+			t.Errorf("expected a digest mismatch, got %v", err)
+		}
+		if len(dst.manifests) > 0 || len(dst.blobs) > 0 {
+			t.Error("a corrupt image was pushed")
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package registry
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// SaveOptions changes how SaveDockerArchive works.
+type SaveOptions struct {
+	// Platform selects the image to save from a manifest list or OCI index.
+	// It defaults to DefaultPlatform.
+	Platform Platform
+}
+
+/*
+ * Write images from this registry to w as a tarball that `docker load`
+ * accepts, like `docker save` does. Besides the manifest.json and image
+ * configs that Docker reads, the tarball has a `repositories` file and a
+ * directory per layer, named by its legacy v1 ID and holding its legacy json
+ * file, for older versions of Docker and other tools. Layers are written as
+ * the registry serves them, usually gzipped, which `docker load` accepts, and
+ * are verified against their digests as they are written.
+ */
+func (registry *Registry) SaveDockerArchive(ctx context.Context, w io.Writer, references []string, opts SaveOptions) error {
+	ctx, span := registry.startSpan(ctx, "registry.SaveDockerArchive")
+	defer span.End()
+
+	platform := opts.Platform
+	if platform.OS == "" && platform.Architecture == "" {
+		platform = DefaultPlatform
+	}
+
+	s := &saver{
+		registry:     registry,
+		tw:           tar.NewWriter(w),
+		written:      map[string]bool{},
+		repositories: map[string]map[string]string{},
+	}
+	images := []DockerArchiveImage{}
+	for _, reference := range references {
+		image, err := s.saveImage(ctx, reference, platform)
+		if err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("saving %s: %w", reference, err)
+		}
+		images = append(images, image)
+	}
+
+	manifest, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	if err := s.writeFile("manifest.json", manifest); err != nil {
+		return err
+	}
+	repositories, err := json.Marshal(s.repositories)
+	if err != nil {
+		return err
+	}
+	if err := s.writeFile("repositories", repositories); err != nil {
+		return err
+	}
+	return s.tw.Close()
+}
+
+type saver struct {
+	registry     *Registry
+	tw           *tar.Writer
+	written      map[string]bool              // paths in the tarball
+	repositories map[string]map[string]string // the repositories file
+}
+
+// saveImage writes an image's config and layers, and returns its entry in
+// manifest.json.
+func (s *saver) saveImage(ctx context.Context, ref string, platform Platform) (DockerArchiveImage, error) {
+	parsed, err := s.registry.ParseReference(ref)
+	if err != nil {
+		return DockerArchiveImage{}, err
+	}
+	_, manifest, err := s.registry.resolveManifest(ctx, parsed.Repository, parsed.Reference(), platform)
+	if err != nil {
+		return DockerArchiveImage{}, err
+	}
+	config, err := s.registry.fetchBlob(ctx, parsed.Repository, manifest.Config.Digest)
+	if err != nil {
+		return DockerArchiveImage{}, err
+	}
+	imageConfig := &ImageConfig{}
+	if err := json.Unmarshal(config, imageConfig); err != nil {
+		return DockerArchiveImage{}, fmt.Errorf("image config: %v", err)
+	}
+	diffIDs := imageConfig.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest.Layers) {
+		return DockerArchiveImage{}, fmt.Errorf("image config lists %d layers, the manifest %d", len(diffIDs), len(manifest.Layers))
+	}
+
+	image := DockerArchiveImage{Config: manifest.Config.Digest.Encoded() + ".json"}
+	if err := s.writeFile(image.Config, config); err != nil {
+		return DockerArchiveImage{}, err
+	}
+
+	var parent string
+	var chainID digest.Digest
+	layers := linkLayers(manifest.Layers, diffIDs, imageConfig.History)
+	for i, layer := range layers {
+		if foreignLayerMediaTypes[layer.Descriptor.MediaType] {
+			return DockerArchiveImage{}, fmt.Errorf("layer %s is a foreign layer, which can't be saved", layer.Descriptor.Digest)
+		}
+
+		if i == 0 {
+			chainID = layer.DiffID
+		} else {
+			chainID = digest.FromString(chainID.String() + " " + layer.DiffID.String())
+		}
+		v1, err := legacyJSON(config, layer, i == len(layers)-1)
+		if err != nil {
+			return DockerArchiveImage{}, err
+		}
+		id, v1JSON, err := legacyID(v1, chainID, parent)
+		if err != nil {
+			return DockerArchiveImage{}, err
+		}
+
+		if err := s.writeFile(path.Join(id, "VERSION"), []byte("1.0")); err != nil {
+			return DockerArchiveImage{}, err
+		}
+		if err := s.writeFile(path.Join(id, "json"), v1JSON); err != nil {
+			return DockerArchiveImage{}, err
+		}
+		if err := s.writeLayer(ctx, parsed.Repository, path.Join(id, "layer.tar"), layer.Descriptor); err != nil {
+			return DockerArchiveImage{}, err
+		}
+		image.Layers = append(image.Layers, path.Join(id, "layer.tar"))
+		parent = id
+	}
+
+	if parsed.Tag != "" {
+		named, err := reference.ParseNormalizedNamed(parsed.Name())
+		if err != nil {
+			return DockerArchiveImage{}, err
+		}
+		name := reference.FamiliarName(named)
+		image.RepoTags = []string{name + ":" + parsed.Tag}
+		if s.repositories[name] == nil {
+			s.repositories[name] = map[string]string{}
+		}
+		s.repositories[name][parsed.Tag] = parent
+	}
+	return image, nil
+}
+
+// legacyJSON returns the legacy json of a layer, without its ID and parent:
+// for the top layer, the image config without its rootfs and history, and
+// for the others, what the history says about them.
+func legacyJSON(config []byte, layer ImageLayer, top bool) (map[string]json.RawMessage, error) {
+	v1 := map[string]json.RawMessage{}
+	if top {
+		if err := json.Unmarshal(config, &v1); err != nil {
+			return nil, err
+		}
+		delete(v1, "rootfs")
+		delete(v1, "history")
+		return v1, nil
+	}
+
+	var legacy struct {
+		Created         *time.Time `json:"created,omitempty"`
+		Author          string     `json:"author,omitempty"`
+		Comment         string     `json:"comment,omitempty"`
+		ContainerConfig struct {
+			Cmd []string `json:"Cmd"`
+		} `json:"container_config"`
+	}
+	if layer.History != nil {
+		legacy.Created = layer.History.Created
+		legacy.Author = layer.History.Author
+		legacy.Comment = layer.History.Comment
+		legacy.ContainerConfig.Cmd = []string{layer.History.CreatedBy}
+	}
+	b, err := json.Marshal(legacy)
+	if err != nil {
+		return nil, err
+	}
+	return v1, json.Unmarshal(b, &v1)
+}
+
+// legacyID works out a layer's v1 ID the way Docker does, from its legacy
+// json, its chain ID and its parent's ID, and returns it with the legacy json
+// to write for it.
+func legacyID(v1 map[string]json.RawMessage, chainID digest.Digest, parent string) (string, []byte, error) {
+	var err error
+	if v1["layer_id"], err = json.Marshal(chainID); err != nil {
+		return "", nil, err
+	}
+	if parent != "" {
+		if v1["parent"], err = json.Marshal(digest.NewDigestFromEncoded(digest.SHA256, parent)); err != nil {
+			return "", nil, err
+		}
+	}
+	b, err := json.Marshal(v1)
+	if err != nil {
+		return "", nil, err
+	}
+	id := digest.FromBytes(b).Encoded()
+
+	delete(v1, "layer_id")
+	delete(v1, "parent")
+	v1["id"], _ = json.Marshal(id)
+	if parent != "" {
+		v1["parent"], _ = json.Marshal(parent)
+	}
+	b, err = json.Marshal(v1)
+	return id, b, err
+}
+
+// writeLayer streams a layer from the registry into the tarball, verifying it
+// as it goes.
+func (s *saver) writeLayer(ctx context.Context, repository, name string, descriptor Descriptor) error {
+	if s.written[name] {
+		return nil
+	}
+	resp, err := s.registry.downloadLayer(ctx, repository, descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := s.writeHeader(name, descriptor.Size); err != nil {
+		return err
+	}
+	verifier := descriptor.Digest.Verifier()
+	if _, err := io.CopyN(s.tw, io.TeeReader(resp.Body, verifier), descriptor.Size); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("%w: blob %s", ErrDigestMismatch, descriptor.Digest)
+	}
+	return nil
+}
+
+func (s *saver) writeFile(name string, content []byte) error {
+	if s.written[name] {
+		return nil
+	}
+	if err := s.writeHeader(name, int64(len(content))); err != nil {
+		return err
+	}
+	_, err := s.tw.Write(content)
+	return err
+}
+
+// writeHeader starts a file in the tarball, after the directory it's in.
+// Times are left at the epoch, so that the same images always make the same
+// tarball.
+func (s *saver) writeHeader(name string, size int64) error {
+	if dir := path.Dir(name); dir != "." && !s.written[dir+"/"] {
+		s.written[dir+"/"] = true
+		err := s.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: time.Unix(0, 0)})
+		if err != nil {
+			return err
+		}
+	}
+	s.written[name] = true
+	return s.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: time.Unix(0, 0)})
+}
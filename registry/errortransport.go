@@ -12,7 +12,7 @@ type HttpStatusError struct {
 }
 
 func (err *HttpStatusError) Error() string {
-	return fmt.Sprintf("http: non-successful response (status=%v body=%q)", err.Response.StatusCode, err.Body)
+	return fmt.Sprintf("http: non-successful response (status=%v body=%q)", err.Response.StatusCode, Redact(string(err.Body)))
 }
 
 var _ error = &HttpStatusError{}
@@ -34,10 +34,12 @@ func (t *ErrorTransport) RoundTrip(request *http.Request) (*http.Response, error
 			return nil, fmt.Errorf("http: failed to read response body (status=%v, err=%q)", resp.StatusCode, err)
 		}
 
-		return nil, &HttpStatusError{
+		statusErr := &HttpStatusError{
 			Response: resp,
 			Body:     body,
 		}
+		spanFrom(request.Context()).RecordError(statusErr)
+		return nil, statusErr
 	}
 
 	return resp, err
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ExportOptions changes how Export works.
+type ExportOptions struct {
+	// Platforms limits which images of a manifest list or OCI index are
+	// exported, as for Copy.
+	Platforms []Platform
+
+	// RefName is the name the image is listed under in the layout's index,
+	// as its org.opencontainers.image.ref.name annotation. It defaults to
+	// the reference's tag; an image exported by digest has no name unless
+	// one is given.
+	RefName string
+}
+
+// ExportResult describes what Export did.
+type ExportResult struct {
+	// Descriptor is the image's entry in the layout's index.
+	Descriptor Descriptor
+
+	Manifests    int   // manifests written, including those in an index
+	BlobsWritten int   // blobs downloaded into the layout
+	BlobsSkipped int   // blobs the layout already had
+	BytesWritten int64 // bytes of the blobs that were downloaded
+}
+
+/*
+ * Export an image, or a manifest list or OCI index with every image it lists,
+ * into an OCI image layout and list it in the layout's index.json. Blobs that
+ * the layout already holds, such as those shared with an image exported
+ * earlier, aren't downloaded again. Everything else is verified against its
+ * digest as it is written. Manifests are written byte for byte, so their
+ * digests are preserved unless opts.Platforms filters an index.
+ */
+func (registry *Registry) Export(ctx context.Context, reference string, layout *Layout, opts ExportOptions) (*ExportResult, error) {
+	ref, err := registry.ParseReference(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := registry.startSpan(ctx, "registry.Export", "reference", ref.String(), "layout", layout.Path)
+	defer span.End()
+
+	e := &exporter{
+		registry:   registry,
+		repository: ref.Repository,
+		layout:     layout,
+		opts:       opts,
+		result:     &ExportResult{},
+	}
+	descriptor, err := e.exportManifest(ctx, ref.Reference(), 0)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("exporting %s: %w", ref, err)
+	}
+
+	name := opts.RefName
+	if name == "" {
+		name = ref.Tag
+	}
+	if name != "" {
+		descriptor.Annotations = map[string]string{AnnotationRefName: name}
+	}
+	if err := layout.addToIndex(descriptor); err != nil {
+		return nil, err
+	}
+	e.result.Descriptor = descriptor
+	return e.result, nil
+}
+
+type exporter struct {
+	registry   *Registry
+	repository string
+	layout     *Layout
+	opts       ExportOptions
+	result     *ExportResult
+}
+
+// exportManifest writes the manifest at reference, and everything it refers
+// to, into the layout and returns its descriptor.
+func (e *exporter) exportManifest(ctx context.Context, reference string, depth int) (Descriptor, error) {
+	if depth > 4 {
+		return Descriptor{}, fmt.Errorf("%s: indexes nested too deeply", reference)
+	}
+
+	raw, err := e.registry.manifestRaw(ctx, e.repository, reference)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	payload := raw.Payload
+
+	switch raw.MediaType {
+	case MediaTypeManifestList, MediaTypeOCIIndex:
+		payload, err = filterIndex(payload, e.opts.Platforms, func(descriptor Descriptor) error {
+			_, err := e.exportManifest(ctx, descriptor.Digest.String(), depth+1)
+			return err
+		})
+		if err != nil {
+			return Descriptor{}, err
+		}
+
+	default:
+		blobs, err := manifestBlobs(raw)
+		if err != nil {
+			return Descriptor{}, fmt.Errorf("%s: %w", reference, err)
+		}
+		for _, blob := range blobs {
+			if err := e.exportBlob(ctx, blob); err != nil {
+				return Descriptor{}, err
+			}
+		}
+	}
+
+	descriptor := Descriptor{
+		MediaType: raw.MediaType,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+	}
+	if _, err := e.layout.writeBlob(descriptor, bytes.NewReader(payload)); err != nil {
+		return Descriptor{}, err
+	}
+	e.result.Manifests++
+	return descriptor, nil
+}
+
+// exportBlob downloads a blob into the layout, unless it's already there.
+func (e *exporter) exportBlob(ctx context.Context, descriptor Descriptor) error {
+	exists, err := e.layout.hasBlob(descriptor)
+	if err != nil {
+		return err
+	}
+	if exists {
+		e.registry.Logf("registry.export.skip repository=%s digest=%s", e.repository, descriptor.Digest)
+		e.result.BlobsSkipped++
+		return nil
+	}
+
+	resp, err := e.registry.downloadLayer(ctx, e.repository, descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	n, err := e.layout.writeBlob(descriptor, resp.Body)
+	if err != nil {
+		return err
+	}
+	e.result.BlobsWritten++
+	e.result.BytesWritten += n
+	return nil
+}
@@ -0,0 +1,106 @@
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func Test_Export(t *testing.T) {
+	m := newMemoryRegistry(t)
+	indexDigest := pushTestIndex(t, m, "app")
+	reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layout, err := registry.CreateLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := reg.Export(context.Background(), "app:latest", layout, registry.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Descriptor.Digest != indexDigest || result.Descriptor.Annotations[registry.AnnotationRefName] != "latest" {
+		t.Errorf("unexpected descriptor %+v", result.Descriptor)
+	}
+	if result.Manifests != 3 || result.BlobsWritten != 4 || result.BlobsSkipped != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// Every blob is stored under its digest, intact.
+	for _, blobs := range []map[string][]byte{m.manifests["app"], blobsByDigest(m.blobs["app"])} {
+		for reference, content := range blobs {
+			d, err := digest.Parse(reference)
+			if err != nil {
+				continue
+			}
+			stored, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", d.Encoded()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stored) != string(content) {
+				t.Errorf("blob %s differs", d)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		t.Error(err)
+	}
+
+	t.Run("shared blobs are written once", func(t *testing.T) {
+		result, err := reg.Export(context.Background(), "app:amd64", layout, registry.ExportOptions{RefName: "app-amd64"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.BlobsWritten != 0 || result.BlobsSkipped != 2 {
+			t.Errorf("unexpected result %+v", result)
+		}
+
+		// Exporting an image again replaces its entry.
+		if _, err := reg.Export(context.Background(), "app:latest", layout, registry.ExportOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		index, err := layout.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(index) != 2 {
+			t.Errorf("expected 2 images, got %+v", index)
+		}
+	})
+
+	t.Run("corrupt blobs are rejected", func(t *testing.T) {
+		m := newMemoryRegistry(t)
+		image := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "s390x"})
+		for d, content := range m.blobs["app"] {
+			m.blobs["app"][d] = append([]byte("X"), content[1:]...)
+		}
+		reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+		defer done()
+
+		_, err := reg.Export(context.Background(), "app@"+image.Digest.String(), layout, registry.ExportOptions{})
+		if !errors.Is(err, registry.ErrDigestMismatch) {
+			t.Fatalf("expected a digest mismatch, got %v", err)
+		}
+	})
+}
+
+func blobsByDigest(blobs map[digest.Digest][]byte) map[string][]byte {
+	res := map[string][]byte{}
+	for d, content := range blobs {
+		res[d.String()] = content
+	}
+	return res
+}
@@ -0,0 +1,357 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	manifestV1 "github.com/docker/distribution/manifest/schema1"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ErrPlatformNotFound is returned when an index has no manifest for the
+// requested platform.
+var ErrPlatformNotFound = errors.New("no manifest for platform")
+
+// Platform describes the platform an image runs on.
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// DefaultPlatform is the platform chosen from an index when none is given:
+// Linux on the architecture this program was built for.
+var DefaultPlatform = Platform{OS: "linux", Architecture: runtime.GOARCH}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ParsePlatform parses a platform written as os/architecture[/variant], such
+// as "linux/arm64/v8".
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", s)
+	}
+	platform := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// defaultVariants are the variants assumed when a platform doesn't give one.
+var defaultVariants = map[string]string{
+	"arm64": "v8",
+	"arm":   "v7",
+}
+
+// matches reports whether an index entry for p can run on want. A missing
+// variant on either side matches the architecture's default variant.
+func (p Platform) matches(want Platform) bool {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	if want.OSVersion != "" && p.OSVersion != want.OSVersion {
+		return false
+	}
+	if want.Variant == "" {
+		return true
+	}
+	variant := p.Variant
+	if variant == "" {
+		variant = defaultVariants[p.Architecture]
+	}
+	return variant == want.Variant
+}
+
+// Descriptor points to content by digest, as in manifests and indexes.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	URLs        []string          `json:"urls,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// imageManifest is a Docker schema 2 or OCI image manifest.
+type imageManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// imageIndex is a Docker manifest list or OCI image index.
+type imageIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// ImageConfig is an image's configuration, covering both the Docker and OCI
+// image config schemas.
+type ImageConfig struct {
+	Created      *time.Time      `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	OSVersion    string          `json:"os.version,omitempty"`
+	OSFeatures   []string        `json:"os.features,omitempty"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+
+	// Digest is the digest of the config blob, and Manifest the descriptor
+	// of the image manifest it was found through.
+	Digest   digest.Digest `json:"-"`
+	Manifest Descriptor    `json:"-"`
+
+	// Layers are the manifest's layers, each with its uncompressed digest
+	// and the history entry that produced it.
+	Layers []ImageLayer `json:"-"`
+}
+
+// Platform returns the platform the image was built for.
+func (c *ImageConfig) Platform() Platform {
+	return Platform{
+		Architecture: c.Architecture,
+		OS:           c.OS,
+		OSVersion:    c.OSVersion,
+		OSFeatures:   c.OSFeatures,
+		Variant:      c.Variant,
+	}
+}
+
+// ContainerConfig holds the defaults for containers run from an image.
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	ArgsEscaped  bool                `json:"ArgsEscaped,omitempty"`
+
+	// Docker only.
+	Healthcheck *HealthConfig `json:"Healthcheck,omitempty"`
+	OnBuild     []string      `json:"OnBuild,omitempty"`
+	Shell       []string      `json:"Shell,omitempty"`
+}
+
+// HealthConfig is a Docker image's health check.
+type HealthConfig struct {
+	Test        []string      `json:"Test,omitempty"`
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+// RootFS lists the uncompressed digests of an image's layers, in order.
+type RootFS struct {
+	Type    string          `json:"type"`
+	DiffIDs []digest.Digest `json:"diff_ids"`
+}
+
+// History describes how one step of an image was built.
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// ImageLayer is one of an image's layers.
+type ImageLayer struct {
+	Descriptor Descriptor
+	DiffID     digest.Digest
+
+	// History is the build step that produced the layer, or nil if the
+	// config's history doesn't account for it.
+	History *History
+}
+
+// Env returns the value of an environment variable in the image's config.
+func (c *ImageConfig) Env(name string) (string, bool) {
+	for _, kv := range c.Config.Env {
+		if strings.HasPrefix(kv, name+"=") {
+			return kv[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+/*
+ * Fetch the config of an image by tag or digest, choosing the manifest for
+ * DefaultPlatform if reference is an index. The config blob is verified
+ * against its digest.
+ */
+func (registry *Registry) ImageConfig(repository, reference string) (*ImageConfig, error) {
+	return registry.ImageConfigForPlatform(repository, reference, DefaultPlatform)
+}
+
+/*
+ * Fetch the config of an image, as with ImageConfig, choosing the manifest
+ * for platform if reference is an index.
+ */
+func (registry *Registry) ImageConfigForPlatform(repository, reference string, platform Platform) (*ImageConfig, error) {
+	return registry.imageConfig(context.Background(), repository, reference, platform)
+}
+
+// ImageConfigForPlatformContext is ImageConfigForPlatform with a context that
+// can cancel the requests.
+func (registry *Registry) ImageConfigForPlatformContext(ctx context.Context, repository, reference string, platform Platform) (*ImageConfig, error) {
+	return registry.imageConfig(ctx, repository, reference, platform)
+}
+
+func (registry *Registry) imageConfig(ctx context.Context, repository, reference string, platform Platform) (*ImageConfig, error) {
+	ctx, span := registry.startSpan(ctx, "registry.ImageConfig", "repository", repository, "reference", reference, "platform", platform.String())
+	defer span.End()
+
+	raw, manifest, err := registry.resolveManifest(ctx, repository, reference, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := registry.fetchBlob(ctx, repository, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ImageConfig{}
+	if err := json.Unmarshal(payload, config); err != nil {
+		return nil, fmt.Errorf("decoding image config %s: %v", manifest.Config.Digest, err)
+	}
+	config.Digest = manifest.Config.Digest
+	config.Manifest = Descriptor{
+		MediaType: raw.MediaType,
+		Digest:    raw.Digest,
+		Size:      int64(len(raw.Payload)),
+	}
+	config.Layers = linkLayers(manifest.Layers, config.RootFS.DiffIDs, config.History)
+	return config, nil
+}
+
+// resolveManifest fetches the image manifest for reference, descending
+// through indexes to the manifest for platform.
+func (registry *Registry) resolveManifest(ctx context.Context, repository, reference string, platform Platform) (*RawManifest, *imageManifest, error) {
+	// Indexes can nest, but not deeply in practice.
+	for depth := 0; depth < 4; depth++ {
+		raw, err := registry.manifestRaw(ctx, repository, reference)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch raw.MediaType {
+		case manifestV2.MediaTypeManifest, MediaTypeOCIManifest:
+			manifest := &imageManifest{}
+			if err := json.Unmarshal(raw.Payload, manifest); err != nil {
+				return nil, nil, err
+			}
+			return raw, manifest, nil
+
+		case MediaTypeManifestList, MediaTypeOCIIndex:
+			index := &imageIndex{}
+			if err := json.Unmarshal(raw.Payload, index); err != nil {
+				return nil, nil, err
+			}
+			descriptor, err := selectPlatform(index.Manifests, platform)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%s: %w", repository, reference, err)
+			}
+			reference = descriptor.Digest.String()
+
+		case manifestV1.MediaTypeManifest, manifestV1.MediaTypeSignedManifest:
+			return nil, nil, fmt.Errorf("%s:%s is a schema 1 manifest, which has no image config", repository, reference)
+
+		default:
+			return nil, nil, fmt.Errorf("%s:%s has unsupported manifest type %q", repository, reference, raw.MediaType)
+		}
+	}
+	return nil, nil, fmt.Errorf("%s:%s: indexes nested too deeply", repository, reference)
+}
+
+// selectPlatform returns the first index entry for platform.
+func selectPlatform(manifests []Descriptor, platform Platform) (Descriptor, error) {
+	var available []string
+	for _, descriptor := range manifests {
+		if descriptor.Platform == nil {
+			continue
+		}
+		if descriptor.Platform.matches(platform) {
+			return descriptor, nil
+		}
+		available = append(available, descriptor.Platform.String())
+	}
+	return Descriptor{}, fmt.Errorf("%w %s (available: %s)", ErrPlatformNotFound, platform, strings.Join(available, ", "))
+}
+
+// fetchBlob downloads a small blob, such as a config, and verifies it.
+func (registry *Registry) fetchBlob(ctx context.Context, repository string, dgst digest.Digest) ([]byte, error) {
+	url := registry.url("/v2/%s/blobs/%s", repository, dgst)
+	registry.Logf("registry.blob.get url=%s repository=%s digest=%s", url, repository, dgst)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(dgst, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// linkLayers pairs each layer with its diff ID and the history entry that
+// produced it. History entries marked as empty layers produced no layer.
+func linkLayers(layers []Descriptor, diffIDs []digest.Digest, history []History) []ImageLayer {
+	var producers []*History
+	for i := range history {
+		if !history[i].EmptyLayer {
+			producers = append(producers, &history[i])
+		}
+	}
+
+	linked := make([]ImageLayer, len(layers))
+	for i, layer := range layers {
+		linked[i].Descriptor = layer
+		if i < len(diffIDs) {
+			linked[i].DiffID = diffIDs[i]
+		}
+		if i < len(producers) {
+			linked[i].History = producers[i]
+		}
+	}
+	return linked
+}
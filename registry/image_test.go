@@ -0,0 +1,228 @@
+package registry_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// imageFixture serves an OCI index of a Docker amd64 image and an OCI
+// arm64/v8 image, addressed by the "latest" tag.
+type imageFixture struct {
+	blobs     map[digest.Digest][]byte
+	manifests map[string][]byte
+	types     map[string]string
+}
+
+func (f *imageFixture) add(reference, mediaType string, payload []byte) digest.Digest {
+	d := digest.FromBytes(payload)
+	f.manifests[reference] = payload
+	f.manifests[d.String()] = payload
+	f.types[reference] = mediaType
+	f.types[d.String()] = mediaType
+	return d
+}
+
+func newImageFixture(t *testing.T) *imageFixture {
+	f := &imageFixture{
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+	}
+
+	amd64Config := []byte(`{
+		"architecture": "amd64",
+		"os": "linux",
+		"created": "2020-01-02T03:04:05Z",
+		"config": {"Env": ["PATH=/usr/bin", "GREETING=hello"], "Entrypoint": ["/bin/app"], "User": "app", "Labels": {"a": "b"}},
+		"rootfs": {"type": "layers", "diff_ids": ["sha256:1111111111111111111111111111111111111111111111111111111111111111", "sha256:2222222222222222222222222222222222222222222222222222222222222222"]},
+		"history": [
+			{"created_by": "ADD base.tar /"},
+			{"created_by": "ENV GREETING=hello", "empty_layer": true},
+			{"created_by": "COPY app /bin/app"}
+		]
+	}`)
+	arm64Config := []byte(`{"architecture": "arm64", "variant": "v8", "os": "linux", "config": {"Cmd": ["sh"]}, "rootfs": {"type": "layers", "diff_ids": []}}`)
+	amd64ConfigDigest := digest.FromBytes(amd64Config)
+	arm64ConfigDigest := digest.FromBytes(arm64Config)
+	f.blobs[amd64ConfigDigest] = amd64Config
+	f.blobs[arm64ConfigDigest] = arm64Config
+
+	amd64 := f.add("amd64", "application/vnd.docker.distribution.manifest.v2+json", mustJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.docker.container.image.v1+json", "digest": amd64ConfigDigest, "size": len(amd64Config)},
+		"layers": []map[string]interface{}{
+			{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "size": 10},
+			{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "digest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "size": 20},
+		},
+	}))
+	arm64 := f.add("arm64", registry.MediaTypeOCIManifest, mustJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        map[string]interface{}{"mediaType": registry.MediaTypeOCIConfig, "digest": arm64ConfigDigest, "size": len(arm64Config)},
+		"layers":        []interface{}{},
+	}))
+	f.add("latest", registry.MediaTypeOCIIndex, mustJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     registry.MediaTypeOCIIndex,
+		"manifests": []map[string]interface{}{
+			{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": amd64, "size": len(f.manifests["amd64"]), "platform": map[string]string{"architecture": "amd64", "os": "linux"}},
+			{"mediaType": registry.MediaTypeOCIManifest, "digest": arm64, "size": len(f.manifests["arm64"]), "platform": map[string]string{"architecture": "arm64", "os": "linux"}},
+		},
+	}))
+	f.add("schema1", "application/vnd.docker.distribution.manifest.v1+prettyjws", []byte(`{"schemaVersion": 1, "signatures": []}`))
+	return f
+}
+
+func (f *imageFixture) handler(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+			reference := strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")
+			payload, ok := f.manifests[reference]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", f.types[reference])
+			w.Write(payload)
+		case strings.HasPrefix(r.URL.Path, "/v2/app/blobs/"):
+			payload, ok := f.blobs[digest.Digest(strings.TrimPrefix(r.URL.Path, "/v2/app/blobs/"))]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(payload)
+		default:
+			t.Errorf("unexpected path = %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func Test_ImageConfig(t *testing.T) {
+	fixture := newImageFixture(t)
+	reg, done := newCatalogTestRegistry(t, fixture.handler(t), nil)
+	defer done()
+
+	t.Run("docker amd64 from index", func(t *testing.T) {
+		config, err := reg.ImageConfigForPlatform("app", "latest", registry.Platform{OS: "linux", Architecture: "amd64"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Config.User != "app" || config.Config.Entrypoint[0] != "/bin/app" || config.Config.Labels["a"] != "b" {
+			t.Errorf("unexpected config %+v", config.Config)
+		}
+		if greeting, ok := config.Env("GREETING"); !ok || greeting != "hello" {
+			t.Errorf("expected GREETING=hello, got %q", greeting)
+		}
+		if config.Created == nil || config.Created.Year() != 2020 {
+			t.Errorf("unexpected created time %v", config.Created)
+		}
+		if config.Manifest.Digest != digest.FromBytes(fixture.manifests["amd64"]) {
+			t.Errorf("unexpected manifest digest %v", config.Manifest.Digest)
+		}
+
+		if len(config.Layers) != 2 {
+			t.Fatalf("expected 2 layers, got %d", len(config.Layers))
+		}
+		for i, createdBy := range []string{"ADD base.tar /", "COPY app /bin/app"} {
+			layer := config.Layers[i]
+			if layer.History == nil || layer.History.CreatedBy != createdBy {
+				t.Errorf("layer %d: expected history %q, got %+v", i, createdBy, layer.History)
+			}
+			if layer.DiffID != config.RootFS.DiffIDs[i] {
+				t.Errorf("layer %d: expected diff ID %v, got %v", i, config.RootFS.DiffIDs[i], layer.DiffID)
+			}
+		}
+	})
+
+	t.Run("oci arm64 with default variant", func(t *testing.T) {
+		config, err := reg.ImageConfigForPlatform("app", "latest", registry.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Platform().String() != "linux/arm64/v8" || config.Config.Cmd[0] != "sh" {
+			t.Errorf("unexpected config %+v", config)
+		}
+	})
+
+	t.Run("manifest by tag", func(t *testing.T) {
+		config, err := reg.ImageConfig("app", "arm64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Architecture != "arm64" {
+			t.Errorf("expected arm64, got %v", config.Architecture)
+		}
+	})
+
+	t.Run("platform not found", func(t *testing.T) {
+		_, err := reg.ImageConfigForPlatform("app", "latest", registry.Platform{OS: "windows", Architecture: "amd64"})
+		if !errors.Is(err, registry.ErrPlatformNotFound) {
+			t.Errorf("expected ErrPlatformNotFound, got %v", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := reg.ImageConfigForPlatformContext(ctx, "app", "latest", registry.Platform{OS: "linux", Architecture: "amd64"})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the requests to be cancelled, got %v", err)
+		}
+	})
+
+	t.Run("schema 1", func(t *testing.T) {
+		if _, err := reg.ImageConfig("app", "schema1"); err == nil {
+			t.Error("expected an error for a schema 1 manifest")
+		}
+	})
+
+	t.Run("config digest mismatch", func(t *testing.T) {
+		fixture := newImageFixture(t)
+		for d := range fixture.blobs {
+			fixture.blobs[d] = []byte(`{"architecture": "tampered"}`)
+		}
+		reg, done := newCatalogTestRegistry(t, fixture.handler(t), nil)
+		defer done()
+
+		if _, err := reg.ImageConfig("app", "arm64"); !errors.Is(err, registry.ErrDigestMismatch) {
+			t.Errorf("expected ErrDigestMismatch, got %v", err)
+		}
+	})
+}
+
+func Test_ManifestRaw_DigestMismatch(t *testing.T) {
+	fixture := newImageFixture(t)
+	d := digest.FromBytes(fixture.manifests["arm64"])
+	fixture.manifests[d.String()] = []byte(`{"schemaVersion": 2}`)
+	reg, done := newCatalogTestRegistry(t, fixture.handler(t), nil)
+	defer done()
+
+	if _, err := reg.ManifestRaw("app", d.String()); !errors.Is(err, registry.ErrDigestMismatch) {
+		t.Errorf("expected ErrDigestMismatch, got %v", err)
+	}
+
+	raw, err := reg.ManifestRaw("app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.MediaType != registry.MediaTypeOCIIndex || raw.Digest != digest.FromBytes(fixture.manifests["latest"]) {
+		t.Errorf("unexpected manifest %v %v", raw.MediaType, raw.Digest)
+	}
+}
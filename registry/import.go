@@ -0,0 +1,290 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var anchoredTagRegexp = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
+
+// ImportOptions changes how Import works.
+type ImportOptions struct {
+	// Tags maps the names of images in the layout, their
+	// org.opencontainers.image.ref.name annotations, to the tags to push
+	// them as. When set, only the images it names are pushed. Otherwise
+	// every image is pushed and tagged with its name; images without a name
+	// are pushed by digest alone.
+	Tags map[string]string
+}
+
+// ImportResult describes what Import did.
+type ImportResult struct {
+	// Images are the images pushed from the layout's index.
+	Images []ImportedImage
+
+	Manifests     int   // manifests pushed, including those in an index
+	BlobsUploaded int   // blobs uploaded from the layout
+	BlobsSkipped  int   // blobs the registry already had
+	BytesUploaded int64 // bytes of the blobs that were uploaded
+}
+
+// ImportedImage is an image Import pushed.
+type ImportedImage struct {
+	Name       string // its name in the layout, if it has one
+	Tag        string // the tag it was pushed as, if any
+	Descriptor Descriptor
+}
+
+/*
+ * Push images from an OCI image layout, such as a *Layout or *LayoutArchive,
+ * to a repository. Each image the layout's index lists is pushed with every
+ * image it lists in turn, and tagged with its name or as opts.Tags maps it.
+ * Nothing is pushed if two images would get the same tag. Blobs the
+ * repository already has are skipped. Manifests are pushed byte for byte, after they are verified against their digests, so the images keep
+ * their digests.
+ */
+func (registry *Registry) Import(ctx context.Context, layout LayoutSource, repository string, opts ImportOptions) (*ImportResult, error) {
+	ctx, span := registry.startSpan(ctx, "registry.Import", "repository", repository)
+	defer span.End()
+
+	index, err := layout.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	im := &importer{
+		registry:   registry,
+		layout:     layout,
+		repository: repository,
+		pushed:     map[digest.Digest]bool{},
+		blobs:      map[digest.Digest]bool{},
+		result:     &ImportResult{},
+	}
+	names := make([][]string, len(index))
+	for i, descriptor := range index {
+		names[i] = []string{descriptor.Annotations[AnnotationRefName]}
+	}
+	targets, err := importTargets(names, opts, repository, "the layout", func(i, j int) bool {
+		return index[i].Digest == index[j].Digest
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, descriptor := range index {
+		for _, target := range targets[i] {
+			reference := target.Tag
+			if reference == "" {
+				reference = descriptor.Digest.String()
+			}
+			if err := im.importManifest(ctx, descriptor, reference, 0); err != nil {
+				span.RecordError(err)
+				return nil, fmt.Errorf("importing %s to %s:%s: %w", descriptor.Digest, repository, reference, err)
+			}
+			target.Descriptor = descriptor
+			im.result.Images = append(im.result.Images, target)
+		}
+	}
+	return im.result, nil
+}
+
+// importTargets works out what to push each image as before anything is
+// pushed, given the names each image has in its source: the tags they map to,
+// or a single target without a tag for an image pushed by digest alone. An
+// image that gets no target isn't pushed. same reports whether two images are
+// the same, and so may share a tag.
+func importTargets(names [][]string, opts ImportOptions, repository, source string, same func(i, j int) bool) ([][]ImportedImage, error) {
+	named := map[string]bool{}
+	for _, imageNames := range names {
+		for _, name := range imageNames {
+			named[name] = true
+		}
+	}
+	for name := range opts.Tags {
+		if !named[name] {
+			return nil, fmt.Errorf("no image named %q in %s", name, source)
+		}
+	}
+
+	targets := make([][]ImportedImage, len(names))
+	taggedBy := map[string]int{}
+	for i, imageNames := range names {
+		for _, name := range imageNames {
+			tag, err := importTag(name, opts.Tags)
+			if err != nil {
+				return nil, err
+			}
+			if tag == "" {
+				continue
+			}
+			if other, ok := taggedBy[tag]; ok && other != i && !same(other, i) {
+				return nil, fmt.Errorf("%s and %s would both be pushed as %s:%s; map them to different tags with ImportOptions.Tags",
+					strings.Join(names[other], ", "), name, repository, tag)
+			}
+			taggedBy[tag] = i
+			targets[i] = append(targets[i], ImportedImage{Name: name, Tag: tag})
+		}
+		if len(targets[i]) == 0 && opts.Tags == nil {
+			name := ""
+			if len(imageNames) == 1 {
+				name = imageNames[0]
+			}
+			targets[i] = append(targets[i], ImportedImage{Name: name})
+		}
+	}
+	return targets, nil
+}
+
+// importTag returns the tag to push the image named name as: its mapping in
+// tags, or else the name itself, or the tag of a name that is a full image
+// reference.
+func importTag(name string, tags map[string]string) (string, error) {
+	if tags != nil {
+		return tags[name], nil
+	}
+	if name == "" || anchoredTagRegexp.MatchString(name) {
+		return name, nil
+	}
+	if named, err := reference.ParseNormalizedNamed(name); err == nil {
+		if tagged, ok := named.(reference.Tagged); ok {
+			return tagged.Tag(), nil
+		}
+	}
+	return "", fmt.Errorf("image name %q isn't a tag; map it to one with ImportOptions.Tags", name)
+}
+
+type importer struct {
+	registry   *Registry
+	layout     LayoutSource
+	repository string
+	pushed     map[digest.Digest]bool // manifests pushed by digest
+	blobs      map[digest.Digest]bool // blobs the repository has
+	result     *ImportResult
+}
+
+// importManifest pushes the manifest descriptor points to, and everything it
+// refers to, as target.
+func (im *importer) importManifest(ctx context.Context, descriptor Descriptor, target string, depth int) error {
+	if depth > 4 {
+		return fmt.Errorf("%s: indexes nested too deeply", descriptor.Digest)
+	}
+	if im.pushed[descriptor.Digest] && target == descriptor.Digest.String() {
+		return nil
+	}
+
+	raw, err := im.readManifest(descriptor)
+	if err != nil {
+		return err
+	}
+
+	switch raw.MediaType {
+	case MediaTypeManifestList, MediaTypeOCIIndex:
+		index := &imageIndex{}
+		if err := json.Unmarshal(raw.Payload, index); err != nil {
+			return err
+		}
+		for _, child := range index.Manifests {
+			if err := im.importManifest(ctx, child, child.Digest.String(), depth+1); err != nil {
+				return err
+			}
+		}
+
+	default:
+		blobs, err := manifestBlobs(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", descriptor.Digest, err)
+		}
+		for _, blob := range blobs {
+			if err := im.importBlob(ctx, blob); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := im.registry.pushManifest(ctx, im.repository, target, raw.MediaType, raw.Payload, nil); err != nil {
+		return err
+	}
+	im.pushed[descriptor.Digest] = true
+	im.result.Manifests++
+	return nil
+}
+
+// readManifest reads a manifest from the layout and verifies it.
+func (im *importer) readManifest(descriptor Descriptor) (*RawManifest, error) {
+	f, size, err := im.layout.OpenBlob(descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if descriptor.Size >= 0 && size != descriptor.Size {
+		return nil, fmt.Errorf("manifest %s is %d bytes, expected %d", descriptor.Digest, size, descriptor.Size)
+	}
+	payload, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(descriptor.Digest, payload); err != nil {
+		return nil, err
+	}
+
+	mediaType := descriptor.MediaType
+	if mediaType == "" {
+		mediaType = manifestMediaType("", payload)
+	}
+	return &RawManifest{MediaType: mediaType, Digest: descriptor.Digest, Payload: payload}, nil
+}
+
+// importBlob uploads a blob from the layout, unless the repository already
+// has it.
+func (im *importer) importBlob(ctx context.Context, descriptor Descriptor) error {
+	return im.uploadBlob(ctx, descriptor, func() (io.ReadCloser, int64, error) {
+		return im.layout.OpenBlob(descriptor.Digest)
+	})
+}
+
+// uploadBlob uploads a blob opened by open, unless the repository already has
+// it.
+func (im *importer) uploadBlob(ctx context.Context, descriptor Descriptor, open func() (io.ReadCloser, int64, error)) error {
+	dgst := descriptor.Digest
+	if im.blobs[dgst] {
+		return nil
+	}
+
+	exists, err := im.registry.hasLayer(ctx, im.repository, dgst)
+	if err != nil {
+		return err
+	}
+	if exists {
+		im.registry.Logf("registry.import.skip repository=%s digest=%s", im.repository, dgst)
+		im.blobs[dgst] = true
+		im.result.BlobsSkipped++
+		return nil
+	}
+
+	f, size, err := open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if descriptor.Size >= 0 && size != descriptor.Size {
+		return fmt.Errorf("blob %s is %d bytes, expected %d", dgst, size, descriptor.Size)
+	}
+	content := &countingReader{ReadCloser: f}
+	if err := im.registry.uploadLayer(ctx, im.repository, dgst, content, size, nil); err != nil {
+		return err
+	}
+	im.blobs[dgst] = true
+	im.result.BlobsUploaded++
+	im.result.BytesUploaded += content.n
+	return nil
+}
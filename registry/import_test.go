@@ -0,0 +1,173 @@
+package registry_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// exportTestLayout exports repo:latest and repo:amd64, the latter named
+// "app-amd64", from m into a new layout.
+func exportTestLayout(t *testing.T, m *memoryRegistry, repo string) *registry.Layout {
+	reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := registry.CreateLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Export(context.Background(), repo+":latest", layout, registry.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Export(context.Background(), repo+":amd64", layout, registry.ExportOptions{RefName: "app-amd64"}); err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+// tarLayout packs a layout directory into a tar file, gzipped or not.
+func tarLayout(t *testing.T, dir string, compress bool) string {
+	f, err := ioutil.TempFile("", "layout-*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if compress {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		header.Name = "./" + filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func Test_Import(t *testing.T) {
+	src := newMemoryRegistry(t)
+	indexDigest := pushTestIndex(t, src, "app")
+	layout := exportTestLayout(t, src, "app")
+	defer os.RemoveAll(layout.Path)
+
+	dst := newMemoryRegistry(t)
+	reg, done := newCatalogTestRegistry(t, dst.ServeHTTP, nil)
+	defer done()
+
+	result, err := reg.Import(context.Background(), layout, "imported/app", registry.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 2 || result.BlobsUploaded != 4 || result.BlobsSkipped != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// Manifests arrive byte for byte, tagged by name.
+	for reference, payload := range src.manifests["app"] {
+		if _, err := digest.Parse(reference); err != nil {
+			continue
+		}
+		if string(dst.manifests["imported/app"][reference]) != string(payload) {
+			t.Errorf("manifest %s differs", reference)
+		}
+	}
+	if digest.FromBytes(dst.manifests["imported/app"]["latest"]) != indexDigest {
+		t.Error("latest has the wrong digest")
+	}
+	if string(dst.manifests["imported/app"]["app-amd64"]) != string(src.manifests["app"]["amd64"]) {
+		t.Error("app-amd64 has the wrong manifest")
+	}
+
+	for _, compress := range []bool{false, true} {
+		name := "tar"
+		if compress {
+			name = "tar.gz"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			path := tarLayout(t, layout.Path, compress)
+			defer os.Remove(path)
+			archive, err := registry.OpenLayoutArchive(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer archive.Close()
+
+			// Only mapped images are pushed, and their blobs are there.
+			result, err := reg.Import(context.Background(), archive, "imported/app", registry.ImportOptions{
+				Tags: map[string]string{"latest": "stable-" + name},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Images) != 1 || result.BlobsUploaded != 0 || result.BlobsSkipped != 4 {
+				t.Errorf("unexpected result %+v", result)
+			}
+			if digest.FromBytes(dst.manifests["imported/app"]["stable-"+name]) != indexDigest {
+				t.Error("the mapped tag has the wrong digest")
+			}
+
+			_, err = reg.Import(context.Background(), archive, "imported/app", registry.ImportOptions{
+				Tags: map[string]string{"missing": "stable"},
+			})
+			if err == nil {
+				t.Error("expected an error for an image the layout doesn't have")
+			}
+		})
+	}
+	t.Run("images sharing a tag", func(t *testing.T) {
+		dst := newMemoryRegistry(t)
+		reg, done := newCatalogTestRegistry(t, dst.ServeHTTP, nil)
+		defer done()
+
+		_, err := reg.Import(context.Background(), layout, "imported/app", registry.ImportOptions{
+			Tags: map[string]string{"latest": "stable", "app-amd64": "stable"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "ImportOptions.Tags") {
+			t.Errorf("expected the shared tag to be refused, got %v", err)
+		}
+		if len(dst.manifests) > 0 || len(dst.blobs) > 0 {
+			t.Error("images were pushed")
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tracer starts spans, so registry operations can be traced with
+// OpenTelemetry or anything else. Set Registry.Tracer to use one; a
+// go.opentelemetry.io/otel/trace.Tracer needs only a small adapter.
+type Tracer interface {
+	// Start starts a span named name as a child of any span in ctx, and
+	// returns a context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttributes sets the span's attributes from alternating keys and
+	// values.
+	SetAttributes(keysAndValues ...interface{})
+	RecordError(err error)
+	End()
+}
+
+// Metrics receives measurements of the registry's HTTP traffic. Set
+// Registry.Metrics to use it. Endpoints are coarse names for the registry
+// API in use, such as "manifests", "blobs", "blob_upload", "tags", "catalog",
+// "ping" or "token", so they can be used as metric labels.
+type Metrics interface {
+	// ObserveRequest is called once per HTTP request, with a status of zero
+	// if the request failed without a response.
+	ObserveRequest(endpoint, method string, status int, duration time.Duration)
+
+	// AddBytes is called with the number of body bytes "sent" or "received".
+	AddBytes(endpoint, direction string, n int64)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(keysAndValues ...interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+type instrumentationKey struct{}
+
+// instrumentation is carried in a request's context from the operation that
+// made it down through the transport stack.
+type instrumentation struct {
+	tracer   Tracer
+	metrics  Metrics
+	span     Span
+	endpoint string // overrides the endpoint worked out from the URL
+}
+
+// startSpan starts a span for a registry operation, and gives it a request ID
+// for the logs. When neither a Tracer nor Metrics is set it starts no span,
+// so uninstrumented registries pay next to nothing.
+func (registry *Registry) startSpan(ctx context.Context, name string, keysAndValues ...interface{}) (context.Context, Span) {
+	ctx = withRequestID(ctx)
+	if registry.Tracer == nil && registry.Metrics == nil {
+		return ctx, noopSpan{}
+	}
+	inst := &instrumentation{tracer: registry.Tracer, metrics: registry.Metrics}
+	if parent := instrumentationFrom(ctx); parent != nil {
+		inst.endpoint = parent.endpoint
+	}
+	return inst.start(ctx, name, keysAndValues...)
+}
+
+// startChildSpan starts a span under the operation in ctx, if it's
+// instrumented.
+func startChildSpan(ctx context.Context, name string, keysAndValues ...interface{}) (context.Context, Span) {
+	parent := instrumentationFrom(ctx)
+	if parent == nil {
+		return ctx, noopSpan{}
+	}
+	inst := *parent
+	return inst.start(ctx, name, keysAndValues...)
+}
+
+func (inst *instrumentation) start(ctx context.Context, name string, keysAndValues ...interface{}) (context.Context, Span) {
+	inst.span = noopSpan{}
+	if inst.tracer != nil {
+		ctx, inst.span = inst.tracer.Start(ctx, name)
+		if len(keysAndValues) > 0 {
+			inst.span.SetAttributes(keysAndValues...)
+		}
+	}
+	return context.WithValue(ctx, instrumentationKey{}, inst), inst.span
+}
+
+func instrumentationFrom(ctx context.Context) *instrumentation {
+	inst, _ := ctx.Value(instrumentationKey{}).(*instrumentation)
+	return inst
+}
+
+// spanFrom returns the innermost span in ctx.
+func spanFrom(ctx context.Context) Span {
+	if inst := instrumentationFrom(ctx); inst != nil {
+		return inst.span
+	}
+	return noopSpan{}
+}
+
+// withEndpoint labels the requests made with ctx as going to endpoint.
+func withEndpoint(ctx context.Context, endpoint string) context.Context {
+	parent := instrumentationFrom(ctx)
+	if parent == nil {
+		return ctx
+	}
+	inst := *parent
+	inst.endpoint = endpoint
+	return context.WithValue(ctx, instrumentationKey{}, &inst)
+}
+
+// endOnClose ends span when body is closed, for operations that hand a
+// response body to the caller.
+func endOnClose(body io.ReadCloser, span Span) io.ReadCloser {
+	if _, ok := span.(noopSpan); ok {
+		return body
+	}
+	return &spanBody{ReadCloser: body, span: span}
+}
+
+type spanBody struct {
+	io.ReadCloser
+	span Span
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End()
+	return err
+}
+
+// InstrumentedTransport traces and measures every request it sends for an
+// instrumented registry operation. Requests made without one pass straight
+// through.
+type InstrumentedTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *InstrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	inst := instrumentationFrom(req.Context())
+	if inst == nil {
+		return t.Transport.RoundTrip(req)
+	}
+
+	endpoint := inst.endpoint
+	if endpoint == "" {
+		endpoint = endpointFromPath(req.URL.Path)
+	}
+
+	ctx, span := startChildSpan(req.Context(), "HTTP "+req.Method,
+		"http.method", req.Method,
+		"http.url", Redact(req.URL.String()),
+		"registry.endpoint", endpoint)
+	defer span.End()
+
+	outgoing := req.WithContext(ctx)
+	var sent *countingReader
+	if req.Body != nil && inst.metrics != nil {
+		sent = &countingReader{ReadCloser: req.Body}
+		outgoing.Body = sent
+	}
+
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(outgoing)
+	duration := time.Since(start)
+
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+		span.SetAttributes("http.status_code", status)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	if inst.metrics != nil {
+		inst.metrics.ObserveRequest(endpoint, req.Method, status, duration)
+		if sent != nil && sent.n > 0 {
+			inst.metrics.AddBytes(endpoint, "sent", sent.n)
+		}
+		if resp != nil && resp.Body != nil {
+			resp.Body = &countingReader{ReadCloser: resp.Body, done: func(n int64) {
+				inst.metrics.AddBytes(endpoint, "received", n)
+			}}
+		}
+	}
+	return resp, err
+}
+
+// countingReader counts the bytes read through it, and reports them to done
+// when closed.
+type countingReader struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.done != nil {
+		r.done(r.n)
+		r.done = nil
+	}
+	return err
+}
+
+// endpointFromPath names the registry API a request path is for.
+func endpointFromPath(path string) string {
+	i := strings.Index(path, "/v2/")
+	if i < 0 {
+		return "other"
+	}
+	rest := path[i+len("/v2/"):]
+	switch {
+	case rest == "":
+		return "ping"
+	case rest == "_catalog":
+		return "catalog"
+	case strings.Contains(rest, "/blobs/uploads"):
+		return "blob_upload"
+	case strings.Contains(rest, "/blobs/"):
+		return "blobs"
+	case strings.Contains(rest, "/manifests/"):
+		return "manifests"
+	case strings.HasSuffix(rest, "/tags/list"):
+		return "tags"
+	case strings.Contains(rest, "/referrers/"):
+		return "referrers"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,173 @@
+package registry_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type spanKey struct{}
+
+// recordingTracer keeps every span it starts, linked to its parent.
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name   string
+	parent *recordingSpan
+	attrs  map[string]interface{}
+	errs   []error
+	ended  bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, registry.Span) {
+	t.Lock()
+	defer t.Unlock()
+
+	parent, _ := ctx.Value(spanKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *recordingSpan) SetAttributes(keysAndValues ...interface{}) {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		s.attrs[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+}
+
+func (s *recordingSpan) RecordError(err error) { s.errs = append(s.errs, err) }
+func (s *recordingSpan) End()                  { s.ended = true }
+
+// path returns the names of the span and its ancestors, outermost first.
+func (s *recordingSpan) path() string {
+	if s.parent == nil {
+		return s.name
+	}
+	return s.parent.path() + " > " + s.name
+}
+
+type recordingMetrics struct {
+	sync.Mutex
+	requests []string
+	bytes    map[string]int64
+}
+
+func (m *recordingMetrics) ObserveRequest(endpoint, method string, status int, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests = append(m.requests, fmt.Sprintf("%s %s %d", endpoint, method, status))
+}
+
+func (m *recordingMetrics) AddBytes(endpoint, direction string, n int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.bytes[endpoint+" "+direction] += n
+}
+
+func Test_Registry_Instrumentation(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			w.Write([]byte(`{"token":"t"}`))
+		case r.Header.Get("Authorization") != "Bearer t":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="registry"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/team/app/tags/list":
+			w.Write([]byte(`{"name":"team/app","tags":["latest"]}`))
+		case strings.HasPrefix(r.URL.Path, "/v2/team/app/blobs/"):
+			w.Write([]byte("0123456789"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	reg, err := registry.NewWithTransport(ts.URL, "user", "pass", &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Logf = registry.Quiet
+	tracer := &recordingTracer{}
+	metrics := &recordingMetrics{bytes: map[string]int64{}}
+	reg.Tracer = tracer
+	reg.Metrics = metrics
+
+	if _, err := reg.Tags("team/app"); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := reg.DownloadLayer("team/app", digest.FromString("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(layer)
+	layer.Close()
+	if _, err := reg.HasLayer("team/missing", digest.FromString("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, span := range tracer.spans {
+		paths = append(paths, span.path())
+		if !span.ended {
+			t.Errorf("span %s was never ended", span.path())
+		}
+	}
+	expected := []string{
+		"registry.Tags",
+		"registry.Tags > HTTP GET",
+		"registry.Tags > registry.token",
+		"registry.Tags > registry.token > HTTP GET",
+		"registry.Tags > registry.retry",
+		"registry.Tags > registry.retry > HTTP GET",
+		"registry.DownloadLayer",
+		"registry.DownloadLayer > HTTP GET",
+		"registry.DownloadLayer > registry.token",
+		"registry.DownloadLayer > registry.token > HTTP GET",
+		"registry.DownloadLayer > registry.retry",
+		"registry.DownloadLayer > registry.retry > HTTP GET",
+		"registry.HasLayer",
+		"registry.HasLayer > HTTP HEAD",
+		"registry.HasLayer > registry.token",
+		"registry.HasLayer > registry.token > HTTP GET",
+		"registry.HasLayer > registry.retry",
+		"registry.HasLayer > registry.retry > HTTP HEAD",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Got spans\n%s\nbut expected\n%s", strings.Join(paths, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if root := tracer.spans[0]; root.attrs["repository"] != "team/app" {
+		t.Errorf("expected the repository on the operation span, got %v", root.attrs)
+	}
+	if hasLayer := tracer.spans[12]; len(hasLayer.errs) != 1 {
+		t.Errorf("expected the 404 to be recorded on the HasLayer span, got %v", hasLayer.errs)
+	}
+
+	expectedRequests := []string{
+		"tags GET 401", "token GET 200", "tags GET 200",
+		"blobs GET 401", "token GET 200", "blobs GET 200",
+		"blobs HEAD 401", "token GET 200", "blobs HEAD 404",
+	}
+	if !reflect.DeepEqual(metrics.requests, expectedRequests) {
+		t.Errorf("Got requests %v but expected %v", metrics.requests, expectedRequests)
+	}
+	if metrics.bytes["blobs received"] != 10 {
+		t.Errorf("expected 10 blob bytes received, got %v", metrics.bytes)
+	}
+}
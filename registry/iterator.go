@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrIteratorDone is returned by an iterator's Next method once every item
+// has been returned.
+var ErrIteratorDone = errors.New("no more items in iterator")
+
+// ListOptions controls how listings are paged.
+type ListOptions struct {
+	// N is the page size requested from the registry (the `n` parameter).
+	// Zero leaves the page size up to the registry.
+	N int
+
+	// Last resumes a listing after the given item (the `last` parameter),
+	// typically a value previously returned by an iterator's Last method.
+	// Repository listings only support it through `_catalog` (the
+	// distribution and Artifactory providers) and otherwise fail with
+	// ErrLastUnsupported; use RepositoryListOptions.Checkpoint for those.
+	Last string
+}
+
+// pageFunc fetches the next page of items. It returns ErrNoMorePages along
+// with the final page.
+type pageFunc func(ctx context.Context) ([]string, error)
+
+// pager turns a pageFunc into a pull-based iterator. It only performs
+// requests from inside next, so abandoning it never leaks a goroutine.
+type pager struct {
+	fetch pageFunc
+
+	buf  []string
+	last string
+	done bool
+	err  error
+}
+
+func (p *pager) next(ctx context.Context) (string, error) {
+	for len(p.buf) == 0 {
+		if p.err != nil {
+			return "", p.err
+		}
+		if p.done {
+			return "", ErrIteratorDone
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		items, err := p.fetch(ctx)
+		switch err {
+		case ErrNoMorePages:
+			p.done = true
+		case nil:
+		default:
+			p.err = err
+			return "", err
+		}
+		p.buf = items
+	}
+
+	item := p.buf[0]
+	p.buf = p.buf[1:]
+	p.last = item
+	return item, nil
+}
+
+// drain collects every remaining item from next.
+func drain(ctx context.Context, next func(context.Context) (string, error)) ([]string, error) {
+	items := make([]string, 0, 10)
+	for {
+		item, err := next(ctx)
+		switch err {
+		case nil:
+			items = append(items, item)
+		case ErrIteratorDone:
+			return items, nil
+		default:
+			return items, err
+		}
+	}
+}
+
+// stream runs next in a goroutine, sending items on the first channel. At most
+// one error is sent on the second channel, which is buffered so the goroutine
+// never blocks on it; both channels are closed when the listing ends. The
+// goroutine exits when ctx is cancelled, so callers that stop reading early
+// must cancel ctx. A cancelled or expired ctx sends its error, so that a
+// listing cut short never looks complete.
+func stream(ctx context.Context, next func(context.Context) (string, error)) (<-chan string, <-chan error) {
+	itemChan := make(chan string)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(errChan)
+		defer close(itemChan)
+
+		for {
+			item, err := next(ctx)
+			switch err {
+			case nil:
+			case ErrIteratorDone:
+				return
+			default:
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				errChan <- err
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			case itemChan <- item:
+			}
+		}
+	}()
+
+	return itemChan, errChan
+}
@@ -0,0 +1,169 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pagedHandler serves items from a sorted list through a Docker-style
+// `n`/`last` paginated endpoint, wrapped in a JSON object under key.
+func pagedHandler(t *testing.T, path, key string, items []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("unexpected path = %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		start := sort.SearchStrings(items, q.Get("last"))
+		if q.Get("last") != "" && start < len(items) && items[start] == q.Get("last") {
+			start++
+		}
+		end := len(items)
+		if n, err := strconv.Atoi(q.Get("n")); err == nil && start+n < end {
+			end = start + n
+			w.Header().Set("Link", fmt.Sprintf(`<%s?n=%d&last=%s>; rel="next"`, path, n, url.QueryEscape(items[end-1])))
+		}
+
+		page := items[start:end]
+		quoted := make([]string, len(page))
+		for i, item := range page {
+			quoted[i] = strconv.Quote(item)
+		}
+		fmt.Fprintf(w, `{%q:[%s]}`, key, strings.Join(quoted, ","))
+	}
+}
+
+func Test_ListRepositories_Paging(t *testing.T) {
+	repos := []string{"a/1", "a/2", "b/1", "b/2", "c/1"}
+	server := httptest.NewServer(pagedHandler(t, "/v2/_catalog", "repositories", repos))
+	defer server.Close()
+
+	r, err := NewWithTransport(server.URL, "", "", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	it := r.ListRepositories(ListOptions{N: 2})
+	var got []string
+	for i := 0; i < 3; i++ {
+		repo, err := it.Next(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, repo)
+	}
+	if it.Last() != "b/1" {
+		t.Errorf("expected last to be b/1, got %v", it.Last())
+	}
+
+	// Resume from the cursor with a fresh iterator.
+	rest, err := drain(ctx, r.ListRepositories(ListOptions{N: 2, Last: it.Last()}).Next)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = append(got, rest...)
+
+	if !reflect.DeepEqual(got, repos) {
+		t.Errorf("expected %v, got %v", repos, got)
+	}
+}
+
+func Test_ListTags_Paging(t *testing.T) {
+	tags := []string{"1.0", "1.1", "2.0", "latest"}
+	server := httptest.NewServer(pagedHandler(t, "/v2/heroku/cedar/tags/list", "tags", tags))
+	defer server.Close()
+
+	r, err := NewWithTransport(server.URL, "", "", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := r.ListTags("heroku/cedar", ListOptions{N: 3})
+	got, err := drain(context.Background(), it.Next)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, tags) {
+		t.Errorf("expected %v, got %v", tags, got)
+	}
+
+	if _, err := it.Next(context.Background()); err != ErrIteratorDone {
+		t.Errorf("expected ErrIteratorDone after the last tag, got %v", err)
+	}
+}
+
+func Test_Stream_ErrorClosesChannels(t *testing.T) {
+	calls := 0
+	p := &pager{fetch: func(ctx context.Context) ([]string, error) {
+		calls++
+		if calls == 1 {
+			return []string{"one"}, nil
+		}
+		return nil, fmt.Errorf("boom")
+	}}
+
+	items, errs := stream(context.Background(), p.next)
+
+	// Wait for the error without reading any items: the producer must not
+	// block on the error channel.
+	<-items
+	if err := <-errs; err == nil || err.Error() != "boom" {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	if _, ok := <-items; ok {
+		t.Error("expected the item channel to be closed")
+	}
+	if _, ok := <-errs; ok {
+		t.Error("expected the error channel to be closed")
+	}
+}
+
+func Test_Stream_Cancel(t *testing.T) {
+	p := &pager{fetch: func(ctx context.Context) ([]string, error) {
+		return []string{"x", "y", "z"}, nil
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	items, errs := stream(ctx, p.next)
+	<-items
+	cancel()
+
+	// Both channels are closed once the producer notices the cancellation,
+	// which is reported.
+	for range items {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if _, ok := <-errs; ok {
+		t.Error("expected the error channel to be closed")
+	}
+}
+
+func Test_Stream_Deadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	p := &pager{fetch: func(ctx context.Context) ([]string, error) {
+		<-ctx.Done()
+		return nil, fmt.Errorf("fetching: %w", ctx.Err())
+	}}
+
+	items, errs := stream(ctx, p.next)
+	for range items {
+	}
+	if err := <-errs; err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -13,38 +14,48 @@ var (
 	ErrNoMorePages = errors.New("No more pages")
 )
 
-func (registry *Registry) getJson(u string, response interface{}) error {
-	resp, err := registry.Client.Get(u)
+// getJson fetches u and decodes the JSON body into response, returning the
+// response so callers can inspect its headers. The body is already closed.
+func (registry *Registry) getJson(ctx context.Context, u string, response interface{}) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return registry.doJson(req, response)
+}
+
+// doJson is getJson for a request the caller has already built, for APIs
+// that need extra headers.
+func (registry *Registry) doJson(req *http.Request, response interface{}) (*http.Response, error) {
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	decoder := json.NewDecoder(resp.Body)
 	err = decoder.Decode(response)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return resp, nil
 }
 
 // getPaginatedJson accepts a string and a pointer, and returns the
 // next page URL while updating pointed-to variable with a parsed JSON
 // value. When there are no more pages it returns `ErrNoMorePages`.
-func (registry *Registry) getPaginatedJson(u string, response interface{}) (string, error) {
-	resp, err := registry.Client.Get(u)
+func (registry *Registry) getPaginatedJson(ctx context.Context, u string, response interface{}) (string, error) {
+	resp, err := registry.getJson(ctx, u, response)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(response)
+	next, err := getNextLink(u, resp)
 	if err != nil {
 		return "", err
 	}
-	return getNextLink(u, resp)
+	return registry.rebase(next), nil
 }
 
 // Matches an RFC 5988 (https://tools.ietf.org/html/rfc5988#section-5)
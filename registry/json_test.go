@@ -41,3 +41,37 @@ func Test_GetNextLink(t *testing.T) {
 		})
 	}
 }
+
+func Test_GetNextLink_Headers(t *testing.T) {
+	tcs := []struct {
+		name     string
+		header   http.Header
+		expected string
+		err      error
+	}{
+		{
+			name:     "dtr page start",
+			header:   http.Header{"X-Next-Page-Start": []string{"0000-repo2"}},
+			expected: `https://example.com/api/v0/repositories/?pageSize=10&pageStart=0000-repo2`,
+		},
+		{
+			name:   "gitlab next page is left to the gitlab catalog",
+			header: http.Header{"X-Next-Page": []string{"3"}, "X-Total-Pages": []string{"4"}},
+			err:    ErrNoMorePages,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := getNextLink("https://example.com/api/v0/repositories/?pageSize=10", &http.Response{
+				Header: tc.header,
+			})
+			if err != tc.err {
+				t.Errorf("Expected error %v, got %v", tc.err, err)
+			}
+			if tc.expected != s {
+				t.Errorf("Expected %v, got %v", tc.expected, s)
+			}
+		})
+	}
+}
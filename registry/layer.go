@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/url"
@@ -10,25 +11,59 @@ import (
 )
 
 func (registry *Registry) DownloadLayer(repository string, digest digest.Digest) (io.ReadCloser, error) {
+	resp, err := registry.downloadLayer(context.Background(), repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// downloadLayer starts downloading a blob. The operation's span lasts until
+// the response body is closed.
+func (registry *Registry) downloadLayer(ctx context.Context, repository string, digest digest.Digest) (*http.Response, error) {
+	ctx, span := registry.startSpan(ctx, "registry.DownloadLayer", "repository", repository, "digest", digest.String())
+
 	url := registry.url("/v2/%s/blobs/%s", repository, digest)
 
 	registry.Logf("registry.layer.download url=%s repository=%s digest=%s", url, repository, digest)
 	registry.resetToken()
 
-	resp, err := registry.Client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		span.End()
+		return nil, err
+	}
+	resp, err := registry.Client.Do(req)
 	if err != nil {
+		span.End()
 		return nil, err
 	}
 
-	return resp.Body, nil
+	// The span lasts until the caller is done with the layer.
+	resp.Body = endOnClose(resp.Body, span)
+	return resp, nil
 }
 
 func (registry *Registry) UploadLayer(repository string, digest digest.Digest, content io.Reader) error {
-	registry.resetToken()
+	return registry.uploadLayer(context.Background(), repository, digest, content, -1, nil)
+}
 
-	uploadUrl, err := registry.initiateUpload(repository)
-	if err != nil {
-		return err
+// uploadLayer uploads a blob in a single request, streaming content. size is
+// sent as the Content-Length when it's known, which some registries require;
+// pass -1 otherwise. uploadUrl continues an upload session that's already
+// been started, such as by a failed mount; when nil, a new one is started.
+func (registry *Registry) uploadLayer(ctx context.Context, repository string, digest digest.Digest, content io.Reader, size int64, uploadUrl *url.URL) error {
+	ctx, span := registry.startSpan(ctx, "registry.UploadLayer", "repository", repository, "digest", digest.String())
+	defer span.End()
+
+	if uploadUrl == nil {
+		registry.resetToken()
+
+		var err error
+		uploadUrl, err = registry.initiateUpload(ctx, repository)
+		if err != nil {
+			return err
+		}
 	}
 	q := uploadUrl.Query()
 	q.Set("digest", digest.String())
@@ -36,22 +71,106 @@ func (registry *Registry) UploadLayer(repository string, digest digest.Digest, c
 
 	registry.Logf("registry.layer.upload url=%s repository=%s digest=%s", uploadUrl, repository, digest)
 
-	upload, err := http.NewRequest("PUT", uploadUrl.String(), content)
+	upload, err := http.NewRequestWithContext(ctx, "PUT", uploadUrl.String(), content)
 	if err != nil {
 		return err
 	}
 	upload.Header.Set("Content-Type", "application/octet-stream")
+	if size >= 0 {
+		upload.ContentLength = size
+		if size == 0 {
+			upload.Body = http.NoBody
+		}
+	}
 
-	_, err = registry.Client.Do(upload)
+	resp, err := registry.Client.Do(upload)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
 	return err
 }
 
+/*
+ * Mount a blob from another repository in the same registry into repository,
+ * without transferring it. It reports false if the registry doesn't support
+ * cross-repository mounts, or the blob couldn't be found in from.
+ */
+func (registry *Registry) MountLayer(repository string, digest digest.Digest, from string) (bool, error) {
+	mounted, uploadUrl, err := registry.mountLayer(context.Background(), repository, digest, from)
+	if err == nil && !mounted && uploadUrl != nil {
+		registry.cancelUpload(context.Background(), uploadUrl)
+	}
+	return mounted, err
+}
+
+// mountLayer asks the registry to mount a blob from another repository. When
+// the registry declines, it starts an ordinary upload instead, and its URL is
+// returned so the blob can be uploaded without starting another.
+func (registry *Registry) mountLayer(ctx context.Context, repository string, digest digest.Digest, from string) (bool, *url.URL, error) {
+	ctx, span := registry.startSpan(ctx, "registry.MountLayer", "repository", repository, "digest", digest.String(), "from", from)
+	defer span.End()
+
+	mountUrl := registry.url("/v2/%s/blobs/uploads/?mount=%s&from=%s", repository, url.QueryEscape(digest.String()), url.QueryEscape(from))
+	registry.Logf("registry.layer.mount url=%s repository=%s digest=%s from=%s", mountUrl, repository, digest, from)
+	registry.resetToken()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", mountUrl, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	resp, err := registry.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	if resp.StatusCode == http.StatusCreated {
+		return true, nil, nil
+	}
+	uploadUrl, err := registry.uploadLocation(resp)
+	if err != nil {
+		return false, nil, err
+	}
+	return false, uploadUrl, nil
+}
+
+// cancelUpload abandons an upload session. Failures are only logged: the
+// registry expires abandoned uploads anyway.
+func (registry *Registry) cancelUpload(ctx context.Context, uploadUrl *url.URL) {
+	registry.Logf("registry.layer.cancel-upload url=%s", uploadUrl)
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", uploadUrl.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := registry.Client.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		registry.Logf("registry.layer.cancel-upload url=%s err=%v", uploadUrl, err)
+	}
+}
+
 func (registry *Registry) HasLayer(repository string, digest digest.Digest) (bool, error) {
+	return registry.hasLayer(context.Background(), repository, digest)
+}
+
+func (registry *Registry) hasLayer(ctx context.Context, repository string, digest digest.Digest) (bool, error) {
+	ctx, span := registry.startSpan(ctx, "registry.HasLayer", "repository", repository, "digest", digest.String())
+	defer span.End()
+
 	checkUrl := registry.url("/v2/%s/blobs/%s", repository, digest)
 	registry.Logf("registry.layer.check url=%s repository=%s digest=%s", checkUrl, repository, digest)
 	registry.resetToken()
 
-	resp, err := registry.Client.Head(checkUrl)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", checkUrl, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := registry.Client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -75,11 +194,18 @@ func (registry *Registry) HasLayer(repository string, digest digest.Digest) (boo
 }
 
 func (registry *Registry) LayerMetadata(repository string, digest digest.Digest) (distribution.Descriptor, error) {
+	ctx, span := registry.startSpan(context.Background(), "registry.LayerMetadata", "repository", repository, "digest", digest.String())
+	defer span.End()
+
 	checkUrl := registry.url("/v2/%s/blobs/%s", repository, digest)
 	registry.Logf("registry.layer.check url=%s repository=%s digest=%s", checkUrl, repository, digest)
 	registry.resetToken()
 
-	resp, err := registry.Client.Head(checkUrl)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", checkUrl, nil)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	resp, err := registry.Client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -93,12 +219,17 @@ func (registry *Registry) LayerMetadata(repository string, digest digest.Digest)
 	}, nil
 }
 
-func (registry *Registry) initiateUpload(repository string) (*url.URL, error) {
+func (registry *Registry) initiateUpload(ctx context.Context, repository string) (*url.URL, error) {
 	initiateUrl := registry.url("/v2/%s/blobs/uploads/", repository)
 	registry.Logf("registry.layer.initiate-upload url=%s repository=%s", initiateUrl, repository)
 	registry.resetToken()
 
-	resp, err := registry.Client.Post(initiateUrl, "application/octet-stream", nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", initiateUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := registry.Client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -106,10 +237,19 @@ func (registry *Registry) initiateUpload(repository string) (*url.URL, error) {
 		return nil, err
 	}
 
-	location := resp.Header.Get("Location")
-	locationUrl, err := url.Parse(location)
+	return registry.uploadLocation(resp)
+}
+
+// uploadLocation returns the URL of the upload session a response started.
+// Registries may send a Location relative to the request, as the spec
+// allows, and those behind a path prefix may leave it out.
+func (registry *Registry) uploadLocation(resp *http.Response) (*url.URL, error) {
+	locationUrl, err := url.Parse(resp.Header.Get("Location"))
 	if err != nil {
 		return nil, err
 	}
-	return locationUrl, nil
+	if resp.Request != nil && resp.Request.URL != nil {
+		locationUrl = resp.Request.URL.ResolveReference(locationUrl)
+	}
+	return url.Parse(registry.rebase(locationUrl.String()))
 }
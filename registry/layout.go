@@ -0,0 +1,243 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// AnnotationRefName is the annotation that names an image in an OCI image
+// layout's index, usually by its tag.
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+const imageLayoutVersion = "1.0.0"
+
+/*
+ * Layout is an OCI image layout: a directory holding images as an
+ * `oci-layout` marker, an `index.json` listing them, and their blobs under
+ * `blobs/<algorithm>/<hex>`, as read and written by tools such as skopeo and
+ * umoci. The images in a layout share their blobs. A Layout can be used from
+ * several goroutines, but not by several processes at once.
+ */
+type Layout struct {
+	Path string
+
+	mu sync.Mutex // guards index.json
+}
+
+// layoutIndex is the index.json of an image layout.
+type layoutIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// CreateLayout opens the OCI image layout at path, creating it if it doesn't
+// exist yet.
+func CreateLayout(path string) (*Layout, error) {
+	if err := os.MkdirAll(filepath.Join(path, "blobs"), 0755); err != nil {
+		return nil, err
+	}
+
+	marker := filepath.Join(path, "oci-layout")
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		b, _ := json.Marshal(map[string]string{"imageLayoutVersion": imageLayoutVersion})
+		if err := writeFileAtomic(marker, b); err != nil {
+			return nil, err
+		}
+		return &Layout{Path: path}, nil
+	}
+	return OpenLayout(path)
+}
+
+// OpenLayout opens an existing OCI image layout.
+func OpenLayout(path string) (*Layout, error) {
+	b, err := ioutil.ReadFile(filepath.Join(path, "oci-layout"))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLayoutVersion(b); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &Layout{Path: path}, nil
+}
+
+func checkLayoutVersion(marker []byte) error {
+	var layout struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(marker, &layout); err != nil {
+		return fmt.Errorf("oci-layout: %v", err)
+	}
+	if layout.ImageLayoutVersion != imageLayoutVersion {
+		return fmt.Errorf("unsupported image layout version %q", layout.ImageLayoutVersion)
+	}
+	return nil
+}
+
+// Index returns the images listed in the layout's index.json.
+func (layout *Layout) Index() ([]Descriptor, error) {
+	layout.mu.Lock()
+	defer layout.mu.Unlock()
+
+	index, err := layout.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+func (layout *Layout) readIndex() (*layoutIndex, error) {
+	b, err := ioutil.ReadFile(filepath.Join(layout.Path, "index.json"))
+	if os.IsNotExist(err) {
+		return &layoutIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Manifests: []Descriptor{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseLayoutIndex(b)
+}
+
+func parseLayoutIndex(b []byte) (*layoutIndex, error) {
+	index := &layoutIndex{}
+	if err := json.Unmarshal(b, index); err != nil {
+		return nil, fmt.Errorf("index.json: %v", err)
+	}
+	return index, nil
+}
+
+// OpenBlob opens a blob in the layout and returns its size.
+func (layout *Layout) OpenBlob(dgst digest.Digest) (io.ReadCloser, int64, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(layout.blobPath(dgst))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// addToIndex lists an image in index.json, in place of any image listed under
+// the same name or, for an image without a name, the same digest.
+func (layout *Layout) addToIndex(descriptor Descriptor) error {
+	layout.mu.Lock()
+	defer layout.mu.Unlock()
+
+	index, err := layout.readIndex()
+	if err != nil {
+		return err
+	}
+
+	name := descriptor.Annotations[AnnotationRefName]
+	manifests := []Descriptor{}
+	for _, existing := range index.Manifests {
+		existingName := existing.Annotations[AnnotationRefName]
+		if existingName == name && (name != "" || existing.Digest == descriptor.Digest) {
+			continue
+		}
+		manifests = append(manifests, existing)
+	}
+	index.Manifests = append(manifests, descriptor)
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(layout.Path, "index.json"), b)
+}
+
+func (layout *Layout) blobPath(dgst digest.Digest) string {
+	return filepath.Join(layout.Path, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// hasBlob reports whether the layout holds a blob, of the expected size when
+// that is known.
+func (layout *Layout) hasBlob(descriptor Descriptor) (bool, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return false, err
+	}
+	info, err := os.Stat(layout.blobPath(descriptor.Digest))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return descriptor.Size < 0 || info.Size() == descriptor.Size, nil
+}
+
+// writeBlob stores a blob, verifying it against its digest and, when known,
+// its size, and returns how many bytes it wrote. Nothing is stored unless the
+// blob is complete and intact.
+func (layout *Layout) writeBlob(descriptor Descriptor, content io.Reader) (int64, error) {
+	dgst := descriptor.Digest
+	if err := dgst.Validate(); err != nil {
+		return 0, err
+	}
+	path := layout.blobPath(dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+dgst.Encoded()+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	verifier := dgst.Verifier()
+	n, err := io.Copy(f, io.TeeReader(content, verifier))
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if descriptor.Size >= 0 && n != descriptor.Size {
+		return 0, fmt.Errorf("blob %s is %d bytes, expected %d", dgst, n, descriptor.Size)
+	}
+	if !verifier.Verified() {
+		return 0, fmt.Errorf("%w: blob %s", ErrDigestMismatch, dgst)
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+// writeFileAtomic replaces a file in one step, so that it is never seen half
+// written.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// LayoutSource is an OCI image layout to read images from: a *Layout or a
+// *LayoutArchive.
+type LayoutSource interface {
+	// Index returns the images listed in the layout's index.json.
+	Index() ([]Descriptor, error)
+
+	// OpenBlob opens a blob and returns its size.
+	OpenBlob(dgst digest.Digest) (io.ReadCloser, int64, error)
+}
+
+var (
+	_ LayoutSource = &Layout{}
+	_ LayoutSource = &LayoutArchive{}
+)
+
+/*
+ * LayoutArchive is an OCI image layout packed in a tar file, optionally
+ * gzipped, as `docker buildx build --output type=oci` writes. Files are read
+ * straight from the tar; a gzipped archive is first decompressed into a
+ * temporary file, which Close removes.
+ */
+type LayoutArchive struct {
+	tarArchive
+}
+
+// OpenLayoutArchive opens the OCI image layout in a tar or tar.gz file.
+func OpenLayoutArchive(path string) (*LayoutArchive, error) {
+	tarArchive, err := openTarArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	archive := &LayoutArchive{tarArchive: *tarArchive}
+
+	marker, err := archive.readFile("oci-layout")
+	if err == nil {
+		err = checkLayoutVersion(marker)
+	}
+	if err != nil {
+		archive.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return archive, nil
+}
+
+func (archive *LayoutArchive) Index() ([]Descriptor, error) {
+	b, err := archive.readFile("index.json")
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseLayoutIndex(b)
+	if err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+func (archive *LayoutArchive) OpenBlob(dgst digest.Digest) (io.ReadCloser, int64, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, 0, err
+	}
+	return archive.open(path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded()))
+}
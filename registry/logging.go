@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Logger is a structured, levelled logger. Arguments after the message are
+// alternating keys and values. *slog.Logger satisfies it, as do adapters for
+// most structured logging libraries.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+/*
+ * Send the registry's logs to logger instead of its Logf callback. Every HTTP
+ * request is logged at debug level, or warning level for server errors and
+ * failed requests, with its method, URL, status, duration and repository, and
+ * the ID of the operation that made it, which correlates an operation's
+ * requests, including those of the authentication dance. Log messages have
+ * credentials and tokens redacted.
+ */
+func (r *Registry) SetLogger(logger Logger) {
+	r.Logf = func(format string, args ...interface{}) {
+		logger.Debug(Redact(fmt.Sprintf(format, args...)))
+	}
+	if t := r.loggingTransport(); t != nil {
+		t.Logger = logger
+	}
+}
+
+// loggingTransport returns the LoggingTransport at the bottom of the
+// registry's transport stack, or nil if the registry wasn't built with
+// WrapTransport.
+func (r *Registry) loggingTransport() *LoggingTransport {
+	if tokenTransport := r.tokenTransport(); tokenTransport != nil {
+		if t, ok := tokenTransport.Transport.(*LoggingTransport); ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// LoggingTransport logs every request it sends to Logger, which may be nil
+// to log nothing.
+type LoggingTransport struct {
+	Transport http.RoundTripper
+	Logger    Logger
+}
+
+var requestCounter uint64
+
+type requestIDKey struct{}
+
+func nextRequestID() string {
+	return strconv.FormatUint(atomic.AddUint64(&requestCounter, 1), 10)
+}
+
+// withRequestID gives ctx a new request ID unless it already has one, so that
+// the requests of an operation, and of any operations it's made of, share it.
+func withRequestID(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, nextRequestID())
+}
+
+func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Logger == nil {
+		return t.Transport.RoundTrip(req)
+	}
+
+	// Requests made outside any operation get an ID of their own.
+	id, ok := req.Context().Value(requestIDKey{}).(string)
+	if !ok {
+		id = nextRequestID()
+	}
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(req)
+
+	args := []interface{}{
+		"request_id", id,
+		"method", req.Method,
+		"url", Redact(req.URL.String()),
+		"duration", time.Since(start),
+	}
+	if repository := repositoryFromPath(req.URL.Path); repository != "" {
+		args = append(args, "repository", repository)
+	}
+
+	switch {
+	case err != nil:
+		t.Logger.Warn("registry.request failed", append(args, "error", Redact(err.Error()))...)
+	case resp.StatusCode >= 500:
+		t.Logger.Warn("registry.request", append(args, "status", resp.StatusCode)...)
+	default:
+		t.Logger.Debug("registry.request", append(args, "status", resp.StatusCode)...)
+	}
+	return resp, err
+}
+
+var repositoryPathRE = regexp.MustCompile(`/v2/(.+?)/(?:manifests|blobs|tags|referrers)/`)
+
+// repositoryFromPath returns the repository a registry API path refers to.
+func repositoryFromPath(path string) string {
+	if m := repositoryPathRE.FindStringSubmatch(path); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+const redacted = "[REDACTED]"
+
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Authorization headers, and credentials wherever else they appear.
+	{regexp.MustCompile(`(?i)(authorization"?\s*[:=]\s*"?)[^"\r\n]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?m)((?:^|[\[:="])\s*(?:Bearer|Basic|JWT)\s+)[A-Za-z0-9\-._~+/]{8,}=*`), "${1}" + redacted},
+	// Tokens and passwords in JSON bodies.
+	{regexp.MustCompile(`(?i)("(?:token|access_token|refresh_token|id_token|password|secret)"\s*:\s*")(?:[^"\\]|\\.)*(")`), "${1}" + redacted + "${2}"},
+	// Tokens and signatures in query strings, such as on pre-signed blob URLs.
+	{regexp.MustCompile(`(?i)([?&](?:token|access_token|password|secret|signature|sig|x-amz-signature|x-amz-credential|x-amz-security-token|x-goog-signature|x-goog-credential)=)[^&\s"]*`), "${1}" + redacted},
+	// Passwords in URLs.
+	{regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "${1}" + redacted + "@"},
+}
+
+// Redact removes credentials and tokens from s, such as Authorization header
+// values, tokens in JSON bodies, signed query parameters and passwords in
+// URLs.
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return s
+}
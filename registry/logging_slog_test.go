@@ -0,0 +1,12 @@
+//go:build go1.21
+// +build go1.21
+
+package registry_test
+
+import (
+	"log/slog"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+var _ registry.Logger = slog.Default()
@@ -2,6 +2,10 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -12,12 +16,15 @@ import (
 )
 
 func (registry *Registry) Manifest(repository, reference string) (*manifestV1.SignedManifest, error) {
+	ctx, span := registry.startSpan(context.Background(), "registry.Manifest", "repository", repository, "reference", reference)
+	defer span.End()
+
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
 
 	registry.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repository, reference)
 	registry.resetToken()
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -44,12 +51,15 @@ func (registry *Registry) Manifest(repository, reference string) (*manifestV1.Si
 }
 
 func (registry *Registry) ManifestV2(repository, reference string) (*manifestV2.DeserializedManifest, error) {
+	ctx, span := registry.startSpan(context.Background(), "registry.ManifestV2", "repository", repository, "reference", reference)
+	defer span.End()
+
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
 
 	registry.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repository, reference)
 	registry.resetToken()
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -75,40 +85,73 @@ func (registry *Registry) ManifestV2(repository, reference string) (*manifestV2.
 }
 
 func (registry *Registry) ManifestDigest(repository, reference string) (digest.Digest, error) {
+	return registry.manifestDigest(context.Background(), repository, reference)
+}
+
+// ManifestDigestContext is ManifestDigest with a context that can cancel the
+// request.
+func (registry *Registry) ManifestDigestContext(ctx context.Context, repository, reference string) (digest.Digest, error) {
+	return registry.manifestDigest(ctx, repository, reference)
+}
+
+func (registry *Registry) manifestDigest(ctx context.Context, repository, reference string) (digest.Digest, error) {
+	header, err := registry.manifestHead(ctx, repository, reference)
+	if err != nil {
+		return "", err
+	}
+	return digest.Parse(header.Get("Docker-Content-Digest"))
+}
+
+// manifestHead returns the headers of a manifest, which include its digest
+// and, on some registries, its ETag.
+func (registry *Registry) manifestHead(ctx context.Context, repository, reference string) (http.Header, error) {
+	ctx, span := registry.startSpan(ctx, "registry.ManifestDigest", "repository", repository, "reference", reference)
+	defer span.End()
+
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
 
 	registry.Logf("registry.manifest.head url=%s repository=%s reference=%s", url, repository, reference)
 	registry.resetToken()
 
-	req, err := http.NewRequest("HEAD", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	req.Header.Set("Accept", strings.Join([]string{
-		manifestV2.MediaTypeManifest,
-		manifestV1.MediaTypeManifest,
-		"application/vnd.docker.distribution.manifest.v1+prettyjws",
-		"application/vnd.docker.distribution.manifest.list.v2+json",
-	}, ", "))
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
 
 	resp, err := registry.Client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	return resp.Header, nil
 }
 
 func (registry *Registry) DeleteManifest(repository string, digest digest.Digest) error {
-	url := registry.url("/v2/%s/manifests/%s", repository, digest)
+	return registry.deleteManifest(context.Background(), repository, digest.String())
+}
+
+// DeleteManifestContext is DeleteManifest with a context that can cancel the
+// request.
+func (registry *Registry) DeleteManifestContext(ctx context.Context, repository string, digest digest.Digest) error {
+	return registry.deleteManifest(ctx, repository, digest.String())
+}
 
-	registry.Logf("registry.manifest.delete url=%s repository=%s reference=%s", url, repository, digest)
+// deleteManifest deletes a manifest by digest or, where the registry allows
+// it, a tag.
+func (registry *Registry) deleteManifest(ctx context.Context, repository, reference string) error {
+	ctx, span := registry.startSpan(ctx, "registry.DeleteManifest", "repository", repository, "reference", reference)
+	defer span.End()
+
+	url := registry.url("/v2/%s/manifests/%s", repository, reference)
+
+	registry.Logf("registry.manifest.delete url=%s repository=%s reference=%s", url, repository, reference)
 	registry.resetToken()
 
-	req, err := http.NewRequest("DELETE", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 	if err != nil {
 		return err
 	}
@@ -123,6 +166,9 @@ func (registry *Registry) DeleteManifest(repository string, digest digest.Digest
 }
 
 func (registry *Registry) PutManifest(repository, reference string, signedManifest *manifestV1.SignedManifest) error {
+	ctx, span := registry.startSpan(context.Background(), "registry.PutManifest", "repository", repository, "reference", reference)
+	defer span.End()
+
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
 
 	registry.Logf("registry.manifest.put url=%s repository=%s reference=%s", url, repository, reference)
@@ -134,7 +180,7 @@ func (registry *Registry) PutManifest(repository, reference string, signedManife
 	}
 
 	buffer := bytes.NewBuffer(body)
-	req, err := http.NewRequest("PUT", url, buffer)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, buffer)
 	if err != nil {
 		return err
 	}
@@ -146,3 +192,185 @@ func (registry *Registry) PutManifest(repository, reference string, signedManife
 	}
 	return err
 }
+
+// Media types of manifests beyond those of the distribution packages.
+const (
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+)
+
+// manifestMediaTypes are the manifest types ManifestRaw accepts by default.
+var manifestMediaTypes = []string{
+	MediaTypeOCIIndex,
+	MediaTypeManifestList,
+	MediaTypeOCIManifest,
+	manifestV2.MediaTypeManifest,
+	manifestV1.MediaTypeSignedManifest,
+	manifestV1.MediaTypeManifest,
+}
+
+// ErrDigestMismatch is returned when content doesn't match the digest it was
+// fetched by.
+var ErrDigestMismatch = errors.New("content does not match its digest")
+
+// RawManifest is a manifest exactly as the registry sent it, so it can be
+// verified against its digest or pushed elsewhere byte for byte.
+type RawManifest struct {
+	MediaType string
+	Digest    digest.Digest
+	Payload   []byte
+}
+
+/*
+ * Fetch a manifest of any type without decoding it. mediaTypes are sent as
+ * the Accept header; when none are given, every manifest and index type this
+ * library knows is accepted. When reference is a digest, the payload is
+ * verified against it.
+ */
+func (registry *Registry) ManifestRaw(repository, reference string, mediaTypes ...string) (*RawManifest, error) {
+	return registry.manifestRaw(context.Background(), repository, reference, mediaTypes...)
+}
+
+// ManifestRawContext is ManifestRaw with a context that can cancel the
+// request.
+func (registry *Registry) ManifestRawContext(ctx context.Context, repository, reference string, mediaTypes ...string) (*RawManifest, error) {
+	return registry.manifestRaw(ctx, repository, reference, mediaTypes...)
+}
+
+func (registry *Registry) manifestRaw(ctx context.Context, repository, reference string, mediaTypes ...string) (*RawManifest, error) {
+	ctx, span := registry.startSpan(ctx, "registry.ManifestRaw", "repository", repository, "reference", reference)
+	defer span.End()
+
+	url := registry.url("/v2/%s/manifests/%s", repository, reference)
+
+	registry.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repository, reference)
+	registry.resetToken()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mediaTypes) == 0 {
+		mediaTypes = manifestMediaTypes
+	}
+	req.Header.Set("Accept", strings.Join(mediaTypes, ", "))
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &RawManifest{
+		MediaType: manifestMediaType(resp.Header.Get("Content-Type"), body),
+		Digest:    digest.FromBytes(body),
+		Payload:   body,
+	}
+	if expected, err := digest.Parse(reference); err == nil {
+		if err := verifyDigest(expected, body); err != nil {
+			return nil, err
+		}
+		manifest.Digest = expected
+	}
+	return manifest, nil
+}
+
+// manifestMediaType works out a manifest's media type from the Content-Type
+// it was served with or, when that's missing or generic, from the manifest
+// itself.
+func manifestMediaType(contentType string, payload []byte) string {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	if contentType != "" && contentType != "application/json" && contentType != "text/plain" && contentType != "application/octet-stream" {
+		return contentType
+	}
+
+	var versioned struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+		Signatures    json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal(payload, &versioned); err != nil {
+		return contentType
+	}
+	switch {
+	case versioned.MediaType != "":
+		return versioned.MediaType
+	case versioned.SchemaVersion == 1 && versioned.Signatures != nil:
+		return manifestV1.MediaTypeSignedManifest
+	case versioned.SchemaVersion == 1:
+		return manifestV1.MediaTypeManifest
+	case versioned.Manifests != nil:
+		return MediaTypeOCIIndex
+	default:
+		return MediaTypeOCIManifest
+	}
+}
+
+// verifyDigest checks that content has the expected digest.
+func verifyDigest(expected digest.Digest, content []byte) error {
+	if err := expected.Validate(); err != nil {
+		return err
+	}
+	if actual := expected.Algorithm().FromBytes(content); actual != expected {
+		return fmt.Errorf("%w: expected %s, got %s", ErrDigestMismatch, expected, actual)
+	}
+	return nil
+}
+
+/*
+ * Upload a manifest of any type exactly as given, so that its digest is
+ * preserved, and return that digest. When reference is a digest, payload is
+ * checked against it before it is sent.
+ */
+func (registry *Registry) PushManifest(repository, reference, mediaType string, payload []byte) (digest.Digest, error) {
+	return registry.pushManifest(context.Background(), repository, reference, mediaType, payload, nil)
+}
+
+// pushManifest uploads a manifest, adding header to the request, as for
+// conditional pushes.
+func (registry *Registry) pushManifest(ctx context.Context, repository, reference, mediaType string, payload []byte, header http.Header) (digest.Digest, error) {
+	ctx, span := registry.startSpan(ctx, "registry.PushManifest", "repository", repository, "reference", reference)
+	defer span.End()
+
+	dgst := digest.FromBytes(payload)
+	if expected, err := digest.Parse(reference); err == nil {
+		if err := verifyDigest(expected, payload); err != nil {
+			return "", err
+		}
+		dgst = expected
+	}
+
+	url := registry.url("/v2/%s/manifests/%s", repository, reference)
+
+	registry.Logf("registry.manifest.put url=%s repository=%s reference=%s", url, repository, reference)
+	registry.resetToken()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := registry.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
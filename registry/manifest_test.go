@@ -0,0 +1,45 @@
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func Test_ManifestDigest(t *testing.T) {
+	index := digest.FromString("index")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.Path != "/v2/app/manifests/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// Like Distribution, only serve an OCI index to clients that accept it.
+		if !strings.Contains(r.Header.Get("Accept"), registry.MediaTypeOCIIndex) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", registry.MediaTypeOCIIndex)
+		w.Header().Set("Docker-Content-Digest", index.String())
+	}
+	reg, done := newCatalogTestRegistry(t, handler, nil)
+	defer done()
+
+	d, err := reg.ManifestDigest("app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != index {
+		t.Errorf("expected %s, got %s", index, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := reg.ManifestDigestContext(ctx, "app", "latest"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ConflictError is returned when a tag doesn't point where a conditional push
+// expected it to.
+type ConflictError struct {
+	Repository string
+	Tag        string
+
+	// Expected is the digest the tag was expected to point to, and Actual the
+	// one it points to. Either is empty for a tag that doesn't exist.
+	Expected digest.Digest
+	Actual   digest.Digest
+}
+
+func (err *ConflictError) Error() string {
+	switch {
+	case err.Expected == "":
+		return fmt.Sprintf("%s:%s already exists, at %s", err.Repository, err.Tag, err.Actual)
+	case err.Actual == "":
+		return fmt.Sprintf("%s:%s doesn't exist, expected it at %s", err.Repository, err.Tag, err.Expected)
+	case err.Actual == err.Expected:
+		return fmt.Sprintf("%s:%s changed while it was being pushed", err.Repository, err.Tag)
+	default:
+		return fmt.Sprintf("%s:%s points to %s, not %s", err.Repository, err.Tag, err.Actual, err.Expected)
+	}
+}
+
+/*
+ * Push a manifest under tag only if the tag points to expected or, when
+ * expected is empty, only if the tag doesn't exist yet. Otherwise nothing is
+ * pushed and a *ConflictError is returned.
+ *
+ * The tag is checked with a HEAD request right before the push. Where the
+ * registry serves ETags for manifests, the push is also sent with If-Match or
+ * If-None-Match, which closes the gap between the two; elsewhere a push by
+ * someone else within that gap can still be overwritten. A push the registry
+ * refuses because its precondition failed is never retried without it, and
+ * returns a *ConflictError.
+ */
+func (registry *Registry) PushManifestIf(repository, tag string, expected digest.Digest, mediaType string, payload []byte) (digest.Digest, error) {
+	return registry.pushManifestIf(context.Background(), repository, tag, expected, mediaType, payload)
+}
+
+func (registry *Registry) pushManifestIf(ctx context.Context, repository, tag string, expected digest.Digest, mediaType string, payload []byte) (digest.Digest, error) {
+	ctx, span := registry.startSpan(ctx, "registry.PushManifestIf", "repository", repository, "tag", tag, "expected", expected.String())
+	defer span.End()
+
+	if _, err := digest.Parse(tag); err == nil {
+		return "", fmt.Errorf("%s is a digest, not a tag", tag)
+	}
+
+	actual, etag, err := registry.tagState(ctx, repository, tag)
+	if err != nil {
+		return "", err
+	}
+	if actual != expected {
+		return "", &ConflictError{Repository: repository, Tag: tag, Expected: expected, Actual: actual}
+	}
+
+	header := http.Header{}
+	if expected == "" {
+		header.Set("If-None-Match", "*")
+	} else if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	dgst, err := registry.pushManifest(ctx, repository, tag, mediaType, payload, header)
+	if !isHttpStatus(err, http.StatusPreconditionFailed) {
+		return dgst, err
+	}
+
+	// The tag moved since the HEAD, perhaps and back again; look again only
+	// to report where it is now.
+	actual, _, err = registry.tagState(ctx, repository, tag)
+	if err != nil {
+		return "", err
+	}
+	return "", &ConflictError{Repository: repository, Tag: tag, Expected: expected, Actual: actual}
+}
+
+// tagState returns the digest a tag points to and its ETag, if the registry
+// sends one. Both are empty when the tag doesn't exist.
+func (registry *Registry) tagState(ctx context.Context, repository, tag string) (digest.Digest, string, error) {
+	header, err := registry.manifestHead(ctx, repository, tag)
+	if isHttpStatus(err, http.StatusNotFound) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	dgst, err := digest.Parse(header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return "", "", err
+	}
+	return dgst, header.Get("Etag"), nil
+}
+
+// TagUpdate moves Tag in Repository from the manifest From to the manifest To,
+// which must already be in the repository. An empty From means that the tag
+// must not exist yet.
+type TagUpdate struct {
+	Repository string
+	Tag        string
+	From       digest.Digest
+	To         digest.Digest
+}
+
+func (update TagUpdate) String() string {
+	return update.Repository + ":" + update.Tag
+}
+
+// PromoteError is returned when Promote fails to move a tag. Err is why, and
+// is a *ConflictError when the tag had been moved by someone else.
+// RollbackErrors are the tags, as repository:tag, that were moved but
+// couldn't be moved back.
+type PromoteError struct {
+	Update         TagUpdate
+	Err            error
+	RollbackErrors map[string]error
+}
+
+func (err *PromoteError) Error() string {
+	msg := fmt.Sprintf("promoting %s to %s: %v", err.Update, err.Update.To, err.Err)
+	if len(err.RollbackErrors) > 0 {
+		var tags []string
+		for tag := range err.RollbackErrors {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		msg += fmt.Sprintf(" (and failed to roll back %s)", strings.Join(tags, ", "))
+	}
+	return msg
+}
+
+func (err *PromoteError) Unwrap() error {
+	return err.Err
+}
+
+/*
+ * Move several tags together, each with PushManifestIf, so that pipelines
+ * promoting releases at the same time can't silently overwrite each other.
+ * The updates are made in order. If one fails, those already made are undone
+ * in reverse order, again only where the tag hasn't moved since, and a
+ * *PromoteError is returned.
+ *
+ * Every manifest involved is fetched before any tag is moved, so that a
+ * missing one stops the promotion before it starts.
+ */
+func (registry *Registry) Promote(ctx context.Context, updates []TagUpdate) error {
+	ctx, span := registry.startSpan(ctx, "registry.Promote", "updates", len(updates))
+	defer span.End()
+
+	manifests := make([]*RawManifest, len(updates))
+	previous := make([]*RawManifest, len(updates))
+	for i, update := range updates {
+		raw, err := registry.manifestRaw(ctx, update.Repository, update.To.String())
+		if err != nil {
+			return &PromoteError{Update: update, Err: err}
+		}
+		manifests[i] = raw
+
+		if update.From != "" {
+			raw, err := registry.manifestRaw(ctx, update.Repository, update.From.String())
+			if err != nil {
+				return &PromoteError{Update: update, Err: err}
+			}
+			previous[i] = raw
+		}
+	}
+
+	for i, update := range updates {
+		_, err := registry.pushManifestIf(ctx, update.Repository, update.Tag, update.From, manifests[i].MediaType, manifests[i].Payload)
+		if err != nil {
+			failure := &PromoteError{Update: update, Err: err}
+			registry.rollback(updates[:i], previous, failure)
+			return failure
+		}
+		registry.Logf("registry.promote tag=%s from=%s to=%s", update, update.From, update.To)
+	}
+	return nil
+}
+
+// rollback moves the tags of done back where they were, recording those it
+// can't in failure.
+func (registry *Registry) rollback(done []TagUpdate, previous []*RawManifest, failure *PromoteError) {
+	// Roll back even if the promotion was cancelled: leaving it half done
+	// is worse.
+	ctx := context.Background()
+
+	for i := len(done) - 1; i >= 0; i-- {
+		update := done[i]
+		var err error
+		if update.From == "" {
+			err = registry.untag(ctx, update)
+		} else {
+			_, err = registry.pushManifestIf(ctx, update.Repository, update.Tag, update.To, previous[i].MediaType, previous[i].Payload)
+		}
+		if err != nil {
+			registry.Logf("registry.promote.rollback tag=%s err=%v", update, err)
+			if failure.RollbackErrors == nil {
+				failure.RollbackErrors = map[string]error{}
+			}
+			failure.RollbackErrors[update.String()] = err
+		}
+	}
+}
+
+// untag deletes a tag that a promotion created, unless it has moved since.
+func (registry *Registry) untag(ctx context.Context, update TagUpdate) error {
+	err := registry.deleteTag(ctx, update.Repository, update.Tag, update.To)
+	if isHttpStatus(err, http.StatusNotFound) {
+		return &ConflictError{Repository: update.Repository, Tag: update.Tag, Expected: update.To}
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func Test_PushManifestIf(t *testing.T) {
+	for _, etags := range []bool{false, true} {
+		name := "without etags"
+		if etags {
+			name = "with etags"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			m := newMemoryRegistry(t)
+			m.etags = etags
+			amd64 := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "amd64"})
+			arm64 := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "arm64"})
+			amd64Payload := m.manifests["app"][amd64.Digest.String()]
+			arm64Payload := m.manifests["app"][arm64.Digest.String()]
+
+			reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+			defer done()
+
+			// A tag that must not exist.
+			if _, err := reg.PushManifestIf("app", "stable", "", amd64.MediaType, amd64Payload); err != nil {
+				t.Fatal(err)
+			}
+			_, err := reg.PushManifestIf("app", "stable", "", arm64.MediaType, arm64Payload)
+			var conflict *registry.ConflictError
+			if !errors.As(err, &conflict) || conflict.Actual != amd64.Digest {
+				t.Fatalf("expected a conflict with %s, got %v", amd64.Digest, err)
+			}
+
+			// A tag that must point to a digest.
+			if _, err := reg.PushManifestIf("app", "stable", arm64.Digest, arm64.MediaType, arm64Payload); !errors.As(err, &conflict) {
+				t.Fatalf("expected a conflict, got %v", err)
+			}
+			if _, err := reg.PushManifestIf("app", "stable", amd64.Digest, arm64.MediaType, arm64Payload); err != nil {
+				t.Fatal(err)
+			}
+
+			// A push racing ours between the check and the push.
+			m.beforePut = func(repo, reference string) {
+				m.manifests[repo][reference] = amd64Payload
+			}
+			_, err = reg.PushManifestIf("app", "stable", arm64.Digest, arm64.MediaType, arm64Payload)
+			m.beforePut = nil
+			if etags && !errors.As(err, &conflict) {
+				t.Fatalf("expected the race to be caught, got %v", err)
+			}
+			if !etags && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_PushManifestIf_PreconditionFailed(t *testing.T) {
+	m := newMemoryRegistry(t)
+	m.etags = true
+	amd64 := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "amd64"})
+	arm64 := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "arm64"})
+	m.putManifest("app", "stable", amd64.MediaType, m.manifests["app"][amd64.Digest.String()])
+
+	// The registry refuses the conditional push although the tag looks
+	// unchanged, as when it moved and was moved back in between.
+	reg, done := newCatalogTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.Header.Get("If-Match") != "" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		m.ServeHTTP(w, r)
+	}, nil)
+	defer done()
+
+	_, err := reg.PushManifestIf("app", "stable", amd64.Digest, arm64.MediaType, m.manifests["app"][arm64.Digest.String()])
+	var conflict *registry.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if d, _ := reg.ManifestDigest("app", "stable"); d != amd64.Digest {
+		t.Errorf("the tag was pushed without its precondition, to %s", d)
+	}
+}
+
+func Test_Promote(t *testing.T) {
+	m := newMemoryRegistry(t)
+	m.tagDeletion = true
+	old := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "amd64"})
+	release := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "arm64"})
+	m.putManifest("app", "stable", old.MediaType, m.manifests["app"][old.Digest.String()])
+	m.putManifest("app", "prod", old.MediaType, m.manifests["app"][old.Digest.String()])
+
+	reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+	defer done()
+
+	// prod has moved on since the pipeline looked at it.
+	err := reg.Promote(context.Background(), []registry.TagUpdate{
+		{Repository: "app", Tag: "candidate", To: release.Digest},
+		{Repository: "app", Tag: "stable", From: old.Digest, To: release.Digest},
+		{Repository: "app", Tag: "prod", From: release.Digest, To: release.Digest},
+	})
+	var promoteErr *registry.PromoteError
+	if !errors.As(err, &promoteErr) || promoteErr.Update.Tag != "prod" {
+		t.Fatalf("expected prod to fail, got %v", err)
+	}
+	var conflict *registry.ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+	if len(promoteErr.RollbackErrors) > 0 {
+		t.Errorf("rollback failed: %v", promoteErr.RollbackErrors)
+	}
+
+	for tag, expected := range map[string]digest.Digest{"stable": old.Digest, "prod": old.Digest} {
+		if d, err := reg.ManifestDigest("app", tag); err != nil || d != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", tag, expected, d, err)
+		}
+	}
+	if _, ok := m.manifests["app"]["candidate"]; ok {
+		t.Error("candidate wasn't rolled back")
+	}
+
+	err = reg.Promote(context.Background(), []registry.TagUpdate{
+		{Repository: "app", Tag: "stable", From: old.Digest, To: release.Digest},
+		{Repository: "app", Tag: "prod", From: old.Digest, To: release.Digest},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"stable", "prod"} {
+		if d, err := reg.ManifestDigest("app", tag); err != nil || d != release.Digest {
+			t.Errorf("%s: expected %s, got %s (%v)", tag, release.Digest, d, err)
+		}
+	}
+}
+
+func Test_Promote_RetaggedDuringRollback(t *testing.T) {
+	m := newMemoryRegistry(t)
+	m.etags = true
+	old := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "amd64"})
+	release := pushTestImage(t, m, "app", registry.MediaTypeOCIManifest, registry.Platform{OS: "linux", Architecture: "arm64"})
+	m.putManifest("app", "prod", old.MediaType, m.manifests["app"][old.Digest.String()])
+
+	// Another pipeline moves candidate after the rollback has first looked
+	// at it: the promotion and the rollback each look once before that.
+	heads := 0
+	reg, done := newCatalogTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" && strings.HasSuffix(r.URL.Path, "/manifests/candidate") {
+			heads++
+		}
+		if heads == 3 {
+			m.Lock()
+			m.putManifest("app", "candidate", old.MediaType, m.manifests["app"][old.Digest.String()])
+			m.Unlock()
+		}
+		m.ServeHTTP(w, r)
+	}, nil)
+	defer done()
+
+	err := reg.Promote(context.Background(), []registry.TagUpdate{
+		{Repository: "app", Tag: "candidate", To: release.Digest},
+		{Repository: "app", Tag: "prod", From: release.Digest, To: release.Digest},
+	})
+	var promoteErr *registry.PromoteError
+	if !errors.As(err, &promoteErr) {
+		t.Fatalf("expected the promotion to fail, got %v", err)
+	}
+	var conflict *registry.ConflictError
+	if !errors.As(promoteErr.RollbackErrors["app:candidate"], &conflict) {
+		t.Errorf("expected the rollback of candidate to conflict, got %v", promoteErr.RollbackErrors)
+	}
+	if d, err := reg.ManifestDigest("app", "candidate"); err != nil || d != old.Digest {
+		t.Errorf("the other pipeline's candidate was lost: %s, %v", d, err)
+	}
+}
@@ -0,0 +1,261 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	manifestV1 "github.com/docker/distribution/manifest/schema1"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// DockerHubDomain is the domain image references use for Docker Hub.
+	DockerHubDomain = "docker.io"
+
+	// DockerHubURL is where Docker Hub serves the registry API.
+	DockerHubURL = "https://registry-1.docker.io"
+
+	defaultTag = "latest"
+)
+
+// Hosts that all mean Docker Hub, whether in a reference or a registry URL.
+var dockerHubHosts = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+var ErrNoDigest = errors.New("reference does not contain a digest")
+
+var ErrNoTag = errors.New("reference does not contain a tag")
+
+// ReferenceMismatchError is returned when a reference names a registry other
+// than the one it was passed to.
+type ReferenceMismatchError struct {
+	Reference string
+	Domain    string
+	Registry  string
+}
+
+func (err *ReferenceMismatchError) Error() string {
+	return fmt.Sprintf("reference %s belongs to %s, not %s", err.Reference, err.Domain, err.Registry)
+}
+
+// Reference is a parsed and validated image reference such as
+// docker.io/library/alpine:3.12@sha256:... split into its parts.
+type Reference struct {
+	// Domain is the registry host, including any port. Docker Hub is always
+	// DockerHubDomain.
+	Domain string
+
+	// Repository is the repository path within the registry, with Docker
+	// Hub's implicit "library/" prefix added where needed.
+	Repository string
+
+	Tag    string
+	Digest digest.Digest
+
+	// explicitDomain records whether the domain came from the input rather
+	// than being the Docker Hub default.
+	explicitDomain bool
+}
+
+// ParseReference parses and normalises an image reference. Names without a
+// domain refer to Docker Hub, and official images gain the "library/"
+// prefix, so "alpine" becomes docker.io/library/alpine.
+func ParseReference(s string) (Reference, error) {
+	named, err := reference.ParseNormalizedNamed(s)
+	if err != nil {
+		return Reference{}, fmt.Errorf("invalid reference %q: %v", s, err)
+	}
+
+	ref := Reference{
+		Domain:         reference.Domain(named),
+		Repository:     reference.Path(named),
+		explicitDomain: hasExplicitDomain(s),
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref.Digest = digested.Digest()
+	}
+	return ref, nil
+}
+
+// hasExplicitDomain applies the same rule as the reference package: the first
+// path component is a domain if it looks like a host name or is "localhost".
+func hasExplicitDomain(s string) bool {
+	i := strings.IndexRune(s, '/')
+	if i == -1 {
+		return false
+	}
+	return strings.ContainsAny(s[:i], ".:") || s[:i] == "localhost"
+}
+
+// Reference returns the part of the reference that identifies a manifest:
+// the digest if there is one, otherwise the tag, otherwise "latest".
+func (ref Reference) Reference() string {
+	if ref.Digest != "" {
+		return ref.Digest.String()
+	}
+	if ref.Tag != "" {
+		return ref.Tag
+	}
+	return defaultTag
+}
+
+// Name returns the fully qualified repository name, without tag or digest.
+func (ref Reference) Name() string {
+	return ref.Domain + "/" + ref.Repository
+}
+
+func (ref Reference) String() string {
+	s := ref.Name()
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest.String()
+	}
+	return s
+}
+
+// RegistryURL returns the base URL of the registry serving the reference.
+// Docker Hub is served from DockerHubURL; other registries are assumed to
+// speak HTTPS on the host named in the reference.
+func (ref Reference) RegistryURL() string {
+	if ref.Domain == DockerHubDomain {
+		return DockerHubURL
+	}
+	return "https://" + ref.Domain
+}
+
+/*
+ * Create a new Registry, as with New, for the registry named by an image
+ * reference, and return the parsed reference along with it.
+ */
+func NewFromReference(ref, username, password string) (*Registry, Reference, error) {
+	parsed, err := ParseReference(ref)
+	if err != nil {
+		return nil, Reference{}, err
+	}
+
+	registry, err := New(parsed.RegistryURL(), username, password)
+	if err != nil {
+		return nil, Reference{}, err
+	}
+	return registry, parsed, nil
+}
+
+// Domain returns the reference domain this registry serves: DockerHubDomain
+// for any of Docker Hub's hosts, otherwise the host (and port) of its URL.
+func (registry *Registry) Domain() string {
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		return ""
+	}
+	if dockerHubHosts[u.Host] {
+		return DockerHubDomain
+	}
+	return u.Host
+}
+
+// ParseReference parses s relative to this registry. References naming
+// another registry are rejected with a *ReferenceMismatchError. Names without
+// a domain belong to this registry; they only gain Docker Hub's "library/"
+// prefix when this registry is Docker Hub.
+func (registry *Registry) ParseReference(s string) (Reference, error) {
+	ref, err := ParseReference(s)
+	if err != nil {
+		return Reference{}, err
+	}
+
+	domain := registry.Domain()
+	if ref.explicitDomain {
+		if ref.Domain != domain {
+			return Reference{}, &ReferenceMismatchError{Reference: s, Domain: ref.Domain, Registry: domain}
+		}
+		return ref, nil
+	}
+
+	if domain != DockerHubDomain {
+		name := s
+		if i := strings.IndexAny(s, ":@"); i != -1 {
+			name = s[:i]
+		}
+		if !strings.ContainsRune(name, '/') {
+			ref.Repository = strings.TrimPrefix(ref.Repository, "library/")
+		}
+		ref.Domain = domain
+	}
+	return ref, nil
+}
+
+// ManifestRef is Manifest for a full image reference.
+func (registry *Registry) ManifestRef(ref string) (*manifestV1.SignedManifest, error) {
+	parsed, err := registry.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Manifest(parsed.Repository, parsed.Reference())
+}
+
+// ManifestV2Ref is ManifestV2 for a full image reference.
+func (registry *Registry) ManifestV2Ref(ref string) (*manifestV2.DeserializedManifest, error) {
+	parsed, err := registry.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return registry.ManifestV2(parsed.Repository, parsed.Reference())
+}
+
+// ManifestDigestRef is ManifestDigest for a full image reference.
+func (registry *Registry) ManifestDigestRef(ref string) (digest.Digest, error) {
+	parsed, err := registry.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	return registry.ManifestDigest(parsed.Repository, parsed.Reference())
+}
+
+// DeleteManifestRef is DeleteManifest for a full image reference, which must
+// include a digest.
+func (registry *Registry) DeleteManifestRef(ref string) error {
+	parsed, err := registry.ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	if parsed.Digest == "" {
+		return ErrNoDigest
+	}
+	return registry.DeleteManifest(parsed.Repository, parsed.Digest)
+}
+
+// TagsRef is Tags for a repository given as a reference; any tag or digest in
+// the reference is ignored.
+func (registry *Registry) TagsRef(name string) ([]string, error) {
+	parsed, err := registry.ParseReference(name)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Tags(parsed.Repository)
+}
+
+// DeleteTagRef is DeleteTag for a full image reference, which must include a
+// tag.
+func (registry *Registry) DeleteTagRef(ref string) error {
+	parsed, err := registry.ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	if parsed.Tag == "" {
+		return ErrNoTag
+	}
+	return registry.DeleteTag(parsed.Repository, parsed.Tag)
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_ParseReference(t *testing.T) {
+	tcs := []struct {
+		input    string
+		expected Reference
+		ref      string
+		err      bool
+	}{
+		{
+			input:    "alpine",
+			expected: Reference{Domain: "docker.io", Repository: "library/alpine"},
+			ref:      "latest",
+		},
+		{
+			input:    "docker.io/library/alpine:3.12",
+			expected: Reference{Domain: "docker.io", Repository: "library/alpine", Tag: "3.12"},
+			ref:      "3.12",
+		},
+		{
+			input:    "index.docker.io/heroku/cedar:14",
+			expected: Reference{Domain: "docker.io", Repository: "heroku/cedar", Tag: "14"},
+			ref:      "14",
+		},
+		{
+			input:    "registry.example.com:5000/team/app:v1@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			expected: Reference{Domain: "registry.example.com:5000", Repository: "team/app", Tag: "v1", Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+			ref:      "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		},
+		{input: "alpine:bad/tag", err: true},
+		{input: "Alpine", err: true},
+		{input: "", err: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.input, func(t *testing.T) {
+			ref, err := ParseReference(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ref.Domain != tc.expected.Domain || ref.Repository != tc.expected.Repository || ref.Tag != tc.expected.Tag || ref.Digest != tc.expected.Digest {
+				t.Errorf("expected %+v, got %+v", tc.expected, ref)
+			}
+			if ref.Reference() != tc.ref {
+				t.Errorf("expected reference %v, got %v", tc.ref, ref.Reference())
+			}
+		})
+	}
+}
+
+func Test_Registry_ParseReference(t *testing.T) {
+	hub := &Registry{URL: DockerHubURL, Logf: Quiet}
+	private := &Registry{URL: "https://registry.example.com:5000", Logf: Quiet}
+
+	tcs := []struct {
+		name       string
+		registry   *Registry
+		input      string
+		repository string
+		err        bool
+	}{
+		{name: "hub official image", registry: hub, input: "alpine:3.12", repository: "library/alpine"},
+		{name: "hub qualified", registry: hub, input: "docker.io/heroku/cedar", repository: "heroku/cedar"},
+		{name: "private short name", registry: private, input: "alpine", repository: "alpine"},
+		{name: "private explicit library", registry: private, input: "library/alpine", repository: "library/alpine"},
+		{name: "private qualified", registry: private, input: "registry.example.com:5000/team/app:v1", repository: "team/app"},
+		{name: "private given hub reference", registry: private, input: "docker.io/library/alpine", err: true},
+		{name: "hub given private reference", registry: hub, input: "registry.example.com:5000/team/app", err: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := tc.registry.ParseReference(tc.input)
+			if tc.err {
+				if _, ok := err.(*ReferenceMismatchError); !ok {
+					t.Fatalf("expected a *ReferenceMismatchError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ref.Repository != tc.repository {
+				t.Errorf("expected repository %v, got %v", tc.repository, ref.Repository)
+			}
+			if ref.Domain != tc.registry.Domain() {
+				t.Errorf("expected domain %v, got %v", tc.registry.Domain(), ref.Domain)
+			}
+		})
+	}
+}
+
+func Test_Registry_TagsRef(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/library/alpine/tags/list" {
+			t.Errorf("unexpected path = %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"name":"library/alpine","tags":["3.11","3.12"]}`))
+	}))
+	defer server.Close()
+
+	r, err := NewWithTransport(server.URL, "", "", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := r.TagsRef("library/alpine:ignored")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tags) != 2 {
+		t.Errorf("expected 2 tags, got %v", tags)
+	}
+}
@@ -1,11 +1,14 @@
 package registry
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"strings"
+	"sync/atomic"
 )
 
 type LogfCallback func(format string, args ...interface{})
@@ -28,6 +31,26 @@ type Registry struct {
 	URL    string
 	Client *http.Client
 	Logf   LogfCallback
+
+	// BasePath is where the registry API lives below URL, for registries
+	// that serve `/v2/` under a prefix, such as Artifactory's
+	// "/artifactory/api/docker/<repo-key>". Vendor APIs (DTR, Harbor, Quay)
+	// are still reached at URL itself.
+	BasePath string
+
+	// Catalog pins the provider used to list repositories. When nil, the
+	// provider is detected from the registry's responses.
+	Catalog CatalogProvider
+
+	// capabilities holds the *Capabilities Detect found out about the
+	// registry; see Capabilities.
+	capabilities atomic.Value
+
+	// Tracer and Metrics, when set, instrument every registry operation with
+	// a span, child spans for its HTTP requests, token negotiation and
+	// retries, and request and byte counts.
+	Tracer  Tracer
+	Metrics Metrics
 }
 
 /*
@@ -58,6 +81,39 @@ func NewInsecure(registryUrl, username, password string) (*Registry, error) {
 	return newFromTransport(registryUrl, username, password, transport, Log)
 }
 
+/*
+ * Create a new Registry, as with New, using an http.Transport configured with
+ * the given TLS settings. Use this to trust private CAs or to present client
+ * certificates without turning verification off.
+ */
+func NewWithTLSConfig(registryUrl, username, password string, tlsConfig *tls.Config) (*Registry, error) {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+
+	return newFromTransport(registryUrl, username, password, transport, Log)
+}
+
+/*
+ * Create a new Registry, as with New, loading CA certificates and client
+ * certificates for the registry's host from a Docker-style certs.d directory,
+ * such as DefaultCertsDir. See LoadCertsDir for the expected layout.
+ */
+func NewWithCertsDir(registryUrl, username, password, certsDir string) (*Registry, error) {
+	host, err := certsDirHost(registryUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := LoadCertsDir(certsDir, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithTLSConfig(registryUrl, username, password, tlsConfig)
+}
+
 /*
  * Create a new Registry, as with New, that uses the provided http.RoundTripper as transport.
  */
@@ -68,12 +124,19 @@ func NewWithTransport(registryUrl, username, password string, transport http.Rou
 /*
  * Given an existing http.RoundTripper such as http.DefaultTransport, build the
  * transport stack necessary to authenticate to the Docker registry API. This
- * adds in support for OAuth bearer tokens and HTTP Basic auth, and sets up
- * error handling this library relies on.
+ * adds in support for OAuth bearer tokens and HTTP Basic auth, sets up
+ * error handling this library relies on, logs requests once a Logger is set
+ * with SetLogger, and traces and measures them for instrumented registries.
  */
 func WrapTransport(transport http.RoundTripper, url, username, password string) http.RoundTripper {
-	tokenTransport := &TokenTransport{
+	instrumentedTransport := &InstrumentedTransport{
 		Transport: transport,
+	}
+	loggingTransport := &LoggingTransport{
+		Transport: instrumentedTransport,
+	}
+	tokenTransport := &TokenTransport{
+		Transport: loggingTransport,
 		Username:  username,
 		Password:  password,
 	}
@@ -107,7 +170,7 @@ func (r *Registry) resetToken() {
 	if errorTransport, ok := r.Client.Transport.(*ErrorTransport); ok {
 		if basicAuthTransport, ok := errorTransport.Transport.(*BasicTransport); ok {
 			if tokenTransport, ok := basicAuthTransport.Transport.(*TokenTransport); ok {
-				tokenTransport.token = ""
+				tokenTransport.setToken("")
 			}
 		}
 	}
@@ -121,29 +184,87 @@ func (r *Registry) useBasicPreAuth() {
 	}
 }
 
-// isDTR attempts to detect if the registry is DTR; the only hint we get is if during the
-// authentication process we got `service="dtr"` in the OAuth challenge.
-func (r *Registry) isDTR() bool {
+// tokenTransport returns the TokenTransport in the registry's transport
+// stack, or nil if the registry wasn't built with WrapTransport.
+func (r *Registry) tokenTransport() *TokenTransport {
 	if errorTransport, ok := r.Client.Transport.(*ErrorTransport); ok {
 		if basicAuthTransport, ok := errorTransport.Transport.(*BasicTransport); ok {
 			if tokenTransport, ok := basicAuthTransport.Transport.(*TokenTransport); ok {
-				return tokenTransport.authService != nil && tokenTransport.authService.Service == "dtr"
+				return tokenTransport
 			}
 		}
 	}
-	return false
+	return nil
+}
+
+// baseTransport returns the transport underneath the authentication and
+// error handling layers, for requests that must go out without credentials.
+func (r *Registry) baseTransport() http.RoundTripper {
+	if tokenTransport := r.tokenTransport(); tokenTransport != nil && tokenTransport.Transport != nil {
+		return tokenTransport.Transport
+	}
+	if r.Client.Transport != nil {
+		return r.Client.Transport
+	}
+	return http.DefaultTransport
 }
 
 func (r *Registry) url(pathTemplate string, args ...interface{}) string {
+	pathSuffix := fmt.Sprintf(pathTemplate, args...)
+	url := fmt.Sprintf("%s%s%s", r.URL, r.basePath(), pathSuffix)
+	return url
+}
+
+// apiURL is like url, but for vendor APIs that live at the root of the
+// registry's host rather than under BasePath.
+func (r *Registry) apiURL(pathTemplate string, args ...interface{}) string {
 	pathSuffix := fmt.Sprintf(pathTemplate, args...)
 	url := fmt.Sprintf("%s%s", r.URL, pathSuffix)
 	return url
 }
 
+func (r *Registry) basePath() string {
+	if r.BasePath == "" {
+		return ""
+	}
+	return "/" + strings.Trim(r.BasePath, "/")
+}
+
+// rebase puts BasePath back into a link to the registry API that a server
+// behind a path prefix generated without it, as Artifactory does in Link
+// headers.
+func (r *Registry) rebase(link string) string {
+	base := r.basePath()
+	if base == "" {
+		return link
+	}
+
+	u, err := neturl.Parse(link)
+	if err != nil || !strings.HasPrefix(u.Path, "/v2/") {
+		return link
+	}
+	if registryURL, err := neturl.Parse(r.URL); err != nil || u.Host != registryURL.Host {
+		return link
+	}
+
+	u.Path = base + u.Path
+	if u.RawPath != "" {
+		u.RawPath = base + u.RawPath
+	}
+	return u.String()
+}
+
 func (r *Registry) Ping() error {
+	ctx, span := r.startSpan(context.Background(), "registry.Ping")
+	defer span.End()
+
 	url := r.url("/v2/")
 	r.Logf("registry.ping url=%s", url)
-	resp, err := r.Client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.Client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
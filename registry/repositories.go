@@ -3,283 +3,301 @@ package registry
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 )
 
 type repositoriesResponse struct {
 	Repositories []string `json:"repositories"`
 }
 
-func (registry *Registry) Repositories() ([]string, error) {
-	repos := make([]string, 0, 10)
+// RepositoryIterator lists the repositories in a registry one at a time,
+// fetching pages as they are needed. Obtain one with ListRepositories or
+// ListRepositoriesMatching.
+type RepositoryIterator struct {
+	registry *Registry
+	opts     ListOptions
+	pager    pager
+	filter   func(string) bool
+
+	provider CatalogProvider
+	cursor   string // of the next page
+	byName   bool   // cursor is a repository name rather than the provider's own
+
+	// The cursor and length of the page in the pager, and the number of items
+	// to drop from the first page when resuming from a checkpoint.
+	pageCursor string
+	pageLen    int
+	skip       int
+}
 
-	rchan, echan := registry.StreamRepositories(context.Background())
+// RepositoryListOptions controls a filtered, resumable catalog listing.
+type RepositoryListOptions struct {
+	ListOptions
+
+	// Include and Exclude are glob patterns, as understood by path.Match, on
+	// repository names; `*` doesn't match `/`. IncludeRegexp and
+	// ExcludeRegexp are regular expressions. A repository is listed if it
+	// matches any include (or there are none) and no exclude.
+	Include       []string
+	Exclude       []string
+	IncludeRegexp []*regexp.Regexp
+	ExcludeRegexp []*regexp.Regexp
+
+	// Checkpoint resumes a listing from a value previously returned by
+	// RepositoryIterator.Checkpoint. It takes precedence over Last.
+	Checkpoint string
+}
 
-	for {
-		select {
-		case r, ok := <-rchan:
-			if !ok {
-				return repos, nil
-			}
-			repos = append(repos, r)
-		case e := <-echan:
-			return repos, e
-		}
+// ListRepositories returns an iterator over the registry's catalog. The
+// registry's Catalog provider is used if set, and otherwise one is chosen
+// from the registry's Capabilities if Detect has run. Failing that, `_catalog`
+// is tried first, falling back to the registered fallback providers (DTR,
+// then the Harbor 1.x and 2.x APIs) when the registry looks like DTR or
+// refuses `_catalog`, as with Repositories.
+func (registry *Registry) ListRepositories(opts ListOptions) *RepositoryIterator {
+	it := &RepositoryIterator{
+		registry: registry,
+		opts:     opts,
+		provider: registry.Catalog,
+		cursor:   opts.Last,
+		byName:   opts.Last != "",
 	}
+	it.pager.fetch = it.fetch
+	return it
 }
 
-func (registry *Registry) StreamRepositories(ctx context.Context) (<-chan string, <-chan error) {
-	regChan := make(chan string)
-	errChan := make(chan error)
-
-	registry.resetToken()
-
-	go func() {
-		// defer close(errChan)
-		defer close(regChan)
-
-		regurl := registry.url("/v2/_catalog")
-
-		var err error //We create this here, otherwise url will be rescoped with :=
-		var response repositoriesResponse
-
-		gotSome := false
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				registry.Logf("registry.repositories url=%s", regurl)
-				regurl, err = registry.getPaginatedJson(regurl, &response)
-				switch err {
-				case ErrNoMorePages:
-					// If we have not gotten anything yet and we get 0 repositories back, it could be because
-					// there are legitimately 0 repositories or it could be because the registry is DTR and it
-					// wants us to use the DTR API instead.
-					//
-					// If the fallback fails, we'll assume that there are legitimately 0 repositories and return
-					// without an error.
-					if !gotSome && len(response.Repositories) == 0 || registry.isDTR() {
-						_ = registry.tryFallback(ctx, regChan, errChan)
-						return
-					}
-					streamRegistryAPIRepositoriesPage(ctx, regChan, response.Repositories)
-					return
-
-				case nil:
-					// DTR is tricky. Sometimes it will respond to the _catalog API request with some repositories,
-					// but the list it gives is incomplete. If we have detected that the registry is DTR, then throw
-					// away the _catalog API response and try the fallback, which will use /api/v0/repositories
-					// instead.
-					if registry.isDTR() {
-						_ = registry.tryFallback(ctx, regChan, errChan)
-						return
-					}
-
-					gotSome = true
-					if !streamRegistryAPIRepositoriesPage(ctx, regChan, response.Repositories) {
-						return
-					}
-					continue
-
-				default:
-					if ue, ok := err.(*url.Error); ok {
-						if he, ok := ue.Err.(*HttpStatusError); ok {
-							if he.Response.StatusCode == http.StatusUnauthorized {
-								if fallbackErr := registry.tryFallback(ctx, regChan, errChan); fallbackErr == nil {
-									return
-								}
-							}
-						}
-					}
-
-					errChan <- err
-					return
-				}
-			}
-		}
-	}()
+// ListRepositoriesMatching returns an iterator over the repositories that
+// match opts' patterns, starting from opts.Checkpoint if set. Invalid
+// patterns or checkpoints are reported by the iterator's first Next.
+func (registry *Registry) ListRepositoriesMatching(opts RepositoryListOptions) *RepositoryIterator {
+	it := registry.ListRepositories(opts.ListOptions)
 
-	return regChan, errChan
-}
+	filter, err := repositoryFilter(opts)
+	if err != nil {
+		it.pager.err = err
+		return it
+	}
+	it.filter = filter
 
-func (registry *Registry) tryFallback(ctx context.Context, regChan chan string, errChan chan error) error {
-	regurl := registry.url("/api/v0/repositories/")
-	registry.Logf("attempting DTR fallback at %v", regurl)
+	if opts.Checkpoint != "" {
+		if err := it.resume(opts.Checkpoint); err != nil {
+			it.pager.err = err
+		}
+	}
+	return it
+}
 
-	gotSome := false
+// Next returns the next repository name, or ErrIteratorDone once the catalog
+// is exhausted. Errors are sticky: once Next fails it keeps failing.
+func (it *RepositoryIterator) Next(ctx context.Context) (string, error) {
 	for {
-		var err2 error
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			dtrRepositories := struct {
-				Repositories []dtrRepository `json:"repositories"`
-			}{}
-
-			regurl, err2 = registry.getPaginatedJson(regurl, &dtrRepositories)
-
-			switch err2 {
-			case ErrNoMorePages:
-				gotSome = true
-				streamDTRAPIRepositoriesPage(ctx, regChan, dtrRepositories.Repositories)
-				return nil
-			case nil:
-				gotSome = true
-				if !streamDTRAPIRepositoriesPage(ctx, regChan, dtrRepositories.Repositories) {
-					return nil
-				}
-				continue
-			default:
-				if gotSome {
-					// we got something successfully but now we're failing, return the current error
-					errChan <- err2
-					return nil
-				}
-
-				// try Harbor fallback
-				registry.resetToken()
-				registry.useBasicPreAuth()
-
-				regurl = registry.url("/api/projects")
-				registry.Logf("got error %v, attempting Harbor fallback at %v", err2, regurl)
-				gotSome := false
-				for {
-					var err3 error
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					default:
-						harborProjects := []harborProject{}
-
-						regurl, err3 = registry.getPaginatedJson(regurl, &harborProjects)
-
-						switch err3 {
-						case ErrNoMorePages:
-							gotSome = true
-							streamHarborProjectsPage(ctx, registry, regChan, errChan, harborProjects)
-							return nil
-						case nil:
-							gotSome = true
-							if !streamHarborProjectsPage(ctx, registry, regChan, errChan, harborProjects) {
-								return nil
-							}
-							continue
-						default:
-							if gotSome {
-								// we got something successfully but now we're failing, return the current error
-								errChan <- err3
-								return nil
-							}
-
-							// the fallbacks didn't work, return the original error
-							return fmt.Errorf("fallback didn't work")
-						}
-					}
-				}
-			}
+		repo, err := it.pager.next(ctx)
+		if err != nil || it.filter == nil || it.filter(repo) {
+			return repo, err
 		}
 	}
 }
 
-type dtrRepository struct {
-	Namespace string `json:"namespace"`
-	Name      string `json:"name"`
-	Status    string `json:"status"`
+// Last returns the most recent repository name returned by Next. Passing it
+// as ListOptions.Last resumes the listing after that repository, but only
+// with `_catalog`; Checkpoint works with every provider.
+func (it *RepositoryIterator) Last() string {
+	return it.pager.last
 }
 
-type harborProject struct {
-	ID        int `json:"project_id"`
-	RepoCount int `json:"repo_count"`
-	// there are more fields but we don't care about them
+// Provider returns the catalog provider in use, which is nil until the first
+// page has been fetched when the provider is auto-detected.
+func (it *RepositoryIterator) Provider() CatalogProvider {
+	return it.provider
 }
 
-type harborRepo struct {
-	Name string `json:"name"`
-	// there are more fields but we don't care about them
-}
+// Checkpoint returns a token from which RepositoryListOptions.Checkpoint
+// resumes the listing after the most recent repository returned by Next. It
+// records the provider along with its cursor, such as the `last` value or
+// DTR's `pageStart`, so it can be persisted and used by a later process.
+func (it *RepositoryIterator) Checkpoint() string {
+	q := url.Values{}
+	if it.provider != nil {
+		q.Set("provider", it.provider.Name())
+	}
 
-func streamRegistryAPIRepositoriesPage(ctx context.Context, c chan string, v []string) bool {
-	for _, r := range v {
-		select {
-		case <-ctx.Done():
-			return false
-		case c <- r:
-			// next
+	offset := it.pageLen - len(it.pager.buf)
+	switch {
+	case it.pageLen == 0:
+		// Nothing has been fetched yet.
+		q.Set("cursor", it.cursor)
+		if it.skip > 0 {
+			q.Set("offset", strconv.Itoa(it.skip))
+		}
+	case offset == it.pageLen && it.cursor != "":
+		q.Set("cursor", it.cursor)
+	default:
+		q.Set("cursor", it.pageCursor)
+		if offset > 0 {
+			q.Set("offset", strconv.Itoa(offset))
 		}
 	}
-	return true
+	return q.Encode()
 }
 
-func streamDTRAPIRepositoriesPage(ctx context.Context, c chan string, v []dtrRepository) bool {
-	for _, r := range v {
-		select {
-		case <-ctx.Done():
-			return false
-		case c <- fmt.Sprintf("%s/%s", r.Namespace, r.Name):
-			// next
-		}
+// resume sets the iterator up to continue from checkpoint.
+func (it *RepositoryIterator) resume(checkpoint string) error {
+	q, err := url.ParseQuery(checkpoint)
+	if err != nil {
+		return fmt.Errorf("invalid catalog checkpoint %q: %v", checkpoint, err)
 	}
-	return true
-}
 
-func streamHarborProjectsPage(ctx context.Context, registry *Registry, c chan string, e chan error, v []harborProject) bool {
-	for _, project := range v {
-		if project.RepoCount <= 0 {
-			continue
+	if name := q.Get("provider"); name != "" {
+		switch {
+		case it.provider != nil && it.provider.Name() != name:
+			return fmt.Errorf("catalog checkpoint is for provider %q, but the registry uses %q", name, it.provider.Name())
+		case it.provider == nil:
+			provider, ok := LookupCatalogProvider(name)
+			if !ok {
+				return fmt.Errorf("catalog checkpoint is for unknown provider %q", name)
+			}
+			it.provider = provider
 		}
+	}
 
-		if !streamHarborProjectRepos(ctx, project, registry, c, e) {
-			return false
+	// The checkpoint takes precedence over ListOptions.Last. Its cursor is
+	// only a repository name if it was taken before a provider was chosen.
+	it.cursor = q.Get("cursor")
+	it.opts.Last = it.cursor
+	it.byName = it.provider == nil && it.cursor != ""
+	if offset := q.Get("offset"); offset != "" {
+		if it.skip, err = strconv.Atoi(offset); err != nil || it.skip < 0 {
+			return fmt.Errorf("invalid catalog checkpoint %q", checkpoint)
 		}
 	}
-
-	return true
+	return nil
 }
 
-func streamHarborProjectRepos(ctx context.Context, project harborProject, registry *Registry, c chan string, e chan error) bool {
-	u := registry.url(fmt.Sprintf("/api/repositories?project_id=%d", project.ID))
+func (it *RepositoryIterator) fetch(ctx context.Context) ([]string, error) {
+	ctx, span := it.registry.startSpan(ctx, "registry.Repositories")
+	defer span.End()
 
-	for {
-		var err error
+	var page CatalogPage
+	var err error
 
-		select {
-		case <-ctx.Done():
-			return false
-		default:
-			harborRepos := []harborRepo{}
+	it.pageCursor = it.cursor
+	if it.provider == nil {
+		it.registry.resetToken()
+		it.provider, it.pageCursor, page, err = it.registry.detectCatalog(ctx, it.opts)
+	} else if !it.byName || pagesByName(it.provider) {
+		page, err = it.provider.ListPage(ctx, it.registry, it.cursor, it.opts.N)
+	}
+	if err == nil && it.byName && !pagesByName(it.provider) {
+		// The page, if any, starts from the beginning rather than after Last.
+		err = ErrLastUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.byName = false
 
-			u, err = registry.getPaginatedJson(u, &harborRepos)
+	repos := page.Repositories
+	it.pageLen = len(repos)
+	if it.skip > 0 {
+		if it.skip > len(repos) {
+			it.skip = len(repos)
+		}
+		repos = repos[it.skip:]
+		it.skip = 0
+	}
+
+	it.cursor = page.Next
+	if page.Next == "" {
+		return repos, ErrNoMorePages
+	}
+	return repos, nil
+}
+
+// pagesByName reports whether provider's cursor is a repository name, so that
+// ListOptions.Last can be passed to it.
+func pagesByName(provider CatalogProvider) bool {
+	p, ok := provider.(NameCursorProvider)
+	return ok && p.NameCursor()
+}
+
+// repositoryFilter builds the filter for opts' patterns, or returns nil if
+// there are none.
+func repositoryFilter(opts RepositoryListOptions) (func(string) bool, error) {
+	for _, pattern := range append(append([]string(nil), opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+	}
+	if len(opts.Include)+len(opts.Exclude)+len(opts.IncludeRegexp)+len(opts.ExcludeRegexp) == 0 {
+		return nil, nil
+	}
 
-			switch err {
-			case ErrNoMorePages:
-				streamHarborReposPage(ctx, c, harborRepos)
+	matches := func(repo string, globs []string, res []*regexp.Regexp) bool {
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, repo); ok {
+				return true
+			}
+		}
+		for _, re := range res {
+			if re.MatchString(repo) {
 				return true
-			case nil:
-				if !streamHarborReposPage(ctx, c, harborRepos) {
-					return false
-				}
-				continue
-			default:
-				// we got something successfully but now we're failing, return the current error
-				e <- err
-				return false
 			}
 		}
+		return false
 	}
-}
 
-func streamHarborReposPage(ctx context.Context, c chan string, v []harborRepo) bool {
-	for _, r := range v {
-		select {
-		case <-ctx.Done():
+	return func(repo string) bool {
+		if len(opts.Include)+len(opts.IncludeRegexp) > 0 && !matches(repo, opts.Include, opts.IncludeRegexp) {
 			return false
-		case c <- r.Name:
-			// next
 		}
+		return !matches(repo, opts.Exclude, opts.ExcludeRegexp)
+	}, nil
+}
+
+func (registry *Registry) Repositories() ([]string, error) {
+	return drain(context.Background(), registry.ListRepositories(ListOptions{}).Next)
+}
+
+// StreamRepositories sends the registry's repositories on the first channel
+// and at most one error on the second; both are closed when the listing ends.
+// Cancel ctx to stop early; its error is then sent.
+func (registry *Registry) StreamRepositories(ctx context.Context) (<-chan string, <-chan error) {
+	return stream(ctx, registry.ListRepositories(ListOptions{}).Next)
+}
+
+// withListOptions adds the `n` and `last` pagination parameters to u.
+func withListOptions(u string, opts ListOptions) string {
+	if opts.N <= 0 && opts.Last == "" {
+		return u
+	}
+
+	q := url.Values{}
+	if opts.N > 0 {
+		q.Set("n", strconv.Itoa(opts.N))
+	}
+	if opts.Last != "" {
+		q.Set("last", opts.Last)
+	}
+	return u + "?" + q.Encode()
+}
+
+// isHttpStatus reports whether err is, or wraps, an *HttpStatusError with the
+// given status code.
+func isHttpStatus(err error, status int) bool {
+	s, ok := httpStatus(err)
+	return ok && s == status
+}
+
+// httpStatus returns the status code of the *HttpStatusError err is or wraps.
+func httpStatus(err error) (int, bool) {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if he, ok := err.(*HttpStatusError); ok {
+		return he.Response.StatusCode, true
 	}
-	return true
+	return 0, false
 }
@@ -1,27 +1,143 @@
 package registry
 
+import (
+	"context"
+	"strings"
+)
+
 type tagsResponse struct {
 	Tags []string `json:"tags"`
 }
 
-func (registry *Registry) Tags(repository string) (tags []string, err error) {
-	url := registry.url("/v2/%s/tags/list", repository)
+// TagIterator lists the tags of a repository one at a time, fetching pages as
+// they are needed. Obtain one with ListTags.
+type TagIterator struct {
+	pager pager
+}
+
+// TagListOptions controls a filtered tag listing.
+type TagListOptions struct {
+	ListOptions
+
+	// Prefix limits the listing to tags that start with it. Every page is
+	// fetched and filtered, unless Seek is set.
+	Prefix string
 
-	registry.resetToken()
+	// Seek lets a Prefix listing skip to the first possible match with
+	// `last` and stop after the last match, instead of fetching every page.
+	// It relies on the registry returning tags in lexical order and
+	// honouring `last`, as Distribution does; registries that don't, such as
+	// ECR, would silently lose matches, so it is off by default.
+	Seek bool
+
+	// Filter, if set, is called for every tag within Prefix; only tags it
+	// returns true for are listed.
+	Filter func(tag string) bool
+}
+
+// ListTags returns an iterator over the tags of repository.
+func (registry *Registry) ListTags(repository string, opts ListOptions) *TagIterator {
+	return registry.listTags(repository, opts)
+}
+
+// ListTagsMatching returns an iterator over the tags of repository that match
+// opts.Prefix and opts.Filter.
+func (registry *Registry) ListTagsMatching(repository string, opts TagListOptions) *TagIterator {
+	listOpts := opts.ListOptions
+	if opts.Seek && opts.Prefix != "" && listOpts.Last < opts.Prefix {
+		listOpts.Last = tagSeek(opts.Prefix)
+	}
+
+	it := registry.listTags(repository, listOpts)
+	fetch := it.pager.fetch
+	it.pager.fetch = func(ctx context.Context) ([]string, error) {
+		tags, err := fetch(ctx)
+		if err != nil && err != ErrNoMorePages {
+			return nil, err
+		}
+
+		matching := tags[:0]
+		for _, tag := range tags {
+			if opts.Prefix != "" && !strings.HasPrefix(tag, opts.Prefix) {
+				if opts.Seek && tag > opts.Prefix {
+					// Past the end of the prefix range; nothing later can match.
+					return matching, ErrNoMorePages
+				}
+				continue
+			}
+			if opts.Filter != nil && !opts.Filter(tag) {
+				continue
+			}
+			matching = append(matching, tag)
+		}
+		return matching, err
+	}
+	return it
+}
+
+// tagSeek returns a `last` value that sorts after every valid tag smaller than
+// prefix and before prefix itself. Tags only use [A-Za-z0-9_.-], all of which
+// sort before '~'.
+func tagSeek(prefix string) string {
+	n := len(prefix) - 1
+	return prefix[:n] + string([]byte{prefix[n] - 1}) + "~"
+}
+
+// StreamTags sends the tags of repository that match opts on the first
+// channel and at most one error on the second; both are closed when the
+// listing ends. Cancel ctx to stop early; its error is then sent.
+func (registry *Registry) StreamTags(ctx context.Context, repository string, opts TagListOptions) (<-chan string, <-chan error) {
+	return stream(ctx, registry.ListTagsMatching(repository, opts).Next)
+}
+
+func (registry *Registry) listTags(repository string, opts ListOptions) *TagIterator {
+	url := withListOptions(registry.url("/v2/%s/tags/list", repository), opts)
+	started := false
+
+	it := &TagIterator{}
+	it.pager.fetch = func(ctx context.Context) ([]string, error) {
+		ctx, span := registry.startSpan(ctx, "registry.Tags", "repository", repository)
+		defer span.End()
+
+		if !started {
+			registry.resetToken()
+			started = true
+		}
+
+		var response tagsResponse
+		var err error
 
-	var response tagsResponse
-	for {
 		registry.Logf("registry.tags url=%s repository=%s", url, repository)
-		url, err = registry.getPaginatedJson(url, &response)
-		switch err {
-		case ErrNoMorePages:
-			tags = append(tags, response.Tags...)
-			return tags, nil
-		case nil:
-			tags = append(tags, response.Tags...)
-			continue
-		default:
+		url, err = registry.getPaginatedJson(ctx, url, &response)
+		if err != nil && err != ErrNoMorePages {
 			return nil, err
 		}
+		return response.Tags, err
+	}
+	return it
+}
+
+// Next returns the next tag, or ErrIteratorDone once every tag has been
+// returned. Errors are sticky: once Next fails it keeps failing.
+func (it *TagIterator) Next(ctx context.Context) (string, error) {
+	return it.pager.next(ctx)
+}
+
+// Last returns the most recent tag returned by Next. Passing it as
+// ListOptions.Last resumes the listing after that tag.
+func (it *TagIterator) Last() string {
+	return it.pager.last
+}
+
+func (registry *Registry) Tags(repository string) (tags []string, err error) {
+	return registry.TagsContext(context.Background(), repository)
+}
+
+// TagsContext is Tags with a context that can cancel the listing.
+func (registry *Registry) TagsContext(ctx context.Context, repository string) ([]string, error) {
+	tags, err := drain(ctx, registry.ListTags(repository, ListOptions{}).Next)
+	if err != nil {
+		return nil, err
 	}
+	return tags, nil
 }
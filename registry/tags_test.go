@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_StreamTags(t *testing.T) {
+	var tags []string
+	for i := 0; i < 30; i++ {
+		tags = append(tags, fmt.Sprintf("pr-%02d", i))
+	}
+	tags = append(tags, "v1.0.0", "v1.1.0", "v2.0.0")
+
+	// Some registries, such as ECR, list tags in no particular order.
+	unsorted := []string{"v1.1.0", "pr-03", "v2.0.0", "latest", "v1.0.0"}
+
+	tcs := []struct {
+		name     string
+		listed   []string
+		opts     TagListOptions
+		expected []string
+		maxCalls int
+	}{
+		{
+			name:     "all tags",
+			opts:     TagListOptions{ListOptions: ListOptions{N: 10}},
+			expected: tags,
+			maxCalls: 4,
+		},
+		{
+			name:     "prefix",
+			opts:     TagListOptions{ListOptions: ListOptions{N: 10}, Prefix: "pr-1"},
+			expected: tags[10:20],
+			maxCalls: 4,
+		},
+		{
+			name:     "prefix on an unsorted registry",
+			listed:   unsorted,
+			opts:     TagListOptions{Prefix: "v1"},
+			expected: []string{"v1.1.0", "v1.0.0"},
+			maxCalls: 1,
+		},
+		{
+			name:     "seeking prefix",
+			opts:     TagListOptions{ListOptions: ListOptions{N: 2}, Prefix: "pr-1", Seek: true},
+			expected: tags[10:20],
+			maxCalls: 6,
+		},
+		{
+			name:     "seeking prefix and filter",
+			opts:     TagListOptions{ListOptions: ListOptions{N: 5}, Prefix: "v1", Seek: true, Filter: func(tag string) bool { return strings.HasSuffix(tag, ".1.0") }},
+			expected: []string{"v1.1.0"},
+			maxCalls: 1,
+		},
+		{
+			name:     "resume within seeking prefix",
+			opts:     TagListOptions{ListOptions: ListOptions{N: 3, Last: "pr-27"}, Prefix: "pr-2", Seek: true},
+			expected: []string{"pr-28", "pr-29"},
+			maxCalls: 1,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			listed := tc.listed
+			if listed == nil {
+				listed = tags
+			}
+			calls := 0
+			handler := pagedHandler(t, "/v2/heroku/cedar/tags/list", "tags", listed)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				handler(w, r)
+			}))
+			defer server.Close()
+
+			r, err := NewWithTransport(server.URL, "", "", http.DefaultTransport)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tagChan, errChan := r.StreamTags(context.Background(), "heroku/cedar", tc.opts)
+			var got []string
+			for tag := range tagChan {
+				got = append(got, tag)
+			}
+			if err := <-errChan; err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+			if calls > tc.maxCalls {
+				t.Errorf("expected at most %d requests, got %d", tc.maxCalls, calls)
+			}
+		})
+	}
+}
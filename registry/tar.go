@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// tarArchive reads files from a tar file, optionally gzipped. A gzipped
+// archive is first decompressed into a temporary file, which Close removes.
+type tarArchive struct {
+	path      string
+	temporary bool
+}
+
+func openTarArchive(path string) (*tarArchive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	archive := &tarArchive{path: path}
+	content := bufio.NewReader(f)
+	if isGzip(content) {
+		if archive.path, err = gunzipToTemp(content); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		archive.temporary = true
+	}
+	return archive, nil
+}
+
+// isGzip reports whether r starts with the gzip magic number.
+func isGzip(r *bufio.Reader) bool {
+	magic, _ := r.Peek(2)
+	return len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+func gunzipToTemp(r io.Reader) (string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	f, err := ioutil.TempFile("", "archive-*.tar")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, gz); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Close removes the temporary file of a gzipped archive.
+func (archive *tarArchive) Close() error {
+	if archive.temporary {
+		return os.Remove(archive.path)
+	}
+	return nil
+}
+
+func (archive *tarArchive) readFile(name string) ([]byte, error) {
+	f, _, err := archive.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// open finds a file in the tar and returns its size. Each file is opened
+// separately, so several can be read at once; finding one only reads the
+// headers before it, since the tar reader seeks past the contents of the
+// others.
+func (archive *tarArchive) open(name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(archive.path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			f.Close()
+			return nil, 0, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		if header.FileInfo().Mode().IsRegular() && archivePath(header.Name) == name {
+			return archiveFile{Reader: tr, Closer: f}, header.Size, nil
+		}
+	}
+}
+
+// archivePath cleans a path in a tar, which may start with "./" or "/".
+func archivePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+type archiveFile struct {
+	io.Reader
+	io.Closer
+}
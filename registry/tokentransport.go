@@ -1,11 +1,13 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
 )
 
 type TokenTransport struct {
@@ -13,13 +15,16 @@ type TokenTransport struct {
 	Username  string
 	Password  string
 
+	// mu guards token and authService, so that a registry can be used from
+	// several goroutines.
+	mu          sync.Mutex
 	token       string
 	authService *authService
 }
 
 func (t *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if t.token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.token))
+	if token := t.currentToken(); token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	}
 	resp, err := t.Transport.RoundTrip(req)
 	if err != nil {
@@ -31,29 +36,56 @@ func (t *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 
 		resp, err = t.authAndRetry(authService, req)
+		t.mu.Lock()
 		t.authService = authService
+		t.mu.Unlock()
 	}
 	return resp, err
 }
 
+func (t *TokenTransport) currentToken() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.token
+}
+
+func (t *TokenTransport) setToken(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = token
+}
+
+// lastAuthService returns the token service of the last challenge, or nil.
+func (t *TokenTransport) lastAuthService() *authService {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.authService
+}
+
 type authToken struct {
 	Token       string `json:"token"`
 	AccessToken string `json:"access_token"`
 }
 
 func (t *TokenTransport) authAndRetry(authService *authService, req *http.Request) (*http.Response, error) {
-	token, authResp, err := t.auth(authService)
+	ctx, span := startChildSpan(req.Context(), "registry.token", "service", authService.Service, "scope", authService.Scope)
+	token, authResp, err := t.auth(withEndpoint(ctx, "token"), authService)
 	if err != nil {
+		span.RecordError(err)
+		span.End()
 		return authResp, err
 	}
+	span.End()
 
-	t.token = token
+	t.setToken(token)
 
-	retryResp, err := t.retry(req, token)
+	ctx, span = startChildSpan(req.Context(), "registry.retry")
+	defer span.End()
+	retryResp, err := t.retry(req.WithContext(ctx), token)
 	return retryResp, err
 }
 
-func (t *TokenTransport) auth(authService *authService) (string, *http.Response, error) {
+func (t *TokenTransport) auth(ctx context.Context, authService *authService) (string, *http.Response, error) {
 	client := http.Client{
 		Transport: t.Transport,
 	}
@@ -63,6 +95,7 @@ func (t *TokenTransport) auth(authService *authService) (string, *http.Response,
 	if err != nil {
 		return "", nil, err
 	}
+	authReq = authReq.WithContext(ctx)
 
 	response, err := client.Do(authReq)
 	if response != nil && response.Body != nil {
@@ -99,11 +132,32 @@ func (t *TokenTransport) auth(authService *authService) (string, *http.Response,
 }
 
 func (t *TokenTransport) retry(req *http.Request, token string) (*http.Response, error) {
+	req, err := rewind(req)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	resp, err := t.Transport.RoundTrip(req)
 	return resp, err
 }
 
+// rewind returns req with a fresh copy of its body, so it can be sent again
+// after a challenge. Bodies that can't be replayed, such as streamed blobs,
+// are sent as they are; they only succeed if the first attempt didn't read
+// them.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry := *req
+	retry.Body = body
+	return &retry, nil
+}
+
 type authService struct {
 	Realm   string
 	Service string
@@ -0,0 +1,518 @@
+package registry
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrUnsafePath is returned when a layer has an entry, symlink or hardlink
+// that would reach outside the directory it is unpacked into.
+var ErrUnsafePath = errors.New("path escapes the root")
+
+// errPrivileged is returned for entries that can only be created by root.
+var errPrivileged = errors.New("needs privileges")
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// UnpackOptions changes how Unpack and UnpackLayer work.
+type UnpackOptions struct {
+	// Platform selects the image to unpack from a manifest list or OCI
+	// index. It defaults to DefaultPlatform.
+	Platform Platform
+
+	// Privileged applies owners and creates device nodes, which needs root.
+	// Without it, everything belongs to the unpacking user and stays
+	// readable and writable by them, device nodes are skipped, and so are
+	// xattrs that can't be set.
+	Privileged bool
+}
+
+// UnpackResult describes what Unpack did.
+type UnpackResult struct {
+	Config *ImageConfig
+
+	// Skipped are the entries that weren't created because they need
+	// Privileged, such as device nodes.
+	Skipped []string
+}
+
+/*
+ * Unpack an image into a root filesystem at dir, much as `umoci unpack`
+ * does. The layers are downloaded and applied in order, gzip and zstd layers
+ * are decompressed, and whiteouts remove what earlier layers added. Entries
+ * are never written outside dir: symlinks among their parent directories are
+ * followed as if dir were the root, and entries, symlinks and hardlinks that
+ * would lead outside it fail the unpack with ErrUnsafePath. Each layer is
+ * verified against its digest and diff ID once it has been applied; if one
+ * doesn't match, the error wraps ErrDigestMismatch and dir shouldn't be
+ * trusted.
+ */
+func (registry *Registry) Unpack(ctx context.Context, reference, dir string, opts UnpackOptions) (*UnpackResult, error) {
+	ref, err := registry.ParseReference(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := registry.startSpan(ctx, "registry.Unpack", "reference", ref.String())
+	defer span.End()
+
+	platform := opts.Platform
+	if platform.OS == "" && platform.Architecture == "" {
+		platform = DefaultPlatform
+	}
+	raw, manifest, err := registry.resolveManifest(ctx, ref.Repository, ref.Reference(), platform)
+	if err != nil {
+		return nil, err
+	}
+	b, err := registry.fetchBlob(ctx, ref.Repository, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	config := &ImageConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("image config: %v", err)
+	}
+	config.Digest = manifest.Config.Digest
+	config.Manifest = Descriptor{MediaType: raw.MediaType, Digest: raw.Digest, Size: int64(len(raw.Payload))}
+	config.Layers = linkLayers(manifest.Layers, config.RootFS.DiffIDs, config.History)
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config lists %d layers, the manifest %d", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	u := &unpacker{root: dir, opts: opts}
+	for _, layer := range config.Layers {
+		if foreignLayerMediaTypes[layer.Descriptor.MediaType] {
+			return nil, fmt.Errorf("layer %s is a foreign layer, which can't be unpacked", layer.Descriptor.Digest)
+		}
+		registry.Logf("registry.unpack repository=%s digest=%s dir=%s", ref.Repository, layer.Descriptor.Digest, dir)
+		if err := registry.unpackLayer(ctx, u, ref.Repository, layer); err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("layer %s: %w", layer.Descriptor.Digest, err)
+		}
+	}
+	return &UnpackResult{Config: config, Skipped: u.skipped}, nil
+}
+
+func (registry *Registry) unpackLayer(ctx context.Context, u *unpacker, repository string, layer ImageLayer) error {
+	resp, err := registry.downloadLayer(ctx, repository, layer.Descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	blob := layer.Descriptor.Digest.Verifier()
+	diffID := layer.DiffID.Verifier()
+	content := bufio.NewReader(io.TeeReader(resp.Body, blob))
+	tarStream, err := decompress(content)
+	if err != nil {
+		return err
+	}
+	defer tarStream.Close()
+
+	if err := u.apply(io.TeeReader(tarStream, diffID)); err != nil {
+		return err
+	}
+
+	// Read what the tar reader left, such as padding, to finish the digests.
+	if _, err := io.Copy(diffID, tarStream); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, content); err != nil {
+		return err
+	}
+	if !blob.Verified() {
+		return fmt.Errorf("%w: blob %s", ErrDigestMismatch, layer.Descriptor.Digest)
+	}
+	if !diffID.Verified() {
+		return fmt.Errorf("%w: diff ID %s", ErrDigestMismatch, layer.DiffID)
+	}
+	return nil
+}
+
+/*
+ * Apply one layer, as DownloadLayer returns it, to a root filesystem at dir,
+ * as Unpack does, and return the entries that were skipped. Layers must be
+ * applied in order, each to the result of the ones before it.
+ */
+func UnpackLayer(dir string, layer io.Reader, opts UnpackOptions) ([]string, error) {
+	tarStream, err := decompress(bufio.NewReader(layer))
+	if err != nil {
+		return nil, err
+	}
+	defer tarStream.Close()
+
+	u := &unpacker{root: dir, opts: opts}
+	if err := u.apply(tarStream); err != nil {
+		return u.skipped, err
+	}
+	return u.skipped, nil
+}
+
+// decompress returns the tar stream of a layer, going by its magic number
+// rather than its media type, which registries don't always get right.
+func decompress(content *bufio.Reader) (io.ReadCloser, error) {
+	if isGzip(content) {
+		return gzip.NewReader(content)
+	}
+	if magic, _ := content.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		decoder, err := zstd.NewReader(content)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(content), nil
+}
+
+type unpacker struct {
+	root    string
+	opts    UnpackOptions
+	skipped []string
+}
+
+// apply extracts a layer's tar stream.
+func (u *unpacker) apply(r io.Reader) error {
+	tr := tar.NewReader(r)
+	added := map[string]bool{} // host paths written by this layer
+	var dirs []*tar.Header
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := entryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+
+		dir, base := path.Split(name)
+		switch {
+		case base == whiteoutOpaque:
+			err = u.removeOpaque(dir, added)
+		case strings.HasPrefix(base, whiteoutPrefix+whiteoutPrefix):
+			// Other aufs metadata, such as hardlink directories.
+		case strings.HasPrefix(base, whiteoutPrefix):
+			err = u.remove(dir, base[len(whiteoutPrefix):])
+		default:
+			var hostPath string
+			hostPath, err = u.extract(tr, header, name)
+			if hostPath != "" {
+				added[hostPath] = true
+				if header.Typeflag == tar.TypeDir {
+					dirs = append(dirs, header)
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	// Set the times of directories last, as their contents change them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		name, _ := entryName(dirs[i].Name)
+		hostPath, err := u.resolve(name)
+		if err != nil {
+			return err
+		}
+		// A later entry may have replaced the directory, possibly with a
+		// symlink that Chtimes would follow out of the root.
+		if info, err := os.Lstat(hostPath); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := os.Chtimes(hostPath, accessTime(dirs[i]), dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryName cleans the name of a tar entry into a path relative to the root,
+// which is empty for the root itself.
+func entryName(name string) (string, error) {
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// resolve returns the host path of name. Symlinks among its parent
+// directories are followed as if the root were the filesystem root, so that
+// they can't lead outside it; the last component isn't followed.
+func (u *unpacker) resolve(name string) (string, error) {
+	dir, base := path.Split(name)
+	resolved := "/"
+	remaining := strings.Split(dir, "/")
+	for links := 0; len(remaining) > 0; {
+		part := remaining[0]
+		remaining = remaining[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		hostPath := filepath.Join(u.root, filepath.FromSlash(next))
+		info, err := os.Lstat(hostPath)
+		if os.IsNotExist(err) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symlinks in %s", name)
+		}
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return filepath.Join(u.root, filepath.FromSlash(resolved), base), nil
+}
+
+// relative returns a host path relative to the root, or ErrUnsafePath if it
+// isn't within it.
+func (u *unpacker) relative(hostPath string) (string, error) {
+	rel, err := filepath.Rel(u.root, hostPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, hostPath)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// escapes reports whether a symlink at name pointing to target would lead
+// outside the root. Absolute targets are taken to be within the root, as they
+// are in a container.
+func escapes(name, target string) bool {
+	if path.IsAbs(target) {
+		return false
+	}
+	depth := strings.Count(path.Dir(name), "/")
+	if path.Dir(name) != "." {
+		depth++
+	}
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// remove deletes what a whiteout in dir hides.
+func (u *unpacker) remove(dir, hidden string) error {
+	if hidden == "" || hidden == "." || hidden == ".." || strings.Contains(hidden, "/") {
+		return fmt.Errorf("%w: whiteout of %q", ErrUnsafePath, hidden)
+	}
+	hostPath, err := u.resolve(path.Join(dir, hidden))
+	if err != nil {
+		return err
+	}
+	if rel, err := u.relative(hostPath); err != nil || rel == "." {
+		return fmt.Errorf("%w: whiteout of %s", ErrUnsafePath, path.Join(dir, hidden))
+	}
+	return os.RemoveAll(hostPath)
+}
+
+// removeOpaque empties a directory of everything that this layer didn't add.
+func (u *unpacker) removeOpaque(dir string, added map[string]bool) error {
+	hostDir, err := u.resolve(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(hostDir, func(hostPath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || hostPath == hostDir || added[hostPath] {
+			return err
+		}
+		if err := os.RemoveAll(hostPath); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// extract creates one entry and returns its host path, which is empty for
+// entries that were skipped.
+func (u *unpacker) extract(content io.Reader, header *tar.Header, name string) (string, error) {
+	hostPath, err := u.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return "", err
+	}
+
+	// Replace whatever is there, except a directory with a directory.
+	if info, err := os.Lstat(hostPath); err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(hostPath); err != nil {
+			return "", err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(hostPath, 0700); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+
+	case tar.TypeReg:
+		f, err := os.OpenFile(hostPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(f, content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", err
+		}
+
+	case tar.TypeSymlink:
+		// Judge the link by where it ends up, as its parents may be symlinks.
+		rel, err := u.relative(hostPath)
+		if err != nil {
+			return "", err
+		}
+		if escapes(rel, header.Linkname) {
+			return "", fmt.Errorf("%w: symlink to %s", ErrUnsafePath, header.Linkname)
+		}
+		if err := os.Symlink(header.Linkname, hostPath); err != nil {
+			return "", err
+		}
+
+	case tar.TypeLink:
+		target, err := entryName(header.Linkname)
+		if err != nil {
+			return "", err
+		}
+		hostTarget, err := u.resolve(target)
+		if err != nil {
+			return "", err
+		}
+		// The link shares its target's metadata, which is already set.
+		return hostPath, os.Link(hostTarget, hostPath)
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		err := mknod(hostPath, header, u.opts.Privileged)
+		if errors.Is(err, errPrivileged) {
+			u.skipped = append(u.skipped, name)
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+	default:
+		return "", nil
+	}
+	return hostPath, u.setMetadata(hostPath, header)
+}
+
+// setMetadata applies an entry's owner, mode, xattrs and times. The owner
+// goes first, since changing it clears setuid bits and capabilities.
+func (u *unpacker) setMetadata(hostPath string, header *tar.Header) error {
+	if u.opts.Privileged {
+		if err := os.Lchown(hostPath, header.Uid, header.Gid); err != nil {
+			return err
+		}
+	}
+
+	if header.Typeflag != tar.TypeSymlink {
+		mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if !u.opts.Privileged {
+			mode |= 0600
+			if header.Typeflag == tar.TypeDir {
+				mode |= 0700
+			}
+		}
+		if err := os.Chmod(hostPath, mode); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, "SCHILY.xattr.") {
+			continue
+		}
+		err := lsetxattr(hostPath, strings.TrimPrefix(key, "SCHILY.xattr."), []byte(value))
+		if err != nil && u.opts.Privileged && !errors.Is(err, errUnsupportedXattr) {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// Set once the directory is complete.
+		return nil
+	case tar.TypeSymlink:
+		return lchtimes(hostPath, accessTime(header), header.ModTime)
+	default:
+		return os.Chtimes(hostPath, accessTime(header), header.ModTime)
+	}
+}
+
+func accessTime(header *tar.Header) time.Time {
+	if header.AccessTime.IsZero() {
+		return header.ModTime
+	}
+	return header.AccessTime
+}
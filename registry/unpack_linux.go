@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package registry
+
+import (
+	"archive/tar"
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errUnsupportedXattr = unix.ENOTSUP
+
+// mknod creates a device node or fifo. Device nodes need privileges.
+func mknod(hostPath string, header *tar.Header, privileged bool) error {
+	var mode uint32
+	switch header.Typeflag {
+	case tar.TypeFifo:
+		mode = unix.S_IFIFO
+	case tar.TypeChar:
+		mode = unix.S_IFCHR
+	case tar.TypeBlock:
+		mode = unix.S_IFBLK
+	}
+	if mode != unix.S_IFIFO && !privileged {
+		return errPrivileged
+	}
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	err := unix.Mknod(hostPath, mode|0600, int(dev))
+	if errors.Is(err, unix.EPERM) {
+		return errPrivileged
+	}
+	return err
+}
+
+func lsetxattr(hostPath, name string, value []byte) error {
+	return unix.Lsetxattr(hostPath, name, value, 0)
+}
+
+// lchtimes sets the times of a symlink itself.
+func lchtimes(hostPath string, atime, mtime time.Time) error {
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, hostPath, times, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package registry
+
+import (
+	"archive/tar"
+	"errors"
+	"time"
+)
+
+var errUnsupportedXattr = errors.New("xattrs are only supported on Linux")
+
+// mknod skips device nodes and fifos, which are only created on Linux.
+func mknod(hostPath string, header *tar.Header, privileged bool) error {
+	return errPrivileged
+}
+
+func lsetxattr(hostPath, name string, value []byte) error {
+	return errUnsupportedXattr
+}
+
+// lchtimes leaves the times of symlinks alone.
+func lchtimes(hostPath string, atime, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,254 @@
+package registry_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type layerEntry struct {
+	header  tar.Header
+	content string
+}
+
+func layerFile(name, content string) layerEntry {
+	return layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))}, content}
+}
+
+func layerLink(typeflag byte, name, target string) layerEntry {
+	return layerEntry{header: tar.Header{Typeflag: typeflag, Name: name, Linkname: target, Mode: 0777}}
+}
+
+// buildLayer returns a layer tarball, compressed as compression says, and its
+// diff ID.
+func buildLayer(t *testing.T, compression string, entries ...layerEntry) ([]byte, digest.Digest) {
+	var uncompressed bytes.Buffer
+	tw := tar.NewWriter(&uncompressed)
+	for _, entry := range entries {
+		header := entry.header
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(entry.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	switch compression {
+	case "gzip":
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(uncompressed.Bytes())
+		gz.Close()
+	case "zstd":
+		zw, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write(uncompressed.Bytes())
+		zw.Close()
+	default:
+		compressed = uncompressed
+	}
+	return compressed.Bytes(), digest.FromBytes(uncompressed.Bytes())
+}
+
+// pushTestLayers stores an image made of layers as repo:tag.
+func pushTestLayers(t *testing.T, m *memoryRegistry, repo, tag string, layers [][]byte, diffIDs []digest.Digest) {
+	config := mustJSON(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	descriptors := []interface{}{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, map[string]interface{}{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": m.putBlob(repo, layer), "size": len(layer)})
+	}
+	manifest := mustJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": m.putBlob(repo, config), "size": len(config)},
+		"layers":        descriptors,
+	})
+	m.putManifest(repo, tag, "application/vnd.oci.image.manifest.v1+json", manifest)
+}
+
+func Test_Unpack(t *testing.T) {
+	base, baseID := buildLayer(t, "",
+		layerEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755}},
+		layerFile("etc/passwd", "root:x:0:0"),
+		layerFile("etc/hosts", "127.0.0.1 localhost"),
+		layerEntry{tar.Header{Typeflag: tar.TypeReg, Name: "bin/sh", Mode: 0755, Size: 2}, "sh"},
+		layerLink(tar.TypeLink, "bin/bash", "bin/sh"),
+		layerLink(tar.TypeSymlink, "lib", "usr/lib"),
+		layerFile("cache/old", "stale"),
+		layerEntry{header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3}},
+	)
+	middle, middleID := buildLayer(t, "gzip",
+		layerFile("etc/.wh.passwd", ""),
+		layerFile("cache/new", "fresh"),
+		layerFile("cache/.wh..wh..opq", ""),
+		layerLink(tar.TypeSymlink, "root", "/"),
+		layerFile("root/etc/motd", "hello"),
+	)
+	top, topID := buildLayer(t, "zstd", layerFile("bin/sh", "new sh"))
+
+	m := newMemoryRegistry(t)
+	pushTestLayers(t, m, "app", "v1", [][]byte{base, middle, top}, []digest.Digest{baseID, middleID, topID})
+	pushTestLayers(t, m, "app", "corrupt", [][]byte{base}, []digest.Digest{topID})
+	reg, done := newCatalogTestRegistry(t, m.ServeHTTP, nil)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "rootfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	result, err := reg.Unpack(context.Background(), "app:v1", dir, registry.UnpackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Config.Layers) != 3 || len(result.Skipped) != 1 || result.Skipped[0] != "dev/null" {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	expected := map[string]string{
+		"etc/hosts": "127.0.0.1 localhost",
+		"etc/motd":  "hello",
+		"cache/new": "fresh",
+		"bin/sh":    "new sh",
+		"bin/bash":  "sh",
+	}
+	for name, content := range expected {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != content {
+			t.Errorf("%s: expected %q, got %q, %v", name, content, b, err)
+		}
+	}
+	for _, name := range []string{"etc/passwd", "cache/old", "cache/.wh..wh..opq", "dev/null"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed: %v", name, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "lib")); err != nil || target != "usr/lib" {
+		t.Errorf("unexpected lib symlink %q, %v", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "bin/bash")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("unexpected bin/bash mode %v, %v", info, err)
+	}
+
+	t.Run("corrupt layers are rejected", func(t *testing.T) {
+		corruptDir, err := ioutil.TempDir("", "rootfs-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(corruptDir)
+
+		_, err = reg.Unpack(context.Background(), "app:corrupt", corruptDir, registry.UnpackOptions{})
+		if !errors.Is(err, registry.ErrDigestMismatch) {
+			t.Errorf("expected a digest mismatch, got %v", err)
+		}
+	})
+}
+
+func Test_UnpackLayer_UnsafePaths(t *testing.T) {
+	cases := map[string][]layerEntry{
+		"traversal":         {layerFile("lib/../../escape", "x")},
+		"escaping symlink":  {layerLink(tar.TypeSymlink, "etc/bad", "../../escape")},
+		"escaping hardlink": {layerLink(tar.TypeLink, "bad", "../escape")},
+		"symlink escaping through a symlinked parent": {
+			layerLink(tar.TypeSymlink, "a", "."),
+			layerLink(tar.TypeSymlink, "a/b/link", "../../escape"),
+		},
+		"whiteout of the parent": {layerFile(".wh..", "")},
+		"whiteout of the root":   {layerFile("a/.wh..", "")},
+		"empty whiteout":         {layerFile("a/.wh.", "")},
+	}
+	for name, entries := range cases {
+		t.Run(name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "unpack-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+			ioutil.WriteFile(filepath.Join(parent, "escape"), []byte("outside"), 0644)
+			dir := filepath.Join(parent, "rootfs")
+			os.Mkdir(dir, 0755)
+
+			layer, _ := buildLayer(t, "", entries...)
+			_, err = registry.UnpackLayer(dir, bytes.NewReader(layer), registry.UnpackOptions{})
+			if !errors.Is(err, registry.ErrUnsafePath) {
+				t.Errorf("expected ErrUnsafePath, got %v", err)
+			}
+			if b, _ := ioutil.ReadFile(filepath.Join(parent, "escape")); string(b) != "outside" {
+				t.Error("a file outside the root was changed")
+			}
+			if _, err := os.Stat(dir); err != nil {
+				t.Errorf("the root was removed: %v", err)
+			}
+		})
+	}
+
+	t.Run("symlinked parents stay within the root", func(t *testing.T) {
+		parent, err := ioutil.TempDir("", "unpack-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(parent)
+		dir := filepath.Join(parent, "rootfs")
+		os.Mkdir(dir, 0755)
+
+		layer, _ := buildLayer(t, "",
+			layerLink(tar.TypeSymlink, "up", "/.."),
+			layerFile("up/escape", "inside"),
+		)
+		if _, err := registry.UnpackLayer(dir, bytes.NewReader(layer), registry.UnpackOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "escape")); !os.IsNotExist(err) {
+			t.Error("a file was written outside the root")
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, "escape")); string(b) != "inside" {
+			t.Error("the file wasn't written within the root")
+		}
+	})
+
+	t.Run("directory times stay within the root", func(t *testing.T) {
+		parent, err := ioutil.TempDir("", "unpack-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(parent)
+		victim := filepath.Join(parent, "victim")
+		os.Mkdir(victim, 0755)
+		before, _ := os.Stat(victim)
+		dir := filepath.Join(parent, "rootfs")
+		os.Mkdir(dir, 0755)
+
+		// The directory is replaced by a symlink to a host directory before
+		// its times are set.
+		layer, _ := buildLayer(t, "",
+			layerEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755, ModTime: time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC)}},
+			layerLink(tar.TypeSymlink, "a", victim),
+		)
+		if _, err := registry.UnpackLayer(dir, bytes.NewReader(layer), registry.UnpackOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if after, err := os.Stat(victim); err != nil || !after.ModTime().Equal(before.ModTime()) {
+			t.Errorf("the times of a directory outside the root were changed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+)
+
+/*
+ * Policy decides which tags of some repositories to delete. It manages the
+ * tags matching Tags, and deletes those that aren't kept for one of these
+ * reasons:
+ *
+ *  - they match Keep;
+ *  - they are among the KeepLast most recently built, going by the created
+ *    time in their image config;
+ *  - they were built less than OlderThan ago.
+ *
+ * At least one of KeepLast and OlderThan must be set. Tags whose build time
+ * can't be found out are kept.
+ *
+ * Deleting a manifest deletes every tag that points to it, so a manifest is
+ * only deleted when all of its tags are to be deleted: a digest referenced by
+ * a kept or unmanaged tag is protected, as are the images listed by a
+ * protected index.
+ */
+type Policy struct {
+	// Repositories are repository names or path.Match patterns, such as
+	// "ci/*", matched against the registry's catalog.
+	Repositories []string
+
+	// Tags are regular expressions for the tags the policy manages. When
+	// empty, it manages every tag.
+	Tags []string
+
+	// Keep are regular expressions for tags that are never deleted, such as
+	// `^v\d+\.\d+\.\d+$` or `^latest$`. They don't count towards KeepLast.
+	Keep []string
+
+	KeepLast  int
+	OlderThan time.Duration
+}
+
+type compiledPolicy struct {
+	Policy
+	tags []*regexp.Regexp
+	keep []*regexp.Regexp
+}
+
+func compilePolicy(policy Policy) (*compiledPolicy, error) {
+	if len(policy.Repositories) == 0 {
+		return nil, errors.New("no repositories")
+	}
+	for _, pattern := range policy.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+	}
+	if policy.KeepLast <= 0 && policy.OlderThan <= 0 {
+		return nil, errors.New("one of KeepLast and OlderThan must be set")
+	}
+
+	compiled := &compiledPolicy{Policy: policy}
+	var err error
+	if compiled.tags, err = compileAll(policy.Tags); err != nil {
+		return nil, err
+	}
+	if compiled.keep, err = compileAll(policy.Keep); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+func compileAll(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// matchRepository reports whether the policy governs repository.
+func (policy *compiledPolicy) matchRepository(repository string) bool {
+	for _, pattern := range policy.Repositories {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *compiledPolicy) manages(tag string) bool {
+	return len(policy.tags) == 0 || firstMatch(policy.tags, tag) != nil
+}
+
+func firstMatch(res []*regexp.Regexp, s string) *regexp.Regexp {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return re
+		}
+	}
+	return nil
+}
@@ -0,0 +1,554 @@
+// Package retention deletes old tags from a registry. A Retention plans what
+// its policies would delete, which can be reviewed as a dry run, and then
+// executes the plan, deleting manifests a few at a time.
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultConcurrency is how many requests a Retention makes at once when
+// Concurrency isn't set.
+const DefaultConcurrency = 4
+
+// Retention applies Policies to the repositories of Registry.
+type Retention struct {
+	Registry *registry.Registry
+
+	// Policies are tried in order; each repository is governed by the first
+	// one that names it.
+	Policies []Policy
+
+	// Concurrency limits how many requests are made at once, both to look up
+	// tags while planning and to delete manifests.
+	Concurrency int
+
+	Logf registry.LogfCallback
+}
+
+// Plan is what a Retention would delete. It can be serialized to review it
+// before calling Execute.
+type Plan struct {
+	Created      time.Time        `json:"created"`
+	Repositories []RepositoryPlan `json:"repositories"`
+}
+
+// RepositoryPlan is what would happen to one repository's tags.
+type RepositoryPlan struct {
+	Repository string     `json:"repository"`
+	Delete     []Deletion `json:"delete,omitempty"`
+	Keep       []Kept     `json:"keep,omitempty"`
+
+	// Error is set when the repository's tags couldn't all be looked up.
+	// Nothing is deleted from it then, since any tag might protect a
+	// manifest.
+	Error string `json:"error,omitempty"`
+}
+
+// Deletion is a manifest to delete, along with every tag pointing to it.
+type Deletion struct {
+	Digest  digest.Digest `json:"digest"`
+	Tags    []string      `json:"tags"`
+	Created *time.Time    `json:"created,omitempty"`
+}
+
+// Kept is a tag that is kept, and why.
+type Kept struct {
+	Tag     string        `json:"tag"`
+	Digest  digest.Digest `json:"digest"`
+	Created *time.Time    `json:"created,omitempty"`
+	Reason  string        `json:"reason"`
+}
+
+// Deletions counts the manifests the plan would delete.
+func (p *Plan) Deletions() int {
+	n := 0
+	for _, repository := range p.Repositories {
+		n += len(repository.Delete)
+	}
+	return n
+}
+
+// Report is the result of executing a plan.
+type Report struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Freed    []Result  `json:"freed"`
+	Failed   []Result  `json:"failed,omitempty"`
+}
+
+// Result is what happened to one planned deletion.
+type Result struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Tags       []string      `json:"tags"`
+	Error      string        `json:"error,omitempty"`
+}
+
+func (r *Retention) concurrency() int {
+	if r.Concurrency > 0 {
+		return r.Concurrency
+	}
+	return DefaultConcurrency
+}
+
+func (r *Retention) logf(format string, args ...interface{}) {
+	if r.Logf != nil {
+		r.Logf(format, args...)
+	}
+}
+
+/*
+ * Work out what the policies would delete, without deleting anything. An
+ * error is only returned if a policy is invalid, the catalog can't be listed
+ * or ctx is cancelled; problems with a repository are recorded in its plan.
+ */
+func (r *Retention) Plan(ctx context.Context) (*Plan, error) {
+	var policies []*compiledPolicy
+	for i, policy := range r.Policies {
+		compiled, err := compilePolicy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("policy %d: %v", i, err)
+		}
+		policies = append(policies, compiled)
+	}
+
+	repositories, err := r.repositories(ctx, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Created: time.Now().UTC()}
+	for _, repository := range repositories {
+		for _, policy := range policies {
+			if policy.matchRepository(repository) {
+				plan.Repositories = append(plan.Repositories, r.planRepository(ctx, policy, repository))
+				break
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// repositories returns the repositories the policies name, listing the
+// catalog only if a policy uses a pattern.
+func (r *Retention) repositories(ctx context.Context, policies []*compiledPolicy) ([]string, error) {
+	seen := map[string]bool{}
+	var repositories []string
+	add := func(repository string) {
+		if !seen[repository] {
+			seen[repository] = true
+			repositories = append(repositories, repository)
+		}
+	}
+
+	var patterns []string
+	for _, policy := range policies {
+		for _, repository := range policy.Repositories {
+			if strings.ContainsAny(repository, "*?[\\") {
+				patterns = append(patterns, repository)
+			} else {
+				add(repository)
+			}
+		}
+	}
+
+	if len(patterns) > 0 {
+		it := r.Registry.ListRepositoriesMatching(registry.RepositoryListOptions{Include: patterns})
+		for {
+			repository, err := it.Next(ctx)
+			if err == registry.ErrIteratorDone {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			add(repository)
+		}
+	}
+
+	sort.Strings(repositories)
+	return repositories, nil
+}
+
+// tagInfo is what planning finds out about a tag.
+type tagInfo struct {
+	tag     string
+	digest  digest.Digest
+	created *time.Time
+	err     error
+}
+
+func (r *Retention) planRepository(ctx context.Context, policy *compiledPolicy, repository string) RepositoryPlan {
+	plan := RepositoryPlan{Repository: repository}
+
+	tags, err := r.Registry.TagsContext(ctx, repository)
+	if err != nil {
+		plan.Error = err.Error()
+		return plan
+	}
+	sort.Strings(tags)
+
+	infos := make([]tagInfo, len(tags))
+	r.forEach(ctx, len(tags), func(i int) {
+		infos[i] = r.lookupTag(ctx, repository, tags[i], policy.manages(tags[i]))
+	})
+	if err := ctx.Err(); err != nil {
+		plan.Error = err.Error()
+		return plan
+	}
+	for _, info := range infos {
+		if info.err != nil {
+			plan.Error = fmt.Sprintf("%s: %v", info.tag, info.err)
+			return plan
+		}
+	}
+
+	// Decide each tag on its own merits.
+	var managed []*tagInfo
+	var candidates []*tagInfo
+	keep := func(info *tagInfo, reason string) {
+		plan.Keep = append(plan.Keep, Kept{Tag: info.tag, Digest: info.digest, Created: info.created, Reason: reason})
+	}
+	for i := range infos {
+		info := &infos[i]
+		switch {
+		case !policy.manages(info.tag):
+			keep(info, "not managed by the policy")
+		case firstMatch(policy.keep, info.tag) != nil:
+			keep(info, fmt.Sprintf("matches %s", firstMatch(policy.keep, info.tag)))
+		case info.created == nil:
+			keep(info, "build time unknown")
+		default:
+			managed = append(managed, info)
+		}
+	}
+
+	// Most recently built first; ties broken by tag for a stable plan.
+	sort.SliceStable(managed, func(i, j int) bool {
+		if !managed[i].created.Equal(*managed[j].created) {
+			return managed[i].created.After(*managed[j].created)
+		}
+		return managed[i].tag > managed[j].tag
+	})
+	for i, info := range managed {
+		switch {
+		case i < policy.KeepLast:
+			keep(info, fmt.Sprintf("one of the %d most recent", policy.KeepLast))
+		case policy.OlderThan > 0 && time.Since(*info.created) < policy.OlderThan:
+			keep(info, fmt.Sprintf("built less than %s ago", policy.OlderThan))
+		default:
+			candidates = append(candidates, info)
+		}
+	}
+	if len(candidates) == 0 {
+		sortKept(plan.Keep)
+		return plan
+	}
+
+	protected, err := r.protectedDigests(ctx, repository, plan.Keep)
+	if err != nil {
+		plan.Error = err.Error()
+		plan.Keep = nil
+		return plan
+	}
+
+	deletions := map[digest.Digest]*Deletion{}
+	for _, info := range candidates {
+		if by, ok := protected[info.digest]; ok {
+			keep(info, fmt.Sprintf("manifest is protected by %s", by))
+			continue
+		}
+		deletion, ok := deletions[info.digest]
+		if !ok {
+			deletion = &Deletion{Digest: info.digest, Created: info.created}
+			deletions[info.digest] = deletion
+		}
+		deletion.Tags = append(deletion.Tags, info.tag)
+	}
+	for _, deletion := range deletions {
+		sort.Strings(deletion.Tags)
+		plan.Delete = append(plan.Delete, *deletion)
+	}
+	sort.Slice(plan.Delete, func(i, j int) bool {
+		return plan.Delete[i].Digest < plan.Delete[j].Digest
+	})
+	sortKept(plan.Keep)
+	return plan
+}
+
+// lookupTag finds out a tag's digest and, for managed tags, when its image
+// was built.
+func (r *Retention) lookupTag(ctx context.Context, repository, tag string, managed bool) tagInfo {
+	info := tagInfo{tag: tag}
+	info.digest, info.err = r.Registry.ManifestDigestContext(ctx, repository, tag)
+	if info.err != nil || !managed {
+		return info
+	}
+	info.created, info.err = r.created(ctx, repository, tag, info.digest)
+	return info
+}
+
+// created returns when the image at dgst was built. For an index, that's when
+// the newest of its images was built, so that the plan doesn't depend on the
+// platform it's made on. Schema 1 manifests, artifacts and indexes of them
+// have no build time to go by, and nil is returned for them.
+func (r *Retention) created(ctx context.Context, repository, tag string, dgst digest.Digest) (*time.Time, error) {
+	children, err := r.indexChildren(ctx, repository, dgst)
+	if err != nil {
+		return nil, r.unknownCreated(ctx, repository, tag, dgst, err)
+	}
+	if children == nil {
+		children = []digest.Digest{dgst}
+	}
+
+	var newest *time.Time
+	for _, child := range children {
+		// The platform only matters for indexes nested in the index, which
+		// are rare.
+		config, err := r.Registry.ImageConfigForPlatformContext(ctx, repository, child.String(), registry.DefaultPlatform)
+		if err != nil {
+			if err := r.unknownCreated(ctx, repository, tag, child, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if config.Created != nil && (newest == nil || config.Created.After(*newest)) {
+			newest = config.Created
+		}
+	}
+	return newest, nil
+}
+
+// unknownCreated logs why a build time couldn't be found, which leaves the tag
+// kept, unless that's because ctx was cancelled; then it returns ctx's error.
+func (r *Retention) unknownCreated(ctx context.Context, repository, tag string, dgst digest.Digest, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	r.logf("retention.created repository=%s tag=%s digest=%s err=%v", repository, tag, dgst, err)
+	return nil
+}
+
+// protectedDigests returns the manifests that kept tags point to, directly or
+// through an index, mapped to a tag that protects them.
+func (r *Retention) protectedDigests(ctx context.Context, repository string, kept []Kept) (map[digest.Digest]string, error) {
+	protected := map[digest.Digest]string{}
+	var digests []digest.Digest
+	for _, k := range kept {
+		if _, ok := protected[k.Digest]; !ok {
+			protected[k.Digest] = k.Tag
+			digests = append(digests, k.Digest)
+		}
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	r.forEach(ctx, len(digests), func(i int) {
+		children, err := r.indexChildren(ctx, repository, digests[i])
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		for _, child := range children {
+			if _, ok := protected[child]; !ok {
+				protected[child] = protected[digests[i]]
+			}
+		}
+	})
+	if firstErr == nil {
+		// Tags left unchecked could protect anything.
+		firstErr = ctx.Err()
+	}
+	return protected, firstErr
+}
+
+// indexChildren returns the manifests an index lists, or nil if dgst isn't an
+// index.
+func (r *Retention) indexChildren(ctx context.Context, repository string, dgst digest.Digest) ([]digest.Digest, error) {
+	raw, err := r.Registry.ManifestRawContext(ctx, repository, dgst.String())
+	if err != nil {
+		return nil, err
+	}
+	if raw.MediaType != registry.MediaTypeManifestList && raw.MediaType != registry.MediaTypeOCIIndex {
+		return nil, nil
+	}
+
+	var index struct {
+		Manifests []registry.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw.Payload, &index); err != nil {
+		return nil, err
+	}
+	children := make([]digest.Digest, 0, len(index.Manifests))
+	for _, descriptor := range index.Manifests {
+		children = append(children, descriptor.Digest)
+	}
+	return children, nil
+}
+
+/*
+ * Delete the manifests in plan, up to Concurrency at a time. Before each one
+ * is deleted, its tags are checked to still point to it, and the repository's
+ * other tags to still not protect it, directly or through an index, so that
+ * nothing pushed since planning is lost. Failures are recorded in the report;
+ * an error is only returned if ctx is cancelled.
+ */
+func (r *Retention) Execute(ctx context.Context, plan *Plan) (*Report, error) {
+	report := &Report{Started: time.Now().UTC()}
+
+	type job struct {
+		repository string
+		deletion   Deletion
+	}
+	var jobs []job
+	for _, repository := range plan.Repositories {
+		for _, deletion := range repository.Delete {
+			jobs = append(jobs, job{repository.Repository, deletion})
+		}
+	}
+
+	var mu sync.Mutex
+	r.forEach(ctx, len(jobs), func(i int) {
+		result := Result{Repository: jobs[i].repository, Digest: jobs[i].deletion.Digest, Tags: jobs[i].deletion.Tags}
+		if err := r.delete(ctx, jobs[i].repository, jobs[i].deletion); err != nil {
+			r.logf("retention.delete repository=%s digest=%s err=%v", result.Repository, result.Digest, err)
+			result.Error = err.Error()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if result.Error != "" {
+			report.Failed = append(report.Failed, result)
+		} else {
+			report.Freed = append(report.Freed, result)
+		}
+	})
+
+	sortResults(report.Freed)
+	sortResults(report.Failed)
+	report.Finished = time.Now().UTC()
+	return report, ctx.Err()
+}
+
+// ErrTagMoved is recorded when the tags have changed since planning: a
+// planned tag no longer points to the manifest, or another tag now protects
+// it.
+var ErrTagMoved = errors.New("tag no longer points to the planned manifest")
+
+func (r *Retention) delete(ctx context.Context, repository string, deletion Deletion) error {
+	planned := map[string]bool{}
+	for _, tag := range deletion.Tags {
+		planned[tag] = true
+		current, err := r.Registry.ManifestDigestContext(ctx, repository, tag)
+		if err != nil {
+			return err
+		}
+		if current != deletion.Digest {
+			return fmt.Errorf("%s: %w", tag, ErrTagMoved)
+		}
+	}
+
+	// Deleting by digest also deletes tags pushed onto it since, and breaks
+	// indexes that now list it.
+	tags, err := r.Registry.TagsContext(ctx, repository)
+	if err != nil {
+		return err
+	}
+	checked := map[digest.Digest]bool{deletion.Digest: true}
+	for _, tag := range tags {
+		if planned[tag] {
+			continue
+		}
+		current, err := r.Registry.ManifestDigestContext(ctx, repository, tag)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if current == deletion.Digest {
+			return fmt.Errorf("%s now points to the manifest: %w", tag, ErrTagMoved)
+		}
+		if checked[current] {
+			continue
+		}
+		checked[current] = true
+
+		children, err := r.indexChildren(ctx, repository, current)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if child == deletion.Digest {
+				return fmt.Errorf("%s now lists the manifest: %w", tag, ErrTagMoved)
+			}
+		}
+	}
+
+	r.logf("retention.delete repository=%s digest=%s tags=%s", repository, deletion.Digest, strings.Join(deletion.Tags, ","))
+	return r.Registry.DeleteManifestContext(ctx, repository, deletion.Digest)
+}
+
+func isNotFound(err error) bool {
+	var statusErr *registry.HttpStatusError
+	return errors.As(err, &statusErr) && statusErr.Response.StatusCode == http.StatusNotFound
+}
+
+// forEach calls f for 0 through n-1, at most Concurrency at a time, and
+// stops starting new calls once ctx is cancelled.
+func (r *Retention) forEach(ctx context.Context, n int, f func(i int)) {
+	sem := make(chan struct{}, r.concurrency())
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func sortKept(kept []Kept) {
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Tag < kept[j].Tag
+	})
+}
+
+func sortResults(results []Result) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Repository != results[j].Repository {
+			return results[i].Repository < results[j].Repository
+		}
+		return results[i].Digest < results[j].Digest
+	})
+}
@@ -0,0 +1,231 @@
+package retention_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/internal/registrytest"
+	"github.com/heroku/docker-registry-client/registry"
+	"github.com/heroku/docker-registry-client/retention"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func Test_Retention(t *testing.T) {
+	f, reg, done := registrytest.New(t)
+	defer done()
+	now := time.Now()
+
+	day := 24 * time.Hour
+	ci1 := f.Push("ci/app", "ci-1", now.Add(-5*day))
+	ci2 := f.Push("ci/app", "ci-2", now.Add(-4*day))
+	ci3 := f.Push("ci/app", "ci-3", now.Add(-3*day))
+	f.Push("ci/app", "ci-4", now.Add(-2*day))
+	f.Push("ci/app", "ci-5", now.Add(-day))
+	f.Push("ci/app", "ci-6", now.Add(-time.Hour))
+	f.Push("ci/app", "ci-release-1", now.Add(-100*day))
+	f.Tag("ci/app", "latest", ci1)
+	f.PushIndex("ci/app", "stable", ci2)
+	f.Push("other/app", "ci-1", now.Add(-100*day))
+
+	r := &retention.Retention{
+		Registry: reg,
+		Policies: []retention.Policy{{
+			Repositories: []string{"ci/*"},
+			Tags:         []string{"^ci-"},
+			Keep:         []string{`^ci-release-`},
+			KeepLast:     2,
+			OlderThan:    60 * time.Hour,
+		}},
+		Concurrency: 3,
+	}
+
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Repositories) != 1 || plan.Repositories[0].Repository != "ci/app" {
+		t.Fatalf("expected a plan for ci/app only, got %+v", plan.Repositories)
+	}
+	repository := plan.Repositories[0]
+	if repository.Error != "" {
+		t.Fatal(repository.Error)
+	}
+
+	// ci-5 and ci-6 are the two most recent and ci-4 is too young; ci-1 is
+	// also latest and ci-2 is in the stable index, so only ci-3 goes.
+	expected := []retention.Deletion{{Digest: ci3, Tags: []string{"ci-3"}}}
+	for i := range repository.Delete {
+		repository.Delete[i].Created = nil
+	}
+	if !reflect.DeepEqual(repository.Delete, expected) {
+		t.Errorf("expected to delete %+v, got %+v", expected, repository.Delete)
+	}
+	reasons := map[string]string{}
+	for _, kept := range repository.Keep {
+		reasons[kept.Tag] = kept.Reason
+	}
+	for tag, reason := range map[string]string{
+		"ci-1":         "manifest is protected by latest",
+		"ci-2":         "manifest is protected by stable",
+		"ci-4":         "built less than 60h0m0s ago",
+		"ci-5":         "one of the 2 most recent",
+		"ci-6":         "one of the 2 most recent",
+		"ci-release-1": "matches ^ci-release-",
+		"latest":       "not managed by the policy",
+		"stable":       "not managed by the policy",
+	} {
+		if reasons[tag] != reason {
+			t.Errorf("%s: expected reason %q, got %q", tag, reason, reasons[tag])
+		}
+	}
+	if _, err := json.Marshal(plan); err != nil {
+		t.Error(err)
+	}
+
+	// Planning is a dry run.
+	if len(f.Deleted) != 0 {
+		t.Fatalf("planning deleted %v", f.Deleted)
+	}
+
+	report, err := r.Execute(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Freed) != 1 || report.Freed[0].Digest != ci3 || len(report.Failed) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if !reflect.DeepEqual(f.Deleted, []digest.Digest{ci3}) {
+		t.Errorf("expected only %s to be deleted, got %v", ci3, f.Deleted)
+	}
+}
+
+func Test_Retention_Index(t *testing.T) {
+	f, reg, done := registrytest.New(t)
+	defer done()
+	now := time.Now()
+
+	// Neither index has an image for every platform; each goes by its
+	// newest image.
+	day := 24 * time.Hour
+	s390x := registry.Platform{OS: "linux", Architecture: "s390x"}
+	ppc64le := registry.Platform{OS: "linux", Architecture: "ppc64le"}
+	old := f.PushIndex("app", "release-1",
+		f.PushPlatform("app", "s390x-1", now.Add(-20*day), s390x),
+		f.PushPlatform("app", "ppc64le-1", now.Add(-8*day), ppc64le))
+	f.PushIndex("app", "release-2",
+		f.PushPlatform("app", "s390x-2", now.Add(-10*day), s390x),
+		f.PushPlatform("app", "ppc64le-2", now.Add(-2*day), ppc64le))
+
+	r := &retention.Retention{
+		Registry: reg,
+		Policies: []retention.Policy{{Repositories: []string{"app"}, Tags: []string{"^release-"}, OlderThan: 5 * day}},
+	}
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository := plan.Repositories[0]
+	if len(repository.Delete) != 1 || repository.Delete[0].Digest != old {
+		t.Fatalf("expected to delete release-1, got %+v", repository)
+	}
+	if created := repository.Delete[0].Created; created == nil || now.Sub(*created) > 9*day {
+		t.Errorf("expected release-1 to go by its newest image, got %v", created)
+	}
+	for _, kept := range repository.Keep {
+		if kept.Tag == "release-2" && kept.Reason != "built less than 120h0m0s ago" {
+			t.Errorf("release-2: unexpected reason %q", kept.Reason)
+		}
+	}
+}
+
+func Test_Retention_TagMoved(t *testing.T) {
+	f, reg, done := registrytest.New(t)
+	defer done()
+	now := time.Now()
+
+	old := f.Push("app", "ci-1", now.Add(-10*24*time.Hour))
+	r := &retention.Retention{
+		Registry: reg,
+		Policies: []retention.Policy{{Repositories: []string{"app"}, OlderThan: time.Hour}},
+	}
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Deletions() != 1 || plan.Repositories[0].Delete[0].Digest != old {
+		t.Fatalf("expected to delete %s, got %+v", old, plan.Repositories)
+	}
+
+	// The tag is pushed again between planning and execution.
+	f.Push("app", "ci-1", now)
+
+	report, err := r.Execute(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 1 || !strings.Contains(report.Failed[0].Error, retention.ErrTagMoved.Error()) {
+		t.Errorf("expected the deletion to be refused, got %+v", report)
+	}
+	if len(f.Deleted) != 0 {
+		t.Errorf("expected nothing to be deleted, got %v", f.Deleted)
+	}
+}
+
+func Test_Retention_NewlyProtected(t *testing.T) {
+	for _, protect := range []string{"tag", "index"} {
+		t.Run(protect, func(t *testing.T) {
+			f, reg, done := registrytest.New(t)
+			defer done()
+			now := time.Now()
+
+			old := f.Push("app", "ci-1", now.Add(-10*24*time.Hour))
+			r := &retention.Retention{
+				Registry: reg,
+				Policies: []retention.Policy{{Repositories: []string{"app"}, OlderThan: time.Hour}},
+			}
+			plan, err := r.Plan(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Deletions() != 1 {
+				t.Fatalf("expected to delete %s, got %+v", old, plan.Repositories)
+			}
+
+			// A kept tag comes to depend on the manifest after planning.
+			if protect == "tag" {
+				f.Tag("app", "release-1", old)
+			} else {
+				f.PushIndex("app", "release-1", old)
+			}
+
+			report, err := r.Execute(context.Background(), plan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Failed) != 1 || !strings.Contains(report.Failed[0].Error, retention.ErrTagMoved.Error()) {
+				t.Errorf("expected the deletion to be refused, got %+v", report)
+			}
+			if len(f.Deleted) != 0 {
+				t.Errorf("expected nothing to be deleted, got %v", f.Deleted)
+			}
+		})
+	}
+}
+
+func Test_Retention_InvalidPolicy(t *testing.T) {
+	for _, policy := range []retention.Policy{
+		{Repositories: []string{"app"}},
+		{KeepLast: 1},
+		{Repositories: []string{"app"}, KeepLast: 1, Keep: []string{"("}},
+		{Repositories: []string{"["}, KeepLast: 1},
+	} {
+		r := &retention.Retention{Policies: []retention.Policy{policy}}
+		if _, err := r.Plan(context.Background()); err == nil {
+			t.Errorf("expected %+v to be rejected", policy)
+		}
+	}
+}